@@ -0,0 +1,71 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// FloatingIPPool annotations
+const (
+	// ReconcileAnnotation requests an immediate reconcile of the pool whenever
+	// its value changes, e.g. `kubectl annotate --overwrite ... hcloud.zenjoy.be/reconcile=$(date +%s)`.
+	ReconcileAnnotation = "hcloud.zenjoy.be/reconcile"
+
+	// PausedAnnotation pauses the pool when "true": the planned moves are
+	// only reported as pending moves, requested moves still happen.
+	PausedAnnotation = "hcloud.zenjoy.be/paused"
+
+	// PinAnnotation pins floating ips to nodes regardless of the spreading
+	// and failback policies, e.g. `10.0.0.1=node-1,10.0.0.2=node-2`. A pinned
+	// ip only leaves its node while the node is not eligible.
+	PinAnnotation = "hcloud.zenjoy.be/pin"
+
+	// MoveAnnotation requests a one-shot move of floating ips to a node, or
+	// away from a node with `!`, e.g. `10.0.0.1=node-2,10.0.0.3=!node-1`. The
+	// annotation is removed once the moves are done.
+	MoveAnnotation = "hcloud.zenjoy.be/move"
+)
+
+// Node annotations
+const (
+	// DrainAnnotation drains a node when "true": it gets no floating ips of
+	// any pool and its floating ips move to other nodes right away, e.g.
+	// before maintenance.
+	DrainAnnotation = "hcloud.zenjoy.be/drain"
+)
+
+// ParseAssignments parses the comma separated ip=node pairs of the pin and
+// move annotations by ip. The node may be prefixed with `!`.
+func ParseAssignments(value string) (map[string]string, error) {
+	assignments := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.Trim(strings.TrimSpace(parts[1]), "!") == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected ip=node", strings.TrimSpace(entry))
+		}
+		ip := net.ParseIP(strings.TrimSpace(parts[0]))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", strings.TrimSpace(parts[0]))
+		}
+		assignments[ip.String()] = strings.TrimSpace(parts[1])
+	}
+
+	return assignments, nil
+}
+
+// FormatAssignments returns the ip=node pairs of the pin and move annotations
+// ordered by ip.
+func FormatAssignments(assignments map[string]string) string {
+	entries := make([]string, 0, len(assignments))
+	for ip, node := range assignments {
+		entries = append(entries, ip+"="+node)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
@@ -1,7 +1,9 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // +genclient
@@ -14,6 +16,8 @@ type FloatingIPPool struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
 	Spec FloatinIPPoolSpec `json:"spec"`
+	// +optional
+	Status FloatingIPPoolStatus `json:"status,omitempty"`
 }
 
 // FloatinIPPoolSpec defines a floating ip resource
@@ -25,13 +29,296 @@ type FloatinIPPoolSpec struct {
 	// Query to select a pool of nodes that
 	NodeSelector map[string]string `json:"nodeSelector"`
 
+	// Labels the Hetzner server of a node must have, in addition to the
+	// nodeSelector, for the node to be a target
+	// +optional
+	ServerSelector map[string]string `json:"serverSelector,omitempty"`
+
 	// Frequency for reconcilation loops
 	IntervalSeconds Seconds `json:"intervalSeconds,omitempty"`
+
+	// Key to spread the floating ips over: TopologyLocation,
+	// TopologyDatacenter, TopologyPlacementGroup or any node label, e.g.
+	// topology.kubernetes.io/zone
+	// +optional
+	TopologyKey string `json:"topologyKey,omitempty"`
+
+	// Prefer nodes in the home location of a floating ip
+	// +optional
+	PreferHomeLocation bool `json:"preferHomeLocation,omitempty"`
+
+	// Maximum number or percentage of floating ips that may be unavailable
+	// at the same time while rebalancing or failing back, floating ips that
+	// fail over count as unavailable too. Failovers are never limited
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+
+	// Maximum number of floating ips moved to rebalance the pool or fail
+	// back per interval, 0 for no limit. Failovers are never limited
+	// +optional
+	MaxMovesPerInterval int `json:"maxMovesPerInterval,omitempty"`
+
+	// Time a node may be not ready, or its server not running, before its
+	// floating ips fail over
+	// +optional
+	FailoverAfterSeconds Seconds `json:"failoverAfterSeconds,omitempty"`
+
+	// Time a floating ip stays on a node after it moved before it may be
+	// moved to rebalance the pool
+	// +optional
+	MinHoldSeconds Seconds `json:"minHoldSeconds,omitempty"`
+
+	// Quarantine nodes that keep changing between healthy and failing
+	// +optional
+	Flapping *FlappingPolicy `json:"flapping,omitempty"`
+
+	// Preferred node of floating ips by ip, floating ips without one prefer
+	// the first node they were assigned to
+	// +optional
+	PreferredNodes map[string]string `json:"preferredNodes,omitempty"`
+
+	// When floating ips return to their preferred node
+	// +optional
+	Failback *FailbackPolicy `json:"failback,omitempty"`
+
+	// Only plan the moves and report them in the status and events, without
+	// assigning any floating ip
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// What to do with floating ips that were reassigned outside of the
+	// operator: Enforce (default) or Observe
+	// +optional
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// Secret with the Hetzner Cloud API token of the project the floating
+	// ips belong to, the token of the operator is used when not set
+	// +optional
+	TokenSecretRef *SecretKeyRef `json:"tokenSecretRef,omitempty"`
+}
+
+// SecretKeyRef references a key of a secret
+type SecretKeyRef struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	// Key of the value in the secret, defaults to token
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// FlappingPolicy defines when a node is flapping. A flapping node is
+// quarantined: it gets no new floating ips until it is stable again
+type FlappingPolicy struct {
+	// Number of changes between healthy and failing
+	Transitions int `json:"transitions"`
+
+	// Period the transitions are counted over
+	WindowSeconds Seconds `json:"windowSeconds"`
+}
+
+// FailbackPolicy defines when floating ips return to their preferred node
+// after it recovered
+type FailbackPolicy struct {
+	// Never (default), Immediate, AfterStableSeconds or MaintenanceWindow
+	Mode FailbackMode `json:"mode,omitempty"`
+
+	// Time the preferred node must be healthy before floating ips return
+	// with AfterStableSeconds
+	// +optional
+	StableSeconds Seconds `json:"stableSeconds,omitempty"`
+
+	// Window floating ips return in with MaintenanceWindow
+	// +optional
+	Window *MaintenanceWindow `json:"window,omitempty"`
+}
+
+// FailbackMode is the mode of a failback policy
+type FailbackMode string
+
+// Failback modes
+const (
+	// FailbackNever keeps floating ips on the node they failed over to
+	FailbackNever FailbackMode = "Never"
+	// FailbackImmediate returns floating ips as soon as their preferred node
+	// is eligible again
+	FailbackImmediate FailbackMode = "Immediate"
+	// FailbackAfterStableSeconds returns floating ips once their preferred
+	// node is healthy for stableSeconds
+	FailbackAfterStableSeconds FailbackMode = "AfterStableSeconds"
+	// FailbackMaintenanceWindow returns floating ips during the window only
+	FailbackMaintenanceWindow FailbackMode = "MaintenanceWindow"
+)
+
+// DriftPolicy is what the operator does with floating ips that were
+// reassigned outside of the operator
+type DriftPolicy string
+
+// Drift policies
+const (
+	// DriftEnforce reports the drift and places the floating ips as usual
+	DriftEnforce DriftPolicy = "Enforce"
+	// DriftObserve reports the drift and leaves the floating ips where they
+	// are until the drift is resolved
+	DriftObserve DriftPolicy = "Observe"
+)
+
+// DriftKind is the kind of change made to a floating ip outside of the
+// operator
+type DriftKind string
+
+// Drift kinds
+const (
+	// DriftReassigned is a floating ip assigned to another server
+	DriftReassigned DriftKind = "Reassigned"
+	// DriftUnassigned is a floating ip that is no longer assigned
+	DriftUnassigned DriftKind = "Unassigned"
+)
+
+// MaintenanceWindow is a daily period of time in UTC
+type MaintenanceWindow struct {
+	// Start and end of the window as HH:MM in UTC, a window that ends
+	// before it starts ends the next day
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Days the window starts on, e.g. Sat, every day when empty
+	// +optional
+	Days []string `json:"days,omitempty"`
 }
 
+// Topology keys of the hcloud server of a node
+const (
+	// TopologyLocation spreads the floating ips over hcloud locations
+	TopologyLocation = "hcloud.zenjoy.be/location"
+	// TopologyDatacenter spreads the floating ips over hcloud datacenters
+	TopologyDatacenter = "hcloud.zenjoy.be/datacenter"
+	// TopologyPlacementGroup spreads the floating ips over hcloud placement
+	// groups
+	TopologyPlacementGroup = "hcloud.zenjoy.be/placement-group"
+)
+
 // Seconds is an duration in seconds
 type Seconds int64
 
+// FloatingIPPoolStatus is the observed state of a floating ip pool
+type FloatingIPPoolStatus struct {
+	// Assignment of each floating ip of the pool as verified with the
+	// Hetzner Cloud API
+	IPs []IPStatus `json:"ips,omitempty"`
+
+	// State of the circuit breaker guarding the Hetzner Cloud API: Closed,
+	// Open or HalfOpen. While not Closed only failovers are performed.
+	CircuitBreaker string `json:"circuitBreaker,omitempty"`
+
+	// Nodes that are failing but keep their floating ips until
+	// failoverAfterSeconds passed
+	FailingNodes []FailingNode `json:"failingNodes,omitempty"`
+
+	// Nodes that are flapping and get no new floating ips
+	QuarantinedNodes []string `json:"quarantinedNodes,omitempty"`
+
+	// Whether the pool is paused with the paused annotation
+	Paused bool `json:"paused,omitempty"`
+
+	// Whether the pool only plans its moves because of a dry run
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Moves the paused or dry run pool would make, e.g.
+	// `10.0.0.1 node-1->node-2`
+	PendingMoves []string `json:"pendingMoves,omitempty"`
+
+	// Floating ips that were reassigned outside of the operator and are left
+	// alone with the Observe drift policy
+	Drift []IPDrift `json:"drift,omitempty"`
+
+	// Latest observations of the state of the pool
+	Conditions []PoolCondition `json:"conditions,omitempty"`
+}
+
+// FailingNode is a node that is failing but keeps its floating ips
+type FailingNode struct {
+	Node string `json:"node"`
+
+	// Time the node started failing, the failover grace period continues
+	// from it after a restart of the operator
+	Since metav1.Time `json:"since"`
+}
+
+// PoolConditionType is the type of a condition of a pool
+type PoolConditionType string
+
+// Pool condition types
+const (
+	// PoolCredentialsValid is whether the Hetzner Cloud API token of the pool
+	// can be read and is accepted
+	PoolCredentialsValid PoolConditionType = "CredentialsValid"
+)
+
+// PoolCondition is an observation of the state of a pool
+type PoolCondition struct {
+	Type   PoolConditionType      `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+
+	// Machine readable reason of the last transition and a human readable
+	// message
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Last time the status of the condition changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// IPDrift is a change made to a floating ip outside of the operator
+type IPDrift struct {
+	// Floating IP from Hetzner
+	IP string `json:"ip"`
+
+	// Reassigned or Unassigned
+	Kind DriftKind `json:"kind"`
+
+	// Node and ID of the Hetzner server the operator assigned the floating
+	// ip to
+	ExpectedNode     string `json:"expectedNode,omitempty"`
+	ExpectedServerID int    `json:"expectedServerID,omitempty"`
+
+	// ID of the Hetzner server the floating ip is assigned to now, 0 when
+	// unassigned
+	ServerID int `json:"serverID,omitempty"`
+
+	// The hcloud action that changed the floating ip, when it could be found
+	Cause string `json:"cause,omitempty"`
+
+	// Time the drift was detected
+	DetectedTime metav1.Time `json:"detectedTime,omitempty"`
+}
+
+// IPStatus is the observed assignment of a single floating ip
+type IPStatus struct {
+	// Floating IP from Hetzner
+	IP string `json:"ip"`
+
+	// Node the floating ip is assigned to, empty when not assigned to a node
+	// of the pool
+	Node string `json:"node,omitempty"`
+
+	// ID of the Hetzner server the floating ip is assigned to
+	ServerID int `json:"serverID,omitempty"`
+
+	// Node the floating ip prefers, from the spec or the first node it was
+	// assigned to
+	PreferredNode string `json:"preferredNode,omitempty"`
+
+	// Last time the floating ip moved to another node
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Number of consecutive failed assignments of the floating ip
+	Failures int `json:"failures,omitempty"`
+
+	// Error of the last failed assignment of the floating ip
+	LastError string `json:"lastError,omitempty"`
+}
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 type FloatingIPPoolList struct {
@@ -0,0 +1,192 @@
+// Command kubectl-floatingip is a kubectl plugin to inspect and operate
+// floating ip pools, install it on the PATH and run `kubectl floatingip`.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	floatingipk8scli "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/plugin"
+)
+
+const usage = `Inspect and operate hcloud floating ip pools.
+
+Usage:
+  kubectl floatingip [--kubeconfig FILE] [--context NAME] COMMAND
+
+Commands:
+  list                                  list the pools, the nodes holding their ips and their health
+  describe POOL                         show the ips, pending moves, drift and events of a pool
+  move IP --to NODE [--pool POOL]       move an ip to a node
+  move IP --away-from NODE [--pool POOL]
+                                        move an ip off a node
+  pause POOL                            only report the moves of a pool as pending
+  resume POOL                           resume a paused pool
+  drain-node NODE [--wait DURATION]     move all ips off a node before maintenance
+  drain-node NODE --undo                make a drained node eligible again
+`
+
+// errUsage is returned when the command line is invalid.
+var errUsage = errors.New("invalid usage")
+
+// flagError is returned when a flag is invalid.
+type flagError struct {
+	err error
+}
+
+func (e flagError) Error() string {
+	return e.err.Error()
+}
+
+func main() {
+	err := run(os.Args[1:])
+	if _, ok := err.(flagError); ok {
+		fmt.Fprintf(os.Stderr, "error: %s\n\n", err)
+		err = errUsage
+	}
+	switch {
+	case err == flag.ErrHelp:
+		fmt.Fprint(os.Stdout, usage)
+	case err == errUsage:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	global := newFlagSet("kubectl-floatingip")
+	kubeconfig := global.String("kubeconfig", "", "path to the kubeconfig file")
+	context := global.String("context", "", "name of the kubeconfig context to use")
+	if err := parse(global, args); err != nil {
+		return err
+	}
+
+	if global.NArg() == 0 {
+		return errUsage
+	}
+
+	p, err := newPlugin(*kubeconfig, *context)
+	if err != nil {
+		return err
+	}
+
+	cmd, args := global.Arg(0), global.Args()[1:]
+	flags := newFlagSet(cmd)
+	switch cmd {
+	case "list":
+		return p.List()
+	case "describe":
+		name, err := arg(flags, args)
+		if err != nil {
+			return err
+		}
+		return p.Describe(name)
+	case "move":
+		to := flags.String("to", "", "node to move the ip to")
+		awayFrom := flags.String("away-from", "", "node to move the ip away from")
+		pool := flags.String("pool", "", "pool of the ip, looked up when empty")
+		ip, err := arg(flags, args)
+		if err != nil {
+			return err
+		}
+		return p.Move(ip, *pool, *to, *awayFrom)
+	case "pause":
+		name, err := arg(flags, args)
+		if err != nil {
+			return err
+		}
+		return p.Pause(name)
+	case "resume":
+		name, err := arg(flags, args)
+		if err != nil {
+			return err
+		}
+		return p.Resume(name)
+	case "drain-node":
+		wait := flags.Duration("wait", 0, "wait until the ips left the node, at most this long")
+		undo := flags.Bool("undo", false, "make the node eligible again")
+		node, err := arg(flags, args)
+		if err != nil {
+			return err
+		}
+		return p.DrainNode(node, *undo, *wait)
+	default:
+		return fmt.Errorf("unknown command %q, see kubectl floatingip --help", cmd)
+	}
+}
+
+// newFlagSet returns a flag set that returns its errors instead of exiting,
+// main reports them together with the usage.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	return flags
+}
+
+// parse parses the flags, returning flag.ErrHelp when the usage was asked for
+// and a flagError when a flag is invalid.
+func parse(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return flagError{err}
+	}
+	return err
+}
+
+// arg parses the flags of a command, which may come before or after its single
+// argument, and returns the argument or errUsage when there is not exactly one.
+func arg(flags *flag.FlagSet, args []string) (string, error) {
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		if err := parse(flags, args[1:]); err != nil {
+			return "", err
+		}
+		if flags.NArg() == 0 {
+			return args[0], nil
+		}
+	} else {
+		if err := parse(flags, args); err != nil {
+			return "", err
+		}
+		if flags.NArg() == 1 {
+			return flags.Arg(0), nil
+		}
+	}
+
+	return "", errUsage
+}
+
+// newPlugin returns a plugin for the cluster of the kubeconfig, loaded the
+// same way kubectl does.
+func newPlugin(kubeconfig, context string) (*plugin.Plugin, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("could not load configuration: %s", err)
+	}
+	cfg.Timeout = 30 * time.Second
+
+	k8sCli, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fipCli, err := floatingipk8scli.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return plugin.New(fipCli, k8sCli, os.Stdout), nil
+}
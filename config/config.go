@@ -0,0 +1,197 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/leaderelection"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/operator"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/service"
+)
+
+// Config is the configuration of the operator. It is read from a yaml config
+// file, see manifest-examples/config.yml, the environment and the command
+// line flags override the file.
+type Config struct {
+	// ConfigFile is the yaml config file, empty without one.
+	ConfigFile string `json:"-"`
+	// KubeConfig is the kubernetes configuration used in development mode,
+	// Development runs the operator outside of a kubernetes cluster.
+	KubeConfig  string `json:"-"`
+	Development bool   `json:"-"`
+
+	// LogLevel is the lowest level that is logged: info, warning or error.
+	LogLevel string `json:"logLevel"`
+	// MetricsAddress is the address the prometheus metrics are served on.
+	MetricsAddress string `json:"metricsAddress"`
+	// NodeServerKey is the annotation or label of a node that holds the id
+	// or name of its hcloud server.
+	NodeServerKey string `json:"nodeServerKey"`
+	// DryRun only plans and reports the moves of the pools.
+	DryRun bool `json:"dryRun"`
+
+	Reconcile      ReconcileConfig      `json:"reconcile"`
+	HCloud         HCloudConfig         `json:"hcloud"`
+	LeaderElection LeaderElectionConfig `json:"leaderElection"`
+	PoolDefaults   PoolDefaultsConfig   `json:"poolDefaults"`
+}
+
+// ReconcileConfig configures the reconciles of the pools.
+type ReconcileConfig struct {
+	// ResyncSeconds is the resync period of the pool watcher.
+	ResyncSeconds int `json:"resyncSeconds"`
+	// Workers is the number of pools that are reconciled concurrently.
+	Workers int `json:"workers"`
+	// MaxBackoffSeconds is the maximum delay before retrying a failed
+	// reconcile of a pool.
+	MaxBackoffSeconds int `json:"maxBackoffSeconds"`
+	// ActionTimeoutSeconds is the time an hcloud action may take before it
+	// is considered stuck.
+	ActionTimeoutSeconds int `json:"actionTimeoutSeconds"`
+	// AssignConcurrency is the number of floating ips of a pool that are
+	// assigned in parallel.
+	AssignConcurrency int `json:"assignConcurrency"`
+}
+
+// HCloudConfig configures the hcloud api calls of every hcloud project.
+type HCloudConfig struct {
+	// Token is the token of the operator, it is never read from the config
+	// file. TokenFile is the file with the token, it takes precedence.
+	Token     string `json:"-"`
+	TokenFile string `json:"tokenFile"`
+	// QPS and Burst are the rate limit of the hcloud api calls.
+	QPS   float64 `json:"qps"`
+	Burst int     `json:"burst"`
+	// RefreshSeconds is the maximum age of the hcloud floating ips and
+	// servers.
+	RefreshSeconds int `json:"refreshSeconds"`
+	// CircuitFailureThreshold is the number of consecutive hcloud api
+	// failures that open the circuit breaker, CircuitOpenSeconds how long it
+	// stays open.
+	CircuitFailureThreshold int `json:"circuitFailureThreshold"`
+	CircuitOpenSeconds      int `json:"circuitOpenSeconds"`
+}
+
+// LeaderElectionConfig configures the election of the replica of the
+// operator that reconciles the pools.
+type LeaderElectionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Namespace and Name are the config map that holds the lock.
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// LeaseSeconds is the time the other replicas wait before taking over
+	// from a leader that stopped renewing its lock, RenewDeadlineSeconds the
+	// time the leader keeps trying to renew it and RetryPeriodSeconds the
+	// time between two tries.
+	LeaseSeconds         int `json:"leaseSeconds"`
+	RenewDeadlineSeconds int `json:"renewDeadlineSeconds"`
+	RetryPeriodSeconds   int `json:"retryPeriodSeconds"`
+}
+
+// PoolDefaultsConfig are the settings of the pools that leave them unset.
+type PoolDefaultsConfig struct {
+	IntervalSeconds      int    `json:"intervalSeconds"`
+	FailoverAfterSeconds int    `json:"failoverAfterSeconds"`
+	MinHoldSeconds       int    `json:"minHoldSeconds"`
+	DriftPolicy          string `json:"driftPolicy"`
+}
+
+// Validate returns an error with every invalid setting.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(valid bool, format string, args ...interface{}) {
+		if !valid {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, err := log.ParseLevel(c.LogLevel)
+	check(err == nil, "logLevel: %v", err)
+	check(c.MetricsAddress != "", "metricsAddress: must be set")
+
+	check(c.Reconcile.ResyncSeconds > 0, "reconcile.resyncSeconds: must be positive")
+	check(c.Reconcile.Workers > 0, "reconcile.workers: must be positive")
+	check(c.Reconcile.MaxBackoffSeconds > 0, "reconcile.maxBackoffSeconds: must be positive")
+	check(c.Reconcile.ActionTimeoutSeconds > 0, "reconcile.actionTimeoutSeconds: must be positive")
+	check(c.Reconcile.AssignConcurrency > 0, "reconcile.assignConcurrency: must be positive")
+
+	check(c.HCloud.QPS > 0, "hcloud.qps: must be positive")
+	check(c.HCloud.Burst > 0, "hcloud.burst: must be positive")
+	check(c.HCloud.RefreshSeconds > 0, "hcloud.refreshSeconds: must be positive")
+	check(c.HCloud.CircuitFailureThreshold > 0, "hcloud.circuitFailureThreshold: must be positive")
+	check(c.HCloud.CircuitOpenSeconds > 0, "hcloud.circuitOpenSeconds: must be positive")
+
+	if le := c.LeaderElection; le.Enabled {
+		check(le.Namespace != "", "leaderElection.namespace: must be set")
+		check(le.Name != "", "leaderElection.name: must be set")
+		check(le.RetryPeriodSeconds > 0, "leaderElection.retryPeriodSeconds: must be positive")
+		check(float64(le.RenewDeadlineSeconds) > leaderelection.JitterFactor*float64(le.RetryPeriodSeconds),
+			"leaderElection.renewDeadlineSeconds: must be greater than %g times retryPeriodSeconds", leaderelection.JitterFactor)
+		check(le.LeaseSeconds > le.RenewDeadlineSeconds, "leaderElection.leaseSeconds: must be greater than renewDeadlineSeconds")
+	}
+
+	check(c.PoolDefaults.IntervalSeconds >= 0, "poolDefaults.intervalSeconds: must not be negative")
+	check(c.PoolDefaults.FailoverAfterSeconds >= 0, "poolDefaults.failoverAfterSeconds: must not be negative")
+	check(c.PoolDefaults.MinHoldSeconds >= 0, "poolDefaults.minHoldSeconds: must not be negative")
+	switch hcloudv1alpha1.DriftPolicy(c.PoolDefaults.DriftPolicy) {
+	case "", hcloudv1alpha1.DriftEnforce, hcloudv1alpha1.DriftObserve:
+	default:
+		check(false, "poolDefaults.driftPolicy: unknown drift policy %q, must be %s or %s", c.PoolDefaults.DriftPolicy, hcloudv1alpha1.DriftEnforce, hcloudv1alpha1.DriftObserve)
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// Level returns the log level, info when it is invalid.
+func (c *Config) Level() log.Level {
+	level, _ := log.ParseLevel(c.LogLevel)
+	return level
+}
+
+// OperatorConfig converts the configuration to operator configuration.
+func (c *Config) OperatorConfig() operator.Config {
+	seconds := func(s int) time.Duration { return time.Duration(s) * time.Second }
+
+	return operator.Config{
+		ResyncPeriod:            seconds(c.Reconcile.ResyncSeconds),
+		Workers:                 c.Reconcile.Workers,
+		MaxRetryDelay:           seconds(c.Reconcile.MaxBackoffSeconds),
+		InventoryRefreshPeriod:  seconds(c.HCloud.RefreshSeconds),
+		ActionTimeout:           seconds(c.Reconcile.ActionTimeoutSeconds),
+		AssignConcurrency:       c.Reconcile.AssignConcurrency,
+		HCloudQPS:               c.HCloud.QPS,
+		HCloudBurst:             c.HCloud.Burst,
+		CircuitFailureThreshold: c.HCloud.CircuitFailureThreshold,
+		CircuitOpenPeriod:       seconds(c.HCloud.CircuitOpenSeconds),
+		NodeServerKey:           c.NodeServerKey,
+		DryRun:                  c.DryRun,
+		HCloudTokenFile:         c.HCloud.TokenFile,
+		PoolDefaults: service.PoolDefaults{
+			IntervalSeconds:      hcloudv1alpha1.Seconds(c.PoolDefaults.IntervalSeconds),
+			FailoverAfterSeconds: hcloudv1alpha1.Seconds(c.PoolDefaults.FailoverAfterSeconds),
+			MinHoldSeconds:       hcloudv1alpha1.Seconds(c.PoolDefaults.MinHoldSeconds),
+			DriftPolicy:          hcloudv1alpha1.DriftPolicy(c.PoolDefaults.DriftPolicy),
+		},
+		LeaderElection: operator.LeaderElectionConfig{
+			Enabled:       c.LeaderElection.Enabled,
+			Namespace:     c.LeaderElection.Namespace,
+			Name:          c.LeaderElection.Name,
+			LeaseDuration: seconds(c.LeaderElection.LeaseSeconds),
+			RenewDeadline: seconds(c.LeaderElection.RenewDeadlineSeconds),
+			RetryPeriod:   seconds(c.LeaderElection.RetryPeriodSeconds),
+		},
+	}
+}
+
+// setReloadable copies the settings that can change while the operator runs
+// from src: the log level, the hcloud rate limit and the pool defaults.
+func (c *Config) setReloadable(src *Config) {
+	c.LogLevel = src.LogLevel
+	c.HCloud.QPS = src.HCloud.QPS
+	c.HCloud.Burst = src.HCloud.Burst
+	c.PoolDefaults = src.PoolDefaults
+}
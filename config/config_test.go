@@ -0,0 +1,148 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kooperlog "github.com/spotahome/kooper/log"
+)
+
+// writeConfig writes the yaml config file and returns its path.
+func writeConfig(t *testing.T, dir, data string) string {
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, `
+logLevel: warning
+reconcile:
+  workers: 3
+hcloud:
+  qps: 2.5
+poolDefaults:
+  intervalSeconds: 60
+  driftPolicy: Observe
+`)
+
+	cfg, err := Load([]string{"--workers", "7"}, env(map[string]string{
+		"HCLOUD_FIP_CONFIG":    path,
+		"HCLOUD_FIP_WORKERS":   "5",
+		"HCLOUD_FIP_LOG_LEVEL": "error",
+		"HCLOUD_API_TOKEN":     "token",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"flag over env and file", cfg.Reconcile.Workers, 7},
+		{"env over file", cfg.LogLevel, "error"},
+		{"file over default", cfg.HCloud.QPS, 2.5},
+		{"nested file setting", cfg.PoolDefaults.DriftPolicy, "Observe"},
+		{"default", cfg.HCloud.Burst, 100},
+		{"legacy env", cfg.HCloud.Token, "token"},
+	}
+	for _, test := range tests {
+		if test.got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.got)
+		}
+	}
+
+	op := cfg.OperatorConfig()
+	if op.PoolDefaults.IntervalSeconds != 60 || op.Workers != 7 {
+		t.Errorf("unexpected operator config %+v", op)
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{"unknown setting", "hcloud:\n  qsp: 2\n", `unknown field "qsp"`},
+		{"log level", "logLevel: debug\n", "logLevel"},
+		{"rate limit", "hcloud:\n  qps: 0\n", "hcloud.qps"},
+		{"drift policy", "poolDefaults:\n  driftPolicy: Ignore\n", "poolDefaults.driftPolicy"},
+		{"leader election", "leaderElection:\n  enabled: true\n  leaseSeconds: 5\n", "leaderElection.leaseSeconds"},
+	}
+	for _, test := range tests {
+		path := writeConfig(t, dir, test.config)
+		_, err := Load([]string{"--config", path}, env(nil))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error about %s, got %v", test.name, test.expected, err)
+		}
+	}
+
+	if _, err := Load([]string{"--workers", "two"}, env(nil)); err == nil {
+		t.Errorf("expected an error for an invalid flag")
+	}
+	if _, err := Load(nil, env(map[string]string{"HCLOUD_FIP_DRY_RUN": "maybe"})); err == nil || !strings.Contains(err.Error(), "HCLOUD_FIP_DRY_RUN") {
+		t.Errorf("expected an error for an invalid environment variable, got %v", err)
+	}
+}
+
+func TestReloadAppliesReloadableSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, "reconcile:\n  workers: 3\nhcloud:\n  qps: 1\n")
+
+	args := []string{"--config", path}
+	cfg, err := Load(args, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []*Config
+	r := NewReloader(cfg, args, env(nil), func(cfg *Config) { applied = append(applied, cfg) }, kooperlog.Dummy)
+
+	// Nothing changed yet.
+	r.reload()
+	if len(applied) != 0 {
+		t.Fatalf("expected no reload, got %d", len(applied))
+	}
+
+	writeConfig(t, dir, "logLevel: error\nreconcile:\n  workers: 5\nhcloud:\n  qps: 4\n")
+	r.reload()
+	if len(applied) != 1 {
+		t.Fatalf("expected a reload, got %d", len(applied))
+	}
+	if got := applied[0]; got.LogLevel != "error" || got.HCloud.QPS != 4 || got.Reconcile.Workers != 3 {
+		t.Errorf("expected the log level and rate limit to be reloaded and the workers not, got %+v", got)
+	}
+
+	// An invalid config file keeps the current configuration.
+	writeConfig(t, dir, "hcloud:\n  qps: -1\n")
+	r.reload()
+	if len(applied) != 1 || r.current.HCloud.QPS != 4 {
+		t.Errorf("expected the invalid config file to be ignored, got %+v", r.current)
+	}
+}
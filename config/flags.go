@@ -1,52 +1,152 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
+	"github.com/ghodss/yaml"
 	"k8s.io/client-go/util/homedir"
 
-	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/operator"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/service"
 )
 
-// Flags are the controller flags.
-type Flags struct {
-	flagSet *flag.FlagSet
+const (
+	// envPrefix is the prefix of the environment variables that override
+	// the flags, e.g. HCLOUD_FIP_WORKERS for --workers.
+	envPrefix = "HCLOUD_FIP_"
+)
 
-	ResyncSec   int
-	KubeConfig  string
-	HCloudToken string
-	Development bool
+// envNames are the environment variables of the flags that predate
+// envPrefix.
+var envNames = map[string]string{
+	"hcloud-token":      "HCLOUD_API_TOKEN",
+	"hcloud-token-file": "HCLOUD_API_TOKEN_FILE",
 }
 
-// OperatorConfig converts the command line flag arguments to operator configuration.
-func (f *Flags) OperatorConfig() operator.Config {
-	return operator.Config{
-		ResyncPeriod: time.Duration(f.ResyncSec) * time.Second,
+// EnvName returns the environment variable that overrides the flag.
+func EnvName(flag string) string {
+	if name, ok := envNames[flag]; ok {
+		return name
 	}
+	return envPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
 }
 
-// NewFlags returns a new Flags.
-func NewFlags() *Flags {
-	f := &Flags{
-		flagSet: flag.NewFlagSet(os.Args[0], flag.ExitOnError),
-	}
+// newFlagSet returns the flags of the operator bound to c, c is set to the
+// defaults.
+func newFlagSet(c *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	// Get the user kubernetes configuration in it's home directory.
 	kubehome := filepath.Join(homedir.HomeDir(), ".kube", "config")
 
 	// Init flags.
-	f.flagSet.IntVar(&f.ResyncSec, "resync-seconds", 30, "The number of seconds the controller will resync the resources")
-	f.flagSet.StringVar(&f.KubeConfig, "kubeconfig", kubehome, "kubernetes configuration path, only used when development mode enabled")
-	f.flagSet.BoolVar(&f.Development, "development", false, "development flag will allow to run the operator outside a kubernetes cluster")
-	f.flagSet.StringVar(&f.HCloudToken, "hcloud-token", "", "api token for the hetzner cloud")
+	fs.StringVar(&c.ConfigFile, "config", "", "yaml config file, reloaded when it changes")
+	fs.StringVar(&c.KubeConfig, "kubeconfig", kubehome, "kubernetes configuration path, only used when development mode enabled")
+	fs.BoolVar(&c.Development, "development", false, "development flag will allow to run the operator outside a kubernetes cluster")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "The lowest level that is logged: info, warning or error")
+	fs.StringVar(&c.MetricsAddress, "metrics-address", ":8080", "The address the prometheus metrics are served on")
+	fs.StringVar(&c.NodeServerKey, "node-server-key", service.DefaultNodeServerKey, "The annotation or label of a node that holds the id or name of its hcloud server, used when the node has no hcloud provider id")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "Only plan and report the moves of every pool, without assigning any floating ip")
+
+	fs.IntVar(&c.Reconcile.ResyncSeconds, "resync-seconds", 30, "The number of seconds the controller will resync the resources")
+	fs.IntVar(&c.Reconcile.Workers, "workers", 2, "The number of pools that are reconciled concurrently")
+	fs.IntVar(&c.Reconcile.MaxBackoffSeconds, "max-backoff-seconds", 300, "The maximum number of seconds to wait before retrying a failed reconcile of a pool")
+	fs.IntVar(&c.Reconcile.ActionTimeoutSeconds, "action-timeout-seconds", 60, "The number of seconds an hcloud action may take before it is considered stuck")
+	fs.IntVar(&c.Reconcile.AssignConcurrency, "assign-concurrency", 4, "The number of floating ips of a pool that are assigned in parallel")
+
+	fs.StringVar(&c.HCloud.Token, "hcloud-token", "", "api token for the hetzner cloud")
+	fs.StringVar(&c.HCloud.TokenFile, "hcloud-token-file", "", "file with the api token for the hetzner cloud, e.g. a mounted secret, reloaded when it changes")
+	fs.Float64Var(&c.HCloud.QPS, "hcloud-qps", 1, "The average number of hcloud api calls per second per hcloud project")
+	fs.IntVar(&c.HCloud.Burst, "hcloud-burst", 100, "The maximum burst of hcloud api calls per hcloud project")
+	fs.IntVar(&c.HCloud.RefreshSeconds, "hcloud-refresh-seconds", 5, "The maximum age in seconds of the hcloud floating ips and servers of an hcloud project")
+	fs.IntVar(&c.HCloud.CircuitFailureThreshold, "circuit-failure-threshold", 5, "The number of consecutive hcloud api server errors or timeouts that open the circuit breaker")
+	fs.IntVar(&c.HCloud.CircuitOpenSeconds, "circuit-open-seconds", 30, "The number of seconds the circuit breaker stays open before probing the hcloud api again")
+
+	fs.BoolVar(&c.LeaderElection.Enabled, "leader-elect", false, "Elect the replica of the operator that reconciles the pools")
+	fs.StringVar(&c.LeaderElection.Namespace, "leader-elect-namespace", "kube-system", "The namespace of the leader election config map")
+	fs.StringVar(&c.LeaderElection.Name, "leader-elect-name", "hcloud-floating-ip-operator", "The name of the leader election config map")
+	fs.IntVar(&c.LeaderElection.LeaseSeconds, "leader-elect-lease-seconds", 15, "The number of seconds the other replicas wait before taking over from a leader that stopped renewing its lock")
+	fs.IntVar(&c.LeaderElection.RenewDeadlineSeconds, "leader-elect-renew-deadline-seconds", 10, "The number of seconds the leader keeps trying to renew its lock before it steps down")
+	fs.IntVar(&c.LeaderElection.RetryPeriodSeconds, "leader-elect-retry-period-seconds", 2, "The number of seconds between two tries to acquire or renew the lock")
+
+	fs.IntVar(&c.PoolDefaults.IntervalSeconds, "pool-interval-seconds", 0, "The reconcile interval of the pools that don't set intervalSeconds")
+	fs.IntVar(&c.PoolDefaults.FailoverAfterSeconds, "pool-failover-after-seconds", 0, "The failover grace period of the pools that don't set failoverAfterSeconds")
+	fs.IntVar(&c.PoolDefaults.MinHoldSeconds, "pool-min-hold-seconds", 0, "The minimum hold time of the pools that don't set minHoldSeconds")
+	fs.StringVar(&c.PoolDefaults.DriftPolicy, "pool-drift-policy", "", "The drift policy of the pools that don't set driftPolicy: Enforce or Observe")
+
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage = fmt.Sprintf("%s (env %s)", f.Usage, EnvName(f.Name))
+	})
+	return fs
+}
+
+// Load returns the configuration of the operator from, in increasing order of
+// precedence, the defaults, the config file, the environment and the
+// command line args. The configuration is validated.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	return load(args, getenv, ioutil.ReadFile)
+}
 
-	f.flagSet.Parse(os.Args[1:])
+// load is Load reading the config file with readFile.
+func load(args []string, getenv func(string) string, readFile func(string) ([]byte, error)) (*Config, error) {
+	c := &Config{}
+	fs := newFlagSet(c)
 
-	if len(os.Getenv("HCLOUD_API_TOKEN")) != 0 {
-		f.HCloudToken = os.Getenv("HCLOUD_API_TOKEN")
+	// The config file itself can be set in the environment and the args.
+	if err := parse(fs, args, getenv); err != nil {
+		return nil, err
+	}
+	if c.ConfigFile != "" {
+		data, err := readFile(c.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the config file: %s", err)
+		}
+		if err := unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %s", c.ConfigFile, err)
+		}
+		if err := parse(fs, args, getenv); err != nil {
+			return nil, err
+		}
 	}
 
-	return f
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err)
+	}
+	return c, nil
+}
+
+// parse sets the flags from the environment and then from the args.
+func parse(fs *flag.FlagSet, args []string, getenv func(string) string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := EnvName(f.Name)
+		value := getenv(name)
+		if value == "" || err != nil {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %s", value, name, serr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fs.Parse(args)
+}
+
+// unmarshal sets the settings of the yaml config file on c, the other
+// settings are left alone. Unknown settings are an error.
+func unmarshal(data []byte, c *Config) error {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
 }
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+)
+
+const (
+	// ReloadPeriod is the time between two reads of the config file.
+	ReloadPeriod = 10 * time.Second
+)
+
+// Reloader reloads the config file when it changes. Only the log level, the
+// hcloud rate limit and the pool defaults can change while the operator
+// runs, the other settings are applied on a restart.
+type Reloader struct {
+	args   []string
+	getenv func(string) string
+	apply  func(*Config)
+	logger log.Logger
+
+	// current is the configuration in use and data the config file it was
+	// last loaded from, only used from within a reload.
+	current *Config
+	data    []byte
+}
+
+// NewReloader returns a new reloader of cfg, that was loaded with args and
+// getenv. apply is called with the new configuration when it changed.
+func NewReloader(cfg *Config, args []string, getenv func(string) string, apply func(*Config), logger log.Logger) *Reloader {
+	return &Reloader{
+		args:    args,
+		getenv:  getenv,
+		apply:   apply,
+		logger:  logger,
+		current: cfg,
+	}
+}
+
+// Run reloads the config file every ReloadPeriod until stopC is closed.
+func (r *Reloader) Run(stopC <-chan struct{}) {
+	r.logger.Infof("watching config file %s", r.current.ConfigFile)
+	wait.Until(r.reload, ReloadPeriod, stopC)
+}
+
+// reload reads the config file and, when it changed and is valid, applies
+// the settings that can change while the operator runs. An invalid config
+// file is logged and the current configuration kept.
+func (r *Reloader) reload() {
+	path := r.current.ConfigFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		r.logger.Errorf("error reading config file %s, keeping the current configuration: %s", path, err)
+		return
+	}
+	if r.data != nil && bytes.Equal(data, r.data) {
+		return
+	}
+	r.data = data
+
+	cfg, err := load(r.args, r.getenv, func(string) ([]byte, error) { return data, nil })
+	if err != nil {
+		r.logger.Errorf("error reloading config file %s, keeping the current configuration: %s", path, err)
+		return
+	}
+
+	next := *r.current
+	next.setReloadable(cfg)
+	if !reflect.DeepEqual(&next, cfg) {
+		r.logger.Warningf("config file %s changed settings that can't be reloaded, they are applied on a restart", path)
+	}
+	if reflect.DeepEqual(&next, r.current) {
+		return
+	}
+
+	r.logger.Infof("config file %s changed, reloading the log level, hcloud rate limit and pool defaults", path)
+	r.current = &next
+	r.apply(&next)
+}
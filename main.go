@@ -1,13 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spotahome/kooper/client/crd"
 	applogger "github.com/spotahome/kooper/log"
 	apiextensionscli "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
@@ -18,23 +22,23 @@ import (
 	floatingipk8scli "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned"
 	"github.com/zenjoy/hcloud-floating-ip-operator/config"
 	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/service"
 
 	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/operator"
 )
 
 // Main is the main program.
 type Main struct {
-	flags  *config.Flags
-	config operator.Config
-	logger log.Logger
+	config *config.Config
+	logger *log.Leveled
+	op     operator.Operator
 }
 
 // New returns the main application.
-func New(logger log.Logger) *Main {
-	f := config.NewFlags()
+func New(cfg *config.Config, logger *log.Leveled) *Main {
 	return &Main{
-		flags:  f,
-		config: f.OperatorConfig(),
+		config: cfg,
 		logger: logger,
 	}
 }
@@ -49,15 +53,55 @@ func (m *Main) Run(stopC <-chan struct{}) error {
 		return err
 	}
 
-	hcloudCli := hcloud.NewClient(hcloud.WithToken(m.flags.HCloudToken))
+	// A token file takes precedence over the token flag, it is reloaded
+	// when it changes.
+	hcloudToken := m.config.HCloud.Token
+	if m.config.HCloud.TokenFile != "" {
+		hcloudToken, err = service.ReadTokenFile(m.config.HCloud.TokenFile)
+		if err != nil {
+			return fmt.Errorf("could not read the hcloud token: %s", err)
+		}
+	}
+
+	// Serve the metrics.
+	reg := prometheus.NewRegistry()
+	recorder := metrics.NewPrometheus(reg)
+	go m.serveMetrics(reg)
 
 	// Create the operator and run
-	op, err := operator.New(m.config, fipCli, crdCli, k8sCli, hcloudCli, m.logger)
+	m.op, err = operator.New(m.config.OperatorConfig(), fipCli, crdCli, k8sCli, hcloudToken, newHCloudClient, recorder, m.logger)
 	if err != nil {
 		return err
 	}
 
-	return op.Run(stopC)
+	if m.config.ConfigFile != "" {
+		reloader := config.NewReloader(m.config, os.Args[1:], os.Getenv, m.reload, m.logger)
+		go reloader.Run(stopC)
+	}
+
+	return m.op.Run(stopC)
+}
+
+// reload applies the settings of the reloaded config file.
+func (m *Main) reload(cfg *config.Config) {
+	m.logger.SetLevel(cfg.Level())
+	m.op.Reload(cfg.OperatorConfig())
+}
+
+// newHCloudClient returns an hcloud client that authenticates with the token.
+func newHCloudClient(token string) *hcloud.Client {
+	return hcloud.NewClient(hcloud.WithToken(token))
+}
+
+// serveMetrics serves the metrics of the registry in prometheus format.
+func (m *Main) serveMetrics(reg *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	m.logger.Infof("serving metrics on %s/metrics", m.config.MetricsAddress)
+	if err := http.ListenAndServe(m.config.MetricsAddress, mux); err != nil {
+		m.logger.Errorf("error serving metrics: %s", err)
+	}
 }
 
 // getKubernetesClients returns all the required clients to communicate with
@@ -67,8 +111,8 @@ func (m *Main) getKubernetesClients() (floatingipk8scli.Interface, crd.Interface
 	var cfg *rest.Config
 
 	// If devel mode then use configuration flag path.
-	if m.flags.Development {
-		cfg, err = clientcmd.BuildConfigFromFlags("", m.flags.KubeConfig)
+	if m.config.Development {
+		cfg, err = clientcmd.BuildConfigFromFlags("", m.config.KubeConfig)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("could not load configuration: %s", err)
 		}
@@ -102,13 +146,21 @@ func (m *Main) getKubernetesClients() (floatingipk8scli.Interface, crd.Interface
 }
 
 func main() {
-	logger := &applogger.Std{}
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading the configuration: %s\n", err)
+		os.Exit(2)
+	}
+	logger := log.NewLeveled(&applogger.Std{}, cfg.Level())
 
 	stopC := make(chan struct{})
 	finishC := make(chan error)
 	signalC := make(chan os.Signal, 1)
 	signal.Notify(signalC, syscall.SIGTERM, syscall.SIGINT)
-	m := New(logger)
+	m := New(cfg, logger)
 
 	// Run in background the operator.
 	go func() {
@@ -0,0 +1,156 @@
+package hcloudapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// CircuitState is the state of the circuit breaker.
+type CircuitState string
+
+// Circuit breaker states.
+const (
+	// CircuitClosed means the hcloud api is healthy, all calls are made.
+	CircuitClosed CircuitState = "Closed"
+	// CircuitOpen means the hcloud api is failing, only essential calls are
+	// made.
+	CircuitOpen CircuitState = "Open"
+	// CircuitHalfOpen means the open period is over, a single low priority
+	// call probes whether the circuit closes or opens again.
+	CircuitHalfOpen CircuitState = "HalfOpen"
+)
+
+// Priority is the priority of an hcloud api call.
+type Priority int
+
+// Priorities of hcloud api calls.
+const (
+	// PriorityLow calls, like listing and rebalancing, are not made while the
+	// circuit is open.
+	PriorityLow Priority = iota
+	// PriorityHigh calls, like failover assignments, are always made and go
+	// ahead of the low priority calls waiting for the rate limiter.
+	PriorityHigh
+)
+
+// ErrCircuitOpen is returned for low priority calls while the circuit is open.
+var ErrCircuitOpen = errors.New("hcloud api circuit breaker is open, skipping non-essential call")
+
+// Breaker is a circuit breaker that opens after a number of consecutive
+// server errors or timeouts of the hcloud api.
+type Breaker struct {
+	threshold int
+	openFor   time.Duration
+
+	mutex    sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// probing is true while the probe of the half open circuit is made.
+	probing bool
+}
+
+// NewBreaker returns a new circuit breaker that opens for openFor after
+// threshold consecutive failures.
+func NewBreaker(threshold int, openFor time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold: threshold,
+		openFor:   openFor,
+		state:     CircuitClosed,
+	}
+}
+
+// Allow returns an error when a call with the given priority should not be
+// made, probe is true when the call is the probe of a half open circuit.
+func (b *Breaker) Allow(prio Priority) (probe bool, err error) {
+	if prio == PriorityHigh {
+		return false, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.currentState() {
+	case CircuitOpen:
+		return false, ErrCircuitOpen
+	case CircuitHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// Cancel gives up the probe of a half open circuit when the call is not made
+// after all.
+func (b *Breaker) Cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+// Record records the result of an hcloud api call.
+func (b *Breaker) Record(resp *hcloud.Response, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+
+	if !isFailure(resp, err) {
+		b.failures = 0
+		b.state = CircuitClosed
+		return
+	}
+
+	b.failures++
+	if b.currentState() == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the current state of the circuit.
+func (b *Breaker) State() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.currentState()
+}
+
+// currentState returns the state of the circuit, an open circuit becomes
+// half open once the open period is over. The mutex must be held.
+func (b *Breaker) currentState() CircuitState {
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.openFor {
+		b.state = CircuitHalfOpen
+	}
+	return b.state
+}
+
+// isFailure returns true when the result of a call means the hcloud api is
+// unhealthy: a server error or a timeout. Client errors don't count.
+func isFailure(resp *hcloud.Response, err error) bool {
+	if resp != nil && resp.Response != nil && resp.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	if err == nil {
+		return false
+	}
+	if hcloud.IsError(err, hcloud.ErrorCodeServiceError) {
+		return true
+	}
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package hcloudapi
+
+import (
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// ErrorCodeUnauthorized is the error code of a call with a missing, invalid
+// or revoked token, the hcloud client in use doesn't define it.
+const ErrorCodeUnauthorized hcloud.ErrorCode = "unauthorized"
+
+// IsUnauthorized returns true when the hcloud api rejected the token of the
+// call. Errors wrapped with Wrap and aggregated errors are looked into.
+func IsUnauthorized(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case interface{ Errors() []error }:
+		for _, err := range e.Errors() {
+			if IsUnauthorized(err) {
+				return true
+			}
+		}
+		return false
+	case interface{ Cause() error }:
+		return IsUnauthorized(e.Cause())
+	}
+	return hcloud.IsError(err, ErrorCodeUnauthorized)
+}
+
+// Wrap returns err with the context in front of its message, the cause of
+// the error stays available to IsUnauthorized.
+func Wrap(err error, context string) error {
+	return &wrappedError{context: context, err: err}
+}
+
+// wrappedError is an error with context.
+type wrappedError struct {
+	context string
+	err     error
+}
+
+// Error satisfies error interface.
+func (e *wrappedError) Error() string {
+	return e.context + ": " + e.err.Error()
+}
+
+// Cause returns the wrapped error.
+func (e *wrappedError) Cause() error {
+	return e.err
+}
@@ -0,0 +1,66 @@
+package hcloudapi
+
+import (
+	"context"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// Guard guards all the hcloud api calls of the operator with a shared rate
+// limiter and circuit breaker. Every call is wrapped in Before and After.
+type Guard struct {
+	limiter *Limiter
+	breaker *Breaker
+}
+
+// NewGuard returns a new guard.
+func NewGuard(limiter *Limiter, breaker *Breaker) *Guard {
+	return &Guard{
+		limiter: limiter,
+		breaker: breaker,
+	}
+}
+
+// Before must be called before every hcloud api call, the call must not be
+// made when an error is returned.
+func (g *Guard) Before(ctx context.Context, prio Priority) error {
+	probe, err := g.breaker.Allow(prio)
+	if err != nil {
+		return err
+	}
+	if err := g.limiter.Wait(ctx, prio); err != nil {
+		if probe {
+			g.breaker.Cancel()
+		}
+		return err
+	}
+	return nil
+}
+
+// After must be called with the result of every hcloud api call.
+func (g *Guard) After(resp *hcloud.Response, err error) {
+	g.limiter.Observe(resp, err)
+	g.breaker.Record(resp, err)
+}
+
+// SetRateLimit changes the rate limit of the hcloud api calls.
+func (g *Guard) SetRateLimit(qps float64, burst int) {
+	g.limiter.SetRateLimit(qps, burst)
+}
+
+// Degraded returns true when the circuit is not closed, non-essential work
+// should be skipped.
+func (g *Guard) Degraded() bool {
+	return g.breaker.State() != CircuitClosed
+}
+
+// CircuitState returns the current state of the circuit breaker.
+func (g *Guard) CircuitState() CircuitState {
+	return g.breaker.State()
+}
+
+// Remaining returns the last known number of remaining hcloud api calls,
+// -1 when unknown.
+func (g *Guard) Remaining() int {
+	return g.limiter.Remaining()
+}
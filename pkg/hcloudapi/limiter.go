@@ -0,0 +1,153 @@
+package hcloudapi
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// RateLimitReserve is the number of remaining hcloud api calls below which
+	// the limiter starts slowing down, so the project never runs out of calls
+	// for a failover.
+	RateLimitReserve = 100
+	// minQPS is the lowest rate the limiter slows down to. A call queued
+	// behind a few others still fits well within the action timeout, and the
+	// hcloud api refills the project much faster.
+	minQPS = 0.2
+)
+
+// Limiter is a token bucket rate limiter shared by all the hcloud api calls
+// of the operator, so pools and the inventory don't exhaust the rate limit
+// of the project together. It adapts its rate to the RateLimit-Remaining
+// header of the hcloud responses. High priority calls wait for the bucket
+// too, but low priority calls don't start waiting while a high priority call
+// waits.
+type Limiter struct {
+	qps     float64
+	limiter *rate.Limiter
+
+	mutex     sync.Mutex
+	remaining int
+	// high is the number of waiting high priority calls, idle is closed when
+	// it drops to 0.
+	high int
+	idle chan struct{}
+}
+
+// NewLimiter returns a new limiter that allows qps calls per second on
+// average with bursts of at most burst calls.
+func NewLimiter(qps float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		qps:       qps,
+		limiter:   rate.NewLimiter(rate.Limit(qps), burst),
+		remaining: -1,
+		idle:      make(chan struct{}),
+	}
+}
+
+// Wait blocks until the next hcloud api call with the given priority is
+// allowed or ctx is done. High priority calls go ahead of the low priority
+// calls that didn't start waiting for the bucket yet.
+func (l *Limiter) Wait(ctx context.Context, prio Priority) error {
+	if prio == PriorityHigh {
+		l.mutex.Lock()
+		l.high++
+		limiter := l.limiter
+		l.mutex.Unlock()
+
+		defer func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.high--
+			if l.high == 0 {
+				close(l.idle)
+				l.idle = make(chan struct{})
+			}
+		}()
+		return limiter.Wait(ctx)
+	}
+
+	for {
+		l.mutex.Lock()
+		high, idle, limiter := l.high, l.idle, l.limiter
+		l.mutex.Unlock()
+		if high == 0 {
+			return limiter.Wait(ctx)
+		}
+
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SetRateLimit changes the average number of calls per second and the
+// maximum burst of the limiter.
+func (l *Limiter) SetRateLimit(qps float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.qps = qps
+	if burst != l.limiter.Burst() {
+		// The burst of a rate limiter can't be changed, a waiting call
+		// keeps waiting on the old one.
+		l.limiter = rate.NewLimiter(rate.Limit(qps), burst)
+	}
+	l.adapt()
+}
+
+// Observe adapts the rate of the limiter to the rate limit headers of an
+// hcloud response, resp and err are the result of the call.
+func (l *Limiter) Observe(resp *hcloud.Response, err error) {
+	remaining := -1
+	if resp != nil && resp.Response != nil {
+		if v, perr := strconv.Atoi(resp.Header.Get("RateLimit-Remaining")); perr == nil {
+			remaining = v
+		}
+	}
+	if hcloud.IsError(err, hcloud.ErrorCodeRateLimitExceeded) {
+		remaining = 0
+	}
+	if remaining < 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.remaining = remaining
+	l.adapt()
+}
+
+// adapt sets the rate of the limiter from its qps and the remaining hcloud
+// api calls. The mutex must be held.
+func (l *Limiter) adapt() {
+	qps := l.qps
+	if l.remaining >= 0 && l.remaining < RateLimitReserve {
+		// Slow down proportionally to what is left of the reserve.
+		qps = l.qps * float64(l.remaining) / RateLimitReserve
+		if qps < minQPS {
+			qps = minQPS
+		}
+	}
+	l.limiter.SetLimit(rate.Limit(qps))
+}
+
+// Remaining returns the last known number of remaining hcloud api calls,
+// -1 when unknown.
+func (l *Limiter) Remaining() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.remaining
+}
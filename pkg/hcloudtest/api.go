@@ -0,0 +1,874 @@
+// Package hcloudtest provides an in-memory Hetzner Cloud API for tests. It
+// serves the endpoints the operator uses from programmable state, an hcloud
+// client is pointed at it with hcloud.WithEndpoint.
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Token is the token the api accepts unless another one is set.
+	Token = "hcloudtest"
+
+	// defaultPerPage is the page size of list responses without per_page.
+	defaultPerPage = 25
+)
+
+// FloatingIP is a floating ip of the api.
+type FloatingIP struct {
+	ID int
+	// IP is the address of an ipv4 or the network of an ipv6 floating ip,
+	// e.g. 2001:db8::/64.
+	IP          string
+	Description string
+	// HomeLocation is the name of the home location, e.g. fsn1.
+	HomeLocation string
+	// ServerID is the server the floating ip is assigned to, 0 when it is
+	// not assigned.
+	ServerID int
+}
+
+// Server is a server of the api.
+type Server struct {
+	ID   int
+	Name string
+	// Status is the hcloud status of the server, running when empty.
+	Status string
+	Locked bool
+	// Datacenter and Location are names, e.g. fsn1-dc14 and fsn1.
+	Datacenter string
+	Location   string
+	// IP is the public ipv4 of the server, PrivateIPs its ips in private
+	// networks.
+	IP         string
+	PrivateIPs []string
+	Labels     map[string]string
+	// PlacementGroup is the name of the spread placement group of the
+	// server, empty for none.
+	PlacementGroup string
+}
+
+// Fault is an error returned instead of handling matching requests.
+type Fault struct {
+	// Method and Path select the requests, empty matches all. Path is a
+	// prefix of the request path, e.g. /floating_ips/1/actions.
+	Method string
+	Path   string
+	// Status, Code and Message are the http status and the hcloud error.
+	Status  int
+	Code    string
+	Message string
+	// Times is the number of requests the fault applies to, 0 for all.
+	Times int
+}
+
+// ActionFault makes actions fail instead of succeed.
+type ActionFault struct {
+	// Command selects the actions, e.g. assign_floating_ip, empty matches
+	// all.
+	Command string
+	// Code and Message are the error of the action.
+	Code    string
+	Message string
+	// Lost makes the action succeed without any effect, as if it was lost.
+	Lost bool
+	// Times is the number of actions the fault applies to, 0 for all.
+	Times int
+}
+
+// action is an action of the api, its effect is applied when it finishes.
+type action struct {
+	schema.Action
+	done  time.Time
+	apply func()
+}
+
+// API is an in-memory Hetzner Cloud API served over http.
+type API struct {
+	server *httptest.Server
+
+	mutex          sync.Mutex
+	token          string
+	floatingIPs    map[int]*FloatingIP
+	servers        map[int]*Server
+	actions        map[int]*action
+	nextID         int
+	latency        time.Duration
+	actionDuration time.Duration
+	faults         []*Fault
+	actionFaults   []*ActionFault
+	rateLimit      int
+	remaining      int
+	requestRate    *rate.Limiter
+	throttled      int
+	requests       map[string]int
+}
+
+// NewAPI starts a new empty api, it must be closed when done.
+func NewAPI() *API {
+	a := &API{
+		token:       Token,
+		floatingIPs: map[int]*FloatingIP{},
+		servers:     map[int]*Server{},
+		actions:     map[int]*action{},
+		nextID:      1,
+		requests:    map[string]int{},
+	}
+	a.server = httptest.NewServer(http.HandlerFunc(a.serveHTTP))
+	return a
+}
+
+// URL returns the endpoint of the api.
+func (a *API) URL() string {
+	return a.server.URL
+}
+
+// Close stops the api.
+func (a *API) Close() {
+	a.server.Close()
+}
+
+// Client returns an hcloud client for the api. Rate limited requests are
+// retried every 10ms.
+func (a *API) Client(opts ...hcloud.ClientOption) *hcloud.Client {
+	a.mutex.Lock()
+	token := a.token
+	a.mutex.Unlock()
+
+	opts = append([]hcloud.ClientOption{
+		hcloud.WithEndpoint(a.URL()),
+		hcloud.WithToken(token),
+		hcloud.WithBackoffFunc(func(int) time.Duration { return 10 * time.Millisecond }),
+	}, opts...)
+	return hcloud.NewClient(opts...)
+}
+
+// SetToken sets the token the api accepts, other tokens are unauthorized.
+func (a *API) SetToken(token string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.token = token
+}
+
+// AddServer adds a server and returns its id, a new id is picked when the
+// server has none.
+func (a *API) AddServer(s Server) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if s.ID == 0 {
+		s.ID = a.newID()
+	}
+	if s.Status == "" {
+		s.Status = string(hcloud.ServerStatusRunning)
+	}
+	a.servers[s.ID] = &s
+	return s.ID
+}
+
+// UpdateServer changes a server in place.
+func (a *API) UpdateServer(id int, f func(s *Server)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if s, ok := a.servers[id]; ok {
+		f(s)
+	}
+}
+
+// DeleteServer deletes a server and unassigns its floating ips.
+func (a *API) DeleteServer(id int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.servers, id)
+	for _, fip := range a.floatingIPs {
+		if fip.ServerID == id {
+			fip.ServerID = 0
+		}
+	}
+}
+
+// AddFloatingIP adds a floating ip and returns its id, a new id is picked
+// when the floating ip has none.
+func (a *API) AddFloatingIP(f FloatingIP) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if f.ID == 0 {
+		f.ID = a.newID()
+	}
+	a.floatingIPs[f.ID] = &f
+	return f.ID
+}
+
+// AssignFloatingIP assigns a floating ip right away, 0 unassigns it.
+func (a *API) AssignFloatingIP(id, serverID int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if fip, ok := a.floatingIPs[id]; ok {
+		fip.ServerID = serverID
+	}
+}
+
+// FloatingIP returns a copy of a floating ip, after applying the actions
+// that finished.
+func (a *API) FloatingIP(id int) (FloatingIP, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.settle()
+	fip, ok := a.floatingIPs[id]
+	if !ok {
+		return FloatingIP{}, false
+	}
+	return *fip, true
+}
+
+// Assignments returns the server id of every floating ip by ip, after
+// applying the actions that finished.
+func (a *API) Assignments() map[string]int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.settle()
+	assignments := make(map[string]int, len(a.floatingIPs))
+	for _, fip := range a.floatingIPs {
+		assignments[fip.IP] = fip.ServerID
+	}
+	return assignments
+}
+
+// SetLatency delays every response.
+func (a *API) SetLatency(d time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.latency = d
+}
+
+// SetActionDuration sets the time actions run before they finish, they
+// finish right away by default.
+func (a *API) SetActionDuration(d time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.actionDuration = d
+}
+
+// AddFault injects an error.
+func (a *API) AddFault(f Fault) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.faults = append(a.faults, &f)
+}
+
+// AddActionFault makes actions fail.
+func (a *API) AddActionFault(f ActionFault) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.actionFaults = append(a.actionFaults, &f)
+}
+
+// ClearFaults removes all the injected errors.
+func (a *API) ClearFaults() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.faults = nil
+	a.actionFaults = nil
+}
+
+// SetRateLimit sets the rate limit headers of the responses, 0 disables
+// them. Once remaining reaches 0 requests are rejected with
+// rate_limit_exceeded until the rate limit is set again.
+func (a *API) SetRateLimit(limit, remaining int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rateLimit = limit
+	a.remaining = remaining
+}
+
+// SetRequestRate rejects the requests above qps requests per second, with
+// bursts of at most burst requests, with rate_limit_exceeded.
+func (a *API) SetRequestRate(qps float64, burst int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.requestRate = rate.NewLimiter(rate.Limit(qps), burst)
+}
+
+// Throttled returns the number of requests rejected by the request rate.
+func (a *API) Throttled() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.throttled
+}
+
+// Requests returns the number of requests received for a method and path
+// pattern, e.g. "POST /floating_ips/{id}/actions/assign".
+func (a *API) Requests(route string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.requests[route]
+}
+
+// newID returns a new unique id.
+func (a *API) newID() int {
+	for {
+		id := a.nextID
+		a.nextID++
+		if _, ok := a.floatingIPs[id]; ok {
+			continue
+		}
+		if _, ok := a.servers[id]; ok {
+			continue
+		}
+		return id
+	}
+}
+
+// settle finishes the actions that ran long enough and applies them.
+func (a *API) settle() {
+	now := time.Now()
+
+	ids := make([]int, 0, len(a.actions))
+	for id := range a.actions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		act := a.actions[id]
+		if act.Status != string(hcloud.ActionStatusRunning) || now.Before(act.done) {
+			continue
+		}
+
+		finished := now
+		act.Finished = &finished
+		act.Progress = 100
+		if act.Error != nil {
+			act.Status = string(hcloud.ActionStatusError)
+			continue
+		}
+		act.Status = string(hcloud.ActionStatusSuccess)
+		if act.apply != nil {
+			act.apply()
+		}
+	}
+}
+
+// newAction starts an action on a resource, apply is called when it
+// finishes successfully.
+func (a *API) newAction(command string, resourceID int, resourceType string, apply func()) *action {
+	now := time.Now()
+	act := &action{
+		Action: schema.Action{
+			ID:        a.newID(),
+			Status:    string(hcloud.ActionStatusRunning),
+			Command:   command,
+			Started:   now,
+			Resources: []schema.ActionResourceReference{{ID: resourceID, Type: resourceType}},
+		},
+		done:  now.Add(a.actionDuration),
+		apply: apply,
+	}
+
+	for _, f := range a.actionFaults {
+		if f.Command != "" && f.Command != command {
+			continue
+		}
+		if f.Lost {
+			act.apply = nil
+		} else {
+			act.Error = &schema.ActionError{Code: f.Code, Message: f.Message}
+		}
+		a.actionFaults = consume(a.actionFaults, f)
+		break
+	}
+
+	a.actions[act.ID] = act
+	a.settle()
+	return act
+}
+
+// consume uses up one application of a fault and removes it when it is used
+// up.
+func consume(faults []*ActionFault, f *ActionFault) []*ActionFault {
+	if f.Times == 0 {
+		return faults
+	}
+	f.Times--
+	if f.Times > 0 {
+		return faults
+	}
+	for i := range faults {
+		if faults[i] == f {
+			return append(faults[:i], faults[i+1:]...)
+		}
+	}
+	return faults
+}
+
+// serveHTTP handles every request of the api.
+func (a *API) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	latency := a.latency
+	a.mutex.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	route, params := match(r.Method, r.URL.Path)
+	a.requests[route]++
+
+	if r.Header.Get("Authorization") != "Bearer "+a.token {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "unable to authenticate")
+		return
+	}
+
+	if a.rateLimit > 0 {
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(a.rateLimit))
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		if a.remaining <= 0 {
+			w.Header().Set("RateLimit-Remaining", "0")
+			writeError(w, http.StatusTooManyRequests, string(hcloud.ErrorCodeRateLimitExceeded), "limit of requests per hour reached")
+			return
+		}
+		a.remaining--
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(a.remaining))
+	}
+	if a.requestRate != nil && !a.requestRate.Allow() {
+		a.throttled++
+		writeError(w, http.StatusTooManyRequests, string(hcloud.ErrorCodeRateLimitExceeded), "too many requests")
+		return
+	}
+
+	for i, f := range a.faults {
+		if (f.Method != "" && f.Method != r.Method) || !strings.HasPrefix(r.URL.Path, f.Path) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				a.faults = append(a.faults[:i], a.faults[i+1:]...)
+			}
+		}
+		writeError(w, f.Status, f.Code, f.Message)
+		return
+	}
+
+	a.settle()
+
+	switch route {
+	case "GET /floating_ips":
+		a.listFloatingIPs(w, r)
+	case "POST /floating_ips":
+		a.createFloatingIP(w, r)
+	case "GET /floating_ips/{id}":
+		a.getFloatingIP(w, params)
+	case "DELETE /floating_ips/{id}":
+		a.deleteFloatingIP(w, params)
+	case "POST /floating_ips/{id}/actions/assign":
+		a.assignFloatingIP(w, r, params)
+	case "POST /floating_ips/{id}/actions/unassign":
+		a.unassignFloatingIP(w, params)
+	case "GET /floating_ips/{id}/actions":
+		a.listFloatingIPActions(w, r, params)
+	case "GET /servers":
+		a.listServers(w, r)
+	case "GET /servers/{id}":
+		a.getServer(w, params)
+	case "GET /actions/{id}":
+		a.getAction(w, params)
+	default:
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "not found")
+	}
+}
+
+// match returns the route pattern of a request and its id parameter.
+func match(method, path string) (string, int) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	id := 0
+	for i, part := range parts {
+		if n, err := strconv.Atoi(part); err == nil && i > 0 {
+			parts[i] = "{id}"
+			id = n
+		}
+	}
+	return method + " /" + strings.Join(parts, "/"), id
+}
+
+// listFloatingIPs handles GET /floating_ips.
+func (a *API) listFloatingIPs(w http.ResponseWriter, r *http.Request) {
+	// Lists are never null on the wire.
+	fips := []schema.FloatingIP{}
+	for _, id := range sortedIDs(a.floatingIPs) {
+		fips = append(fips, a.floatingIPSchema(a.floatingIPs[id]))
+	}
+
+	start, end, meta := paginate(r, len(fips))
+	writeJSON(w, http.StatusOK, struct {
+		FloatingIPs []schema.FloatingIP `json:"floating_ips"`
+		Meta        schema.Meta         `json:"meta"`
+	}{fips[start:end], meta})
+}
+
+// createFloatingIP handles POST /floating_ips.
+func (a *API) createFloatingIP(w http.ResponseWriter, r *http.Request) {
+	var req schema.FloatingIPCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, string(hcloud.ErrorCodeInvalidInput), err.Error())
+		return
+	}
+
+	fip := &FloatingIP{ID: a.newID()}
+	fip.IP = fmt.Sprintf("10.%d.%d.%d", fip.ID>>16&0xff, fip.ID>>8&0xff, fip.ID&0xff)
+	if req.Description != nil {
+		fip.Description = *req.Description
+	}
+	if req.HomeLocation != nil {
+		fip.HomeLocation = *req.HomeLocation
+	}
+
+	var act *schema.Action
+	if req.Server != nil {
+		server, ok := a.servers[*req.Server]
+		if !ok {
+			writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "server not found")
+			return
+		}
+		fip.HomeLocation = server.Location
+		act = &a.newAction("assign_floating_ip", fip.ID, "floating_ip", func() { fip.ServerID = server.ID }).Action
+	}
+	a.floatingIPs[fip.ID] = fip
+
+	writeJSON(w, http.StatusCreated, schema.FloatingIPCreateResponse{
+		FloatingIP: a.floatingIPSchema(fip),
+		Action:     act,
+	})
+}
+
+// getFloatingIP handles GET /floating_ips/{id}.
+func (a *API) getFloatingIP(w http.ResponseWriter, id int) {
+	fip, ok := a.floatingIPs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "floating ip not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, schema.FloatingIPGetResponse{FloatingIP: a.floatingIPSchema(fip)})
+}
+
+// deleteFloatingIP handles DELETE /floating_ips/{id}.
+func (a *API) deleteFloatingIP(w http.ResponseWriter, id int) {
+	if _, ok := a.floatingIPs[id]; !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "floating ip not found")
+		return
+	}
+	delete(a.floatingIPs, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// assignFloatingIP handles POST /floating_ips/{id}/actions/assign.
+func (a *API) assignFloatingIP(w http.ResponseWriter, r *http.Request, id int) {
+	fip, ok := a.floatingIPs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "floating ip not found")
+		return
+	}
+
+	var req schema.FloatingIPActionAssignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, string(hcloud.ErrorCodeInvalidInput), err.Error())
+		return
+	}
+	server, ok := a.servers[req.Server]
+	if !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "server not found")
+		return
+	}
+	if server.Locked {
+		writeError(w, http.StatusLocked, "locked", "server is locked")
+		return
+	}
+
+	act := a.newAction("assign_floating_ip", fip.ID, "floating_ip", func() { fip.ServerID = server.ID })
+	writeJSON(w, http.StatusCreated, schema.FloatingIPActionAssignResponse{Action: act.Action})
+}
+
+// unassignFloatingIP handles POST /floating_ips/{id}/actions/unassign.
+func (a *API) unassignFloatingIP(w http.ResponseWriter, id int) {
+	fip, ok := a.floatingIPs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "floating ip not found")
+		return
+	}
+
+	act := a.newAction("unassign_floating_ip", fip.ID, "floating_ip", func() { fip.ServerID = 0 })
+	writeJSON(w, http.StatusCreated, schema.FloatingIPActionUnassignResponse{Action: act.Action})
+}
+
+// listFloatingIPActions handles GET /floating_ips/{id}/actions, newest
+// action first.
+func (a *API) listFloatingIPActions(w http.ResponseWriter, r *http.Request, id int) {
+	if _, ok := a.floatingIPs[id]; !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "floating ip not found")
+		return
+	}
+
+	actions := []schema.Action{}
+	ids := sortedIDs(a.actions)
+	for i := len(ids) - 1; i >= 0; i-- {
+		act := a.actions[ids[i]]
+		for _, res := range act.Resources {
+			if res.Type == "floating_ip" && res.ID == id {
+				actions = append(actions, act.Action)
+				break
+			}
+		}
+	}
+
+	start, end, meta := paginate(r, len(actions))
+	writeJSON(w, http.StatusOK, struct {
+		Actions []schema.Action `json:"actions"`
+		Meta    schema.Meta     `json:"meta"`
+	}{actions[start:end], meta})
+}
+
+// listServers handles GET /servers, filtered by name and label_selector.
+func (a *API) listServers(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	selector := r.URL.Query().Get("label_selector")
+
+	servers := []serverSchema{}
+	for _, id := range sortedIDs(a.servers) {
+		server := a.servers[id]
+		if name != "" && server.Name != name {
+			continue
+		}
+		if !matchLabels(selector, server.Labels) {
+			continue
+		}
+		servers = append(servers, a.serverSchema(server))
+	}
+
+	start, end, meta := paginate(r, len(servers))
+	writeJSON(w, http.StatusOK, struct {
+		Servers []serverSchema `json:"servers"`
+		Meta    schema.Meta    `json:"meta"`
+	}{servers[start:end], meta})
+}
+
+// getServer handles GET /servers/{id}.
+func (a *API) getServer(w http.ResponseWriter, id int) {
+	server, ok := a.servers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "server not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Server serverSchema `json:"server"`
+	}{a.serverSchema(server)})
+}
+
+// getAction handles GET /actions/{id}.
+func (a *API) getAction(w http.ResponseWriter, id int) {
+	act, ok := a.actions[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, string(hcloud.ErrorCodeNotFound), "action not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, schema.ActionGetResponse{Action: act.Action})
+}
+
+// serverSchema is a server on the wire, with the labels, private networks and
+// placement group the hcloud schema package does not know about.
+type serverSchema struct {
+	schema.Server
+	Labels         map[string]string           `json:"labels"`
+	PrivateNet     []serverPrivateNetSchema    `json:"private_net"`
+	PlacementGroup *serverPlacementGroupSchema `json:"placement_group"`
+}
+
+// serverPlacementGroupSchema is the placement group of a server on the wire.
+type serverPlacementGroupSchema struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// serverPrivateNetSchema is a private network of a server on the wire.
+type serverPrivateNetSchema struct {
+	Network int    `json:"network"`
+	IP      string `json:"ip"`
+}
+
+// floatingIPSchema returns the wire format of a floating ip.
+func (a *API) floatingIPSchema(fip *FloatingIP) schema.FloatingIP {
+	s := schema.FloatingIP{
+		ID:           fip.ID,
+		Description:  hcloud.String(fip.Description),
+		IP:           fip.IP,
+		Type:         string(hcloud.FloatingIPTypeIPv4),
+		DNSPtr:       []schema.FloatingIPDNSPtr{},
+		HomeLocation: schema.Location{Name: fip.HomeLocation},
+	}
+	if strings.Contains(fip.IP, ":") {
+		s.Type = string(hcloud.FloatingIPTypeIPv6)
+	}
+	if fip.ServerID != 0 {
+		s.Server = hcloud.Int(fip.ServerID)
+	}
+	return s
+}
+
+// serverSchema returns the wire format of a server.
+func (a *API) serverSchema(server *Server) serverSchema {
+	s := serverSchema{
+		Server: schema.Server{
+			ID:     server.ID,
+			Name:   server.Name,
+			Status: server.Status,
+			Locked: server.Locked,
+			PublicNet: schema.ServerPublicNet{
+				IPv4:        schema.ServerPublicNetIPv4{IP: server.IP},
+				FloatingIPs: []int{},
+			},
+			Datacenter: schema.Datacenter{
+				Name:     server.Datacenter,
+				Location: schema.Location{Name: server.Location},
+			},
+		},
+		Labels:     server.Labels,
+		PrivateNet: []serverPrivateNetSchema{},
+	}
+	for i, ip := range server.PrivateIPs {
+		s.PrivateNet = append(s.PrivateNet, serverPrivateNetSchema{Network: i + 1, IP: ip})
+	}
+	if server.PlacementGroup != "" {
+		s.PlacementGroup = &serverPlacementGroupSchema{Name: server.PlacementGroup, Type: "spread"}
+	}
+	for _, id := range sortedIDs(a.floatingIPs) {
+		if a.floatingIPs[id].ServerID == server.ID {
+			s.PublicNet.FloatingIPs = append(s.PublicNet.FloatingIPs, id)
+		}
+	}
+	if s.Labels == nil {
+		s.Labels = map[string]string{}
+	}
+	return s
+}
+
+// matchLabels returns true when the labels match the comma separated
+// selector of key=value, key!=value, key and !key requirements.
+func matchLabels(selector string, labels map[string]string) bool {
+	for _, req := range strings.Split(selector, ",") {
+		req = strings.TrimSpace(req)
+		switch {
+		case req == "":
+		case strings.Contains(req, "!="):
+			kv := strings.SplitN(req, "!=", 2)
+			if labels[kv[0]] == kv[1] {
+				return false
+			}
+		case strings.Contains(req, "="):
+			kv := strings.SplitN(strings.Replace(req, "==", "=", 1), "=", 2)
+			if v, ok := labels[kv[0]]; !ok || v != kv[1] {
+				return false
+			}
+		case strings.HasPrefix(req, "!"):
+			if _, ok := labels[req[1:]]; ok {
+				return false
+			}
+		default:
+			if _, ok := labels[req]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// paginate returns the range of the requested page of total items and the
+// pagination meta data.
+func paginate(r *http.Request, total int) (int, int, schema.Meta) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+
+	lastPage := (total + perPage - 1) / perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	pagination := &schema.MetaPagination{
+		Page:         page,
+		PerPage:      perPage,
+		LastPage:     lastPage,
+		TotalEntries: total,
+	}
+	if page > 1 {
+		pagination.PreviousPage = page - 1
+	}
+	if page < lastPage {
+		pagination.NextPage = page + 1
+	}
+
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return start, end, schema.Meta{Pagination: pagination}
+}
+
+// sortedIDs returns the keys of a map by id in ascending order.
+func sortedIDs(m interface{}) []int {
+	var ids []int
+	switch m := m.(type) {
+	case map[int]*FloatingIP:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	case map[int]*Server:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	case map[int]*action:
+		for id := range m {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// writeJSON writes a json response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an hcloud error response.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, schema.ErrorResponse{Error: schema.Error{Code: code, Message: message}})
+}
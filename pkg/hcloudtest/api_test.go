@@ -0,0 +1,191 @@
+package hcloudtest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestListPaginates(t *testing.T) {
+	api := NewAPI()
+	defer api.Close()
+	for i := 0; i < 60; i++ {
+		api.AddFloatingIP(FloatingIP{IP: "10.0.0.1"})
+	}
+
+	fips, err := api.Client().FloatingIP.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fips) != 60 {
+		t.Errorf("expected 60 floating ips, got %d", len(fips))
+	}
+	if n := api.Requests("GET /floating_ips"); n != 2 {
+		t.Errorf("expected 2 pages of 50, got %d", n)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	api := NewAPI()
+	defer api.Close()
+	serverID := api.AddServer(Server{Name: "node-1", Location: "fsn1", Datacenter: "fsn1-dc14", IP: "192.168.0.1"})
+	fipID := api.AddFloatingIP(FloatingIP{IP: "10.0.0.1", HomeLocation: "fsn1"})
+	api.SetActionDuration(50 * time.Millisecond)
+
+	ctx := context.Background()
+	cli := api.Client()
+	action, _, err := cli.FloatingIP.Assign(ctx, &hcloud.FloatingIP{ID: fipID}, &hcloud.Server{ID: serverID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Status != hcloud.ActionStatusRunning {
+		t.Errorf("expected a running action, got %s", action.Status)
+	}
+	if fip, _ := api.FloatingIP(fipID); fip.ServerID != 0 {
+		t.Errorf("expected the floating ip to be assigned after the action finished")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	action, _, err = cli.Action.GetByID(ctx, action.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Status != hcloud.ActionStatusSuccess {
+		t.Errorf("expected a successful action, got %s", action.Status)
+	}
+
+	fip, _, err := cli.FloatingIP.GetByID(ctx, fipID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fip.Server == nil || fip.Server.ID != serverID {
+		t.Errorf("expected the floating ip on server %d, got %v", serverID, fip.Server)
+	}
+	if fip.HomeLocation.Name != "fsn1" {
+		t.Errorf("expected home location fsn1, got %s", fip.HomeLocation.Name)
+	}
+
+	server, _, err := cli.Server.GetByID(ctx, serverID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Datacenter.Location.Name != "fsn1" || server.PublicNet.IPv4.IP.String() != "192.168.0.1" {
+		t.Errorf("unexpected server %+v", server)
+	}
+	if len(server.PublicNet.FloatingIPs) != 1 {
+		t.Errorf("expected the floating ip on the server, got %v", server.PublicNet.FloatingIPs)
+	}
+}
+
+func TestFault(t *testing.T) {
+	api := NewAPI()
+	defer api.Close()
+	fipID := api.AddFloatingIP(FloatingIP{IP: "10.0.0.1"})
+	api.AddFault(Fault{Method: "GET", Path: "/floating_ips", Status: http.StatusServiceUnavailable, Code: string(hcloud.ErrorCodeServiceError), Times: 1})
+
+	cli := api.Client()
+	_, _, err := cli.FloatingIP.GetByID(context.Background(), fipID)
+	if !hcloud.IsError(err, hcloud.ErrorCodeServiceError) {
+		t.Errorf("expected a service error, got %v", err)
+	}
+	if _, _, err := cli.FloatingIP.GetByID(context.Background(), fipID); err != nil {
+		t.Errorf("expected the fault to be used up, got %v", err)
+	}
+}
+
+func TestActionFault(t *testing.T) {
+	api := NewAPI()
+	defer api.Close()
+	serverID := api.AddServer(Server{Name: "node-1"})
+	fipID := api.AddFloatingIP(FloatingIP{IP: "10.0.0.1"})
+	api.AddActionFault(ActionFault{Command: "assign_floating_ip", Code: "server_error", Message: "boom", Times: 1})
+	api.AddActionFault(ActionFault{Command: "assign_floating_ip", Lost: true, Times: 1})
+
+	ctx := context.Background()
+	cli := api.Client()
+
+	action, _, err := cli.FloatingIP.Assign(ctx, &hcloud.FloatingIP{ID: fipID}, &hcloud.Server{ID: serverID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Status != hcloud.ActionStatusError || action.ErrorCode != "server_error" {
+		t.Errorf("expected a failed action, got %s %s", action.Status, action.ErrorCode)
+	}
+
+	action, _, err = cli.FloatingIP.Assign(ctx, &hcloud.FloatingIP{ID: fipID}, &hcloud.Server{ID: serverID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Status != hcloud.ActionStatusSuccess {
+		t.Errorf("expected a successful action, got %s", action.Status)
+	}
+	if fip, _ := api.FloatingIP(fipID); fip.ServerID != 0 {
+		t.Errorf("expected the lost action to have no effect")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	api := NewAPI()
+	defer api.Close()
+	api.SetRateLimit(3600, 1)
+
+	cli := api.Client()
+	_, resp, err := cli.Server.List(context.Background(), hcloud.ServerListOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Meta.Ratelimit.Limit != 3600 || resp.Meta.Ratelimit.Remaining != 0 {
+		t.Errorf("unexpected rate limit %+v", resp.Meta.Ratelimit)
+	}
+
+	// The client retries rate limited requests until the limit is reset.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		api.SetRateLimit(3600, 100)
+	}()
+	if _, _, err := cli.Server.List(context.Background(), hcloud.ServerListOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.Requests("GET /servers"); n < 3 {
+		t.Errorf("expected the rate limited request to be retried, got %d requests", n)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	api := NewAPI()
+	defer api.Close()
+
+	api.SetToken("rotated")
+	_, _, err := api.Client(hcloud.WithToken("old")).Server.List(context.Background(), hcloud.ServerListOpts{})
+	if !hcloud.IsError(err, "unauthorized") {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+	if _, _, err := api.Client().Server.List(context.Background(), hcloud.ServerListOpts{}); err != nil {
+		t.Errorf("expected the current token to be accepted, got %v", err)
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	labels := map[string]string{"ingress": "true", "role": "worker"}
+
+	tests := map[string]bool{
+		"":                      true,
+		"ingress=true":          true,
+		"ingress==true":         true,
+		"ingress=false":         false,
+		"role!=master":          true,
+		"role!=worker":          false,
+		"ingress":               true,
+		"!ingress":              false,
+		"!gpu":                  true,
+		"ingress=true,role=web": false,
+	}
+	for selector, expected := range tests {
+		if got := matchLabels(selector, labels); got != expected {
+			t.Errorf("%q: expected %t, got %t", selector, expected, got)
+		}
+	}
+}
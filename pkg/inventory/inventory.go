@@ -0,0 +1,328 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+)
+
+const (
+	// perPage is the number of items listed per hcloud api call.
+	perPage = 50
+)
+
+// Snapshot is a point in time view of the floating ips and servers of the
+// hcloud project. A snapshot is shared between pools and must not be modified.
+type Snapshot struct {
+	// FloatingIPs are all the floating ips of the project.
+	FloatingIPs []*hcloud.FloatingIP
+	// Servers are all the servers of the project.
+	Servers []*hcloud.Server
+	// Time is the moment the snapshot was taken.
+	Time time.Time
+
+	floatingIPsByIP map[string]*hcloud.FloatingIP
+	serversByID     map[int]*hcloud.Server
+	serversByName   map[string]*hcloud.Server
+	serversByIP     map[string]*hcloud.Server
+	details         map[int]serverDetails
+}
+
+// serverDetails are the fields of a server the hcloud client doesn't expose.
+type serverDetails struct {
+	labels map[string]string
+	// privateIPs are the ips of the server in private networks.
+	privateIPs     []string
+	placementGroup string
+}
+
+// newSnapshot returns a new snapshot with all the indexes built, details are
+// the details of the servers by id.
+func newSnapshot(fips []*hcloud.FloatingIP, servers []*hcloud.Server, details map[int]serverDetails, t time.Time) *Snapshot {
+	s := &Snapshot{
+		FloatingIPs:     fips,
+		Servers:         servers,
+		Time:            t,
+		floatingIPsByIP: make(map[string]*hcloud.FloatingIP, len(fips)),
+		serversByID:     make(map[int]*hcloud.Server, len(servers)),
+		serversByName:   make(map[string]*hcloud.Server, len(servers)),
+		serversByIP:     make(map[string]*hcloud.Server, len(servers)),
+		details:         details,
+	}
+
+	for _, fip := range fips {
+		s.floatingIPsByIP[fip.IP.String()] = fip
+	}
+
+	for _, server := range servers {
+		s.serversByID[server.ID] = server
+		s.serversByName[server.Name] = server
+		// Nodes report their private network ip as address, or their public
+		// ipv4 when the server is in no private network.
+		if server.PublicNet.IPv4.IP != nil {
+			s.serversByIP[server.PublicNet.IPv4.IP.String()] = server
+		}
+		for _, ip := range details[server.ID].privateIPs {
+			s.serversByIP[ip] = server
+		}
+	}
+
+	return s
+}
+
+// FloatingIPByIP returns the floating ip with the given ip or nil when the
+// project has no such floating ip.
+func (s *Snapshot) FloatingIPByIP(ip net.IP) *hcloud.FloatingIP {
+	return s.floatingIPsByIP[ip.String()]
+}
+
+// ServerByID returns the server with the given id or nil.
+func (s *Snapshot) ServerByID(id int) *hcloud.Server {
+	return s.serversByID[id]
+}
+
+// ServerByName returns the server with the given name or nil.
+func (s *Snapshot) ServerByName(name string) *hcloud.Server {
+	return s.serversByName[name]
+}
+
+// ServerByIP returns the server with the given private network ip or public
+// ipv4, or nil.
+func (s *Snapshot) ServerByIP(ip string) *hcloud.Server {
+	return s.serversByIP[ip]
+}
+
+// ServerLabels returns the labels of the server with the given id.
+func (s *Snapshot) ServerLabels(id int) map[string]string {
+	return s.details[id].labels
+}
+
+// ServerPlacementGroup returns the name of the placement group of the server
+// with the given id, empty when it is in none.
+func (s *Snapshot) ServerPlacementGroup(id int) string {
+	return s.details[id].placementGroup
+}
+
+// Inventory lists the floating ips and servers of the hcloud project at most
+// once per period and serves all the pools from memory.
+type Inventory struct {
+	hcloudCli *hcloud.Client
+	guard     *hcloudapi.Guard
+	period    time.Duration
+
+	// mutex is never held while listing, so Invalidate doesn't wait for a
+	// refresh. generation is incremented by every Invalidate, snapshot was
+	// listed by a refresh started in snapshotGeneration and is stale when
+	// that is not the current one. refreshing is the refresh in flight,
+	// nil when there is none.
+	mutex              sync.Mutex
+	generation         int
+	snapshot           *Snapshot
+	snapshotGeneration int
+	refreshing         *refresh
+}
+
+// refresh is a refresh of the inventory that all the callers of Get wait
+// for, done is closed when snapshot and err are set. canceled is set when it
+// failed because the context of the caller that ran it ended.
+type refresh struct {
+	generation int
+	done       chan struct{}
+	snapshot   *Snapshot
+	err        error
+	canceled   bool
+}
+
+// New returns a new inventory that is refreshed at most once per period.
+func New(hcloudCli *hcloud.Client, guard *hcloudapi.Guard, period time.Duration) *Inventory {
+	return &Inventory{
+		hcloudCli: hcloudCli,
+		guard:     guard,
+		period:    period,
+	}
+}
+
+// Get returns the current snapshot, it is refreshed first when it is older
+// than the period or has been invalidated. Concurrent callers wait for a
+// single refresh, unless it started before the last Invalidate. While the
+// hcloud api circuit is open the last snapshot is returned, even when it is
+// outdated.
+func (i *Inventory) Get(ctx context.Context) (*Snapshot, error) {
+	for {
+		i.mutex.Lock()
+		if i.snapshot != nil && i.snapshotGeneration == i.generation && time.Since(i.snapshot.Time) < i.period {
+			snapshot := i.snapshot
+			i.mutex.Unlock()
+			return snapshot, nil
+		}
+
+		r := i.refreshing
+		if r == nil || r.generation != i.generation {
+			r = &refresh{generation: i.generation, done: make(chan struct{})}
+			i.refreshing = r
+			i.mutex.Unlock()
+			i.refresh(ctx, r)
+		} else {
+			i.mutex.Unlock()
+			select {
+			case <-r.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		switch {
+		case r.err == nil:
+			return r.snapshot, nil
+		case r.canceled && ctx.Err() == nil:
+			// The caller that ran the refresh gave up, run another one.
+			continue
+		}
+
+		i.mutex.Lock()
+		snapshot := i.snapshot
+		i.mutex.Unlock()
+		if r.err == hcloudapi.ErrCircuitOpen && snapshot != nil {
+			return snapshot, nil
+		}
+		return nil, r.err
+	}
+}
+
+// Invalidate marks the current snapshot as stale, it should be called after
+// every change made to the project so the next Get sees the change. It
+// doesn't wait for a refresh in flight, the next Get starts a new one.
+func (i *Inventory) Invalidate() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.generation++
+}
+
+// refresh runs the refresh and keeps its snapshot unless a later refresh
+// finished first.
+func (i *Inventory) refresh(ctx context.Context, r *refresh) {
+	r.snapshot, r.err = i.list(ctx)
+	r.canceled = r.err != nil && ctx.Err() != nil
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.refreshing == r {
+		i.refreshing = nil
+	}
+	if r.err == nil && (i.snapshot == nil || r.generation >= i.snapshotGeneration) {
+		i.snapshot = r.snapshot
+		i.snapshotGeneration = r.generation
+	}
+	close(r.done)
+}
+
+// list lists all the floating ips and servers of the project.
+func (i *Inventory) list(ctx context.Context) (*Snapshot, error) {
+	now := time.Now()
+
+	fips, err := i.allFloatingIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	servers, details, err := i.allServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSnapshot(fips, servers, details, now), nil
+}
+
+// allFloatingIPs lists all the floating ips of the project page by page.
+func (i *Inventory) allFloatingIPs(ctx context.Context) ([]*hcloud.FloatingIP, error) {
+	var all []*hcloud.FloatingIP
+
+	opts := hcloud.FloatingIPListOpts{}
+	opts.PerPage = perPage
+	for opts.Page = 1; opts.Page > 0; {
+		if err := i.guard.Before(ctx, hcloudapi.PriorityLow); err != nil {
+			return nil, err
+		}
+		fips, resp, err := i.hcloudCli.FloatingIP.List(ctx, opts)
+		i.guard.After(resp, err)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, fips...)
+		opts.Page = nextPage(resp)
+	}
+
+	return all, nil
+}
+
+// serverListResponse is the response of the hcloud api when listing servers.
+// The hcloud client in use does not know about server labels, private
+// networks and placement groups, so the servers are listed with a plain request to get them as
+// well.
+type serverListResponse struct {
+	Servers []struct {
+		schema.Server
+		Labels     map[string]string `json:"labels"`
+		PrivateNet []struct {
+			IP string `json:"ip"`
+		} `json:"private_net"`
+		PlacementGroup *struct {
+			Name string `json:"name"`
+		} `json:"placement_group"`
+	} `json:"servers"`
+}
+
+// allServers lists all the servers of the project with their details page by
+// page.
+func (i *Inventory) allServers(ctx context.Context) ([]*hcloud.Server, map[int]serverDetails, error) {
+	var all []*hcloud.Server
+	details := map[int]serverDetails{}
+
+	for page := 1; page > 0; {
+		if err := i.guard.Before(ctx, hcloudapi.PriorityLow); err != nil {
+			return nil, nil, err
+		}
+		req, err := i.hcloudCli.NewRequest(ctx, "GET", fmt.Sprintf("/servers?page=%d&per_page=%d", page, perPage), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var body serverListResponse
+		resp, err := i.hcloudCli.Do(req, &body)
+		i.guard.After(resp, err)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, s := range body.Servers {
+			server := hcloud.ServerFromSchema(s.Server)
+			all = append(all, server)
+			d := serverDetails{labels: s.Labels}
+			for _, n := range s.PrivateNet {
+				d.privateIPs = append(d.privateIPs, n.IP)
+			}
+			if s.PlacementGroup != nil {
+				d.placementGroup = s.PlacementGroup.Name
+			}
+			details[server.ID] = d
+		}
+		page = nextPage(resp)
+	}
+
+	return all, details, nil
+}
+
+// nextPage returns the next page of a list response, 0 when there is none.
+func nextPage(resp *hcloud.Response) int {
+	if resp == nil || resp.Meta.Pagination == nil {
+		return 0
+	}
+	return resp.Meta.Pagination.NextPage
+}
@@ -0,0 +1,121 @@
+package inventory
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudtest"
+)
+
+func newTestInventory(api *hcloudtest.API, period time.Duration) *Inventory {
+	guard := hcloudapi.NewGuard(hcloudapi.NewLimiter(1000, 1000), hcloudapi.NewBreaker(5, time.Minute))
+	return New(api.Client(), guard, period)
+}
+
+func TestGet(t *testing.T) {
+	api := hcloudtest.NewAPI()
+	defer api.Close()
+	for i := 0; i < 120; i++ {
+		api.AddServer(hcloudtest.Server{Name: "worker", Labels: map[string]string{"ingress": "true"}})
+	}
+	serverID := api.AddServer(hcloudtest.Server{Name: "node-1", IP: "203.0.113.1", PrivateIPs: []string{"192.168.0.1"}, PlacementGroup: "workers"})
+	api.AddFloatingIP(hcloudtest.FloatingIP{IP: "10.0.0.1", ServerID: serverID})
+
+	snapshot, err := newTestInventory(api, time.Minute).Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshot.Servers) != 121 {
+		t.Errorf("expected 121 servers, got %d", len(snapshot.Servers))
+	}
+	if server := snapshot.ServerByName("node-1"); server == nil || server.ID != serverID {
+		t.Errorf("expected node-1 to be server %d, got %v", serverID, server)
+	}
+	for _, ip := range []string{"192.168.0.1", "203.0.113.1"} {
+		if server := snapshot.ServerByIP(ip); server == nil || server.ID != serverID {
+			t.Errorf("expected %s to be server %d, got %v", ip, serverID, server)
+		}
+	}
+	if labels := snapshot.ServerLabels(snapshot.Servers[0].ID); labels["ingress"] != "true" {
+		t.Errorf("expected the server labels, got %v", labels)
+	}
+	if group := snapshot.ServerPlacementGroup(serverID); group != "workers" {
+		t.Errorf("expected the placement group workers, got %q", group)
+	}
+	if group := snapshot.ServerPlacementGroup(snapshot.Servers[0].ID); group != "" {
+		t.Errorf("expected no placement group, got %q", group)
+	}
+
+	fip := snapshot.FloatingIPByIP(net.ParseIP("10.0.0.1"))
+	if fip == nil || fip.Server == nil || fip.Server.ID != serverID {
+		t.Errorf("expected 10.0.0.1 on server %d, got %v", serverID, fip)
+	}
+}
+
+func TestGetCachesUntilInvalidated(t *testing.T) {
+	api := hcloudtest.NewAPI()
+	defer api.Close()
+	api.AddServer(hcloudtest.Server{Name: "node-1"})
+
+	inv := newTestInventory(api, time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := inv.Get(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := api.Requests("GET /servers"); n != 1 {
+		t.Errorf("expected a single refresh, got %d", n)
+	}
+
+	inv.Invalidate()
+	if _, err := inv.Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.Requests("GET /servers"); n != 2 {
+		t.Errorf("expected a refresh after invalidating, got %d", n)
+	}
+}
+
+func TestInvalidateDoesNotWaitForARefresh(t *testing.T) {
+	api := hcloudtest.NewAPI()
+	defer api.Close()
+	api.AddServer(hcloudtest.Server{Name: "node-1"})
+	api.SetLatency(200 * time.Millisecond)
+
+	inv := newTestInventory(api, time.Minute)
+	refreshed := make(chan error)
+	go func() {
+		_, err := inv.Get(context.Background())
+		refreshed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	invalidated := make(chan struct{})
+	go func() {
+		inv.Invalidate()
+		close(invalidated)
+	}()
+	select {
+	case <-invalidated:
+	case <-refreshed:
+		t.Fatal("expected Invalidate to return while the refresh is in flight")
+	}
+
+	// The refresh in flight started before the change, a Get after it runs
+	// its own.
+	api.AddServer(hcloudtest.Server{Name: "node-2"})
+	snapshot, err := inv.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ServerByName("node-2") == nil {
+		t.Errorf("expected the snapshot to have node-2, got %v", snapshot.Servers)
+	}
+	if err := <-refreshed; err != nil {
+		t.Fatal(err)
+	}
+}
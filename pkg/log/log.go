@@ -1,6 +1,9 @@
 package log
 
 import (
+	"fmt"
+	"sync/atomic"
+
 	"github.com/spotahome/kooper/log"
 )
 
@@ -9,3 +12,71 @@ import (
 type Logger interface {
 	log.Logger
 }
+
+// Level is the lowest level of the messages a leveled logger logs.
+type Level int32
+
+// Log levels.
+const (
+	LevelInfo Level = iota
+	LevelWarning
+	LevelError
+)
+
+// ParseLevel returns the level with the name: info, warning or error.
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "info":
+		return LevelInfo, nil
+	case "warning":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, must be info, warning or error", name)
+}
+
+// Leveled is a logger that drops the messages below its level, the level
+// can be changed while the logger is used.
+type Leveled struct {
+	logger Logger
+	level  int32
+}
+
+// NewLeveled returns a new leveled logger that logs to logger.
+func NewLeveled(logger Logger, level Level) *Leveled {
+	return &Leveled{
+		logger: logger,
+		level:  int32(level),
+	}
+}
+
+// SetLevel changes the level of the logger.
+func (l *Leveled) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Leveled) enabled(level Level) bool {
+	return Level(atomic.LoadInt32(&l.level)) <= level
+}
+
+// Infof satisfies Logger interface.
+func (l *Leveled) Infof(format string, args ...interface{}) {
+	if l.enabled(LevelInfo) {
+		l.logger.Infof(format, args...)
+	}
+}
+
+// Warningf satisfies Logger interface.
+func (l *Leveled) Warningf(format string, args ...interface{}) {
+	if l.enabled(LevelWarning) {
+		l.logger.Warningf(format, args...)
+	}
+}
+
+// Errorf satisfies Logger interface.
+func (l *Leveled) Errorf(format string, args ...interface{}) {
+	if l.enabled(LevelError) {
+		l.logger.Errorf(format, args...)
+	}
+}
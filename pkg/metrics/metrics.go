@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "hcloud_floating_ip_operator"
+)
+
+// Recorder knows how to record the metrics of the operator.
+type Recorder interface {
+	// ObserveAssignment records a floating ip assignment of a pool and how
+	// long it took until it was verified (or failed).
+	ObserveAssignment(pool string, err error, duration time.Duration)
+	// ObservePlan records the moves planned by a reconcile of a pool, the
+	// failovers of ips that are not on a node of the pool, the failbacks to
+	// their preferred node, the rebalances of ips that are and the manual
+	// moves of pinned ips and moves requested by an operator.
+	ObservePlan(pool string, failovers, failbacks, rebalances, manual int)
+	// ObserveDrift records a floating ip of a pool that was reassigned outside
+	// of the operator, kind is Reassigned or Unassigned.
+	ObserveDrift(pool, kind string)
+	// SetDriftedIPs sets the number of floating ips of a pool that are left
+	// alone because of unresolved drift.
+	SetDriftedIPs(pool string, drifted int)
+	// SetPoolIPs sets the number of floating ips of a pool that are assigned
+	// to a node of the pool and the number that are not.
+	SetPoolIPs(pool string, assigned, unassigned int)
+	// DeletePool removes all the metrics of a pool.
+	DeletePool(pool string)
+	// SetHCloudAPIState sets the state of the hcloud api circuit breaker and
+	// the number of remaining hcloud api calls (-1 when unknown) of an hcloud
+	// project.
+	SetHCloudAPIState(project, circuitState string, remaining int)
+	// ObserveUnauthorized records a reconcile that failed because the hcloud
+	// api rejected the token of an hcloud project.
+	ObserveUnauthorized(project string)
+	// DeleteProject removes all the metrics of an hcloud project.
+	DeleteProject(project string)
+}
+
+// Dummy is a recorder that doesn't record anything.
+var Dummy Recorder = &dummy{}
+
+type dummy struct{}
+
+func (d *dummy) ObserveAssignment(pool string, err error, duration time.Duration)      {}
+func (d *dummy) ObservePlan(pool string, failovers, failbacks, rebalances, manual int) {}
+func (d *dummy) ObserveDrift(pool, kind string)                                        {}
+func (d *dummy) SetDriftedIPs(pool string, drifted int)                                {}
+func (d *dummy) SetPoolIPs(pool string, assigned, unassigned int)                      {}
+func (d *dummy) DeletePool(pool string)                                                {}
+func (d *dummy) SetHCloudAPIState(project, circuitState string, remaining int)         {}
+func (d *dummy) ObserveUnauthorized(project string)                                    {}
+func (d *dummy) DeleteProject(project string)                                          {}
+
+// Prometheus is a recorder that exposes the metrics in prometheus format.
+type Prometheus struct {
+	assignments        *prometheus.CounterVec
+	assignmentDuration *prometheus.HistogramVec
+	plannedMoves       *prometheus.CounterVec
+	drift              *prometheus.CounterVec
+	driftedIPs         *prometheus.GaugeVec
+	poolIPs            *prometheus.GaugeVec
+	circuitState       *prometheus.GaugeVec
+	rateLimitRemaining *prometheus.GaugeVec
+	unauthorized       *prometheus.CounterVec
+}
+
+// NewPrometheus returns a new prometheus recorder registered on reg.
+func NewPrometheus(reg prometheus.Registerer) *Prometheus {
+	p := &Prometheus{
+		assignments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "assignments_total",
+			Help:      "Number of floating ip assignments by pool and result.",
+		}, []string{"pool", "result"}),
+		assignmentDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "assignment_duration_seconds",
+			Help:      "Time until a floating ip assignment was verified or failed.",
+			Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60},
+		}, []string{"pool"}),
+		plannedMoves: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "planned_moves_total",
+			Help:      "Number of floating ip moves planned by pool and reason.",
+		}, []string{"pool", "reason"}),
+		drift: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "drift_total",
+			Help:      "Number of floating ips reassigned outside of the operator by pool and kind.",
+		}, []string{"pool", "kind"}),
+		driftedIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "drifted_ips",
+			Help:      "Number of floating ips of a pool left alone because of unresolved drift.",
+		}, []string{"pool"}),
+		poolIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pool_ips",
+			Help:      "Number of floating ips of a pool by state.",
+		}, []string{"pool", "state"}),
+		circuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hcloud_circuit_state",
+			Help:      "State of the hcloud api circuit breaker of an hcloud project, 1 for the current state.",
+		}, []string{"project", "state"}),
+		rateLimitRemaining: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hcloud_rate_limit_remaining",
+			Help:      "Last known number of remaining hcloud api calls of an hcloud project.",
+		}, []string{"project"}),
+		unauthorized: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hcloud_unauthorized_total",
+			Help:      "Number of reconciles that failed because the hcloud api rejected the token of an hcloud project.",
+		}, []string{"project"}),
+	}
+
+	reg.MustRegister(
+		p.assignments,
+		p.assignmentDuration,
+		p.plannedMoves,
+		p.drift,
+		p.driftedIPs,
+		p.poolIPs,
+		p.circuitState,
+		p.rateLimitRemaining,
+		p.unauthorized,
+	)
+
+	return p
+}
+
+// ObserveAssignment satisfies Recorder interface.
+func (p *Prometheus) ObserveAssignment(pool string, err error, duration time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	p.assignments.WithLabelValues(pool, result).Inc()
+	p.assignmentDuration.WithLabelValues(pool).Observe(duration.Seconds())
+}
+
+// ObservePlan satisfies Recorder interface.
+func (p *Prometheus) ObservePlan(pool string, failovers, failbacks, rebalances, manual int) {
+	p.plannedMoves.WithLabelValues(pool, "failover").Add(float64(failovers))
+	p.plannedMoves.WithLabelValues(pool, "failback").Add(float64(failbacks))
+	p.plannedMoves.WithLabelValues(pool, "rebalance").Add(float64(rebalances))
+	p.plannedMoves.WithLabelValues(pool, "manual").Add(float64(manual))
+}
+
+// ObserveDrift satisfies Recorder interface.
+func (p *Prometheus) ObserveDrift(pool, kind string) {
+	p.drift.WithLabelValues(pool, kind).Inc()
+}
+
+// SetDriftedIPs satisfies Recorder interface.
+func (p *Prometheus) SetDriftedIPs(pool string, drifted int) {
+	p.driftedIPs.WithLabelValues(pool).Set(float64(drifted))
+}
+
+// SetPoolIPs satisfies Recorder interface.
+func (p *Prometheus) SetPoolIPs(pool string, assigned, unassigned int) {
+	p.poolIPs.WithLabelValues(pool, "assigned").Set(float64(assigned))
+	p.poolIPs.WithLabelValues(pool, "unassigned").Set(float64(unassigned))
+}
+
+// DeletePool satisfies Recorder interface.
+func (p *Prometheus) DeletePool(pool string) {
+	for _, result := range []string{"success", "error"} {
+		p.assignments.DeleteLabelValues(pool, result)
+	}
+	p.assignmentDuration.DeleteLabelValues(pool)
+	for _, reason := range []string{"failover", "failback", "rebalance", "manual"} {
+		p.plannedMoves.DeleteLabelValues(pool, reason)
+	}
+	for _, kind := range []string{"Reassigned", "Unassigned"} {
+		p.drift.DeleteLabelValues(pool, kind)
+	}
+	p.driftedIPs.DeleteLabelValues(pool)
+	for _, state := range []string{"assigned", "unassigned"} {
+		p.poolIPs.DeleteLabelValues(pool, state)
+	}
+}
+
+// SetHCloudAPIState satisfies Recorder interface.
+func (p *Prometheus) SetHCloudAPIState(project, circuitState string, remaining int) {
+	for _, state := range []string{"Closed", "Open", "HalfOpen"} {
+		v := 0.0
+		if state == circuitState {
+			v = 1
+		}
+		p.circuitState.WithLabelValues(project, state).Set(v)
+	}
+	if remaining >= 0 {
+		p.rateLimitRemaining.WithLabelValues(project).Set(float64(remaining))
+	}
+}
+
+// ObserveUnauthorized satisfies Recorder interface.
+func (p *Prometheus) ObserveUnauthorized(project string) {
+	p.unauthorized.WithLabelValues(project).Inc()
+}
+
+// DeleteProject satisfies Recorder interface.
+func (p *Prometheus) DeleteProject(project string) {
+	for _, state := range []string{"Closed", "Open", "HalfOpen"} {
+		p.circuitState.DeleteLabelValues(project, state)
+	}
+	p.rateLimitRemaining.DeleteLabelValues(project)
+	p.unauthorized.DeleteLabelValues(project)
+}
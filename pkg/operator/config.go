@@ -2,10 +2,65 @@ package operator
 
 import (
 	"time"
+
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/service"
 )
 
 // Config is the controller configuration.
 type Config struct {
 	// ResyncPeriod is the resync period of the operator.
 	ResyncPeriod time.Duration
+	// Workers is the number of pools that are reconciled concurrently.
+	Workers int
+	// MaxRetryDelay is the upper bound of the backoff between retries of a
+	// failed reconcile.
+	MaxRetryDelay time.Duration
+	// InventoryRefreshPeriod is the maximum age of the hcloud floating ips and
+	// servers the pools are reconciled with.
+	InventoryRefreshPeriod time.Duration
+	// ActionTimeout is the time an hcloud action may take before it is
+	// considered stuck.
+	ActionTimeout time.Duration
+	// AssignConcurrency is the number of floating ips of a pool that are
+	// assigned in parallel.
+	AssignConcurrency int
+	// HCloudQPS is the average number of hcloud api calls per second.
+	HCloudQPS float64
+	// HCloudBurst is the maximum burst of hcloud api calls.
+	HCloudBurst int
+	// CircuitFailureThreshold is the number of consecutive hcloud api
+	// failures that open the circuit breaker.
+	CircuitFailureThreshold int
+	// CircuitOpenPeriod is the time the circuit breaker stays open.
+	CircuitOpenPeriod time.Duration
+	// NodeServerKey is the annotation or label of a node that holds the id
+	// or name of its hcloud server.
+	NodeServerKey string
+	// DryRun only plans and reports the moves of the pools.
+	DryRun bool
+	// HCloudTokenFile is the file with the hcloud token, reloaded when it
+	// changes.
+	HCloudTokenFile string
+	// PoolDefaults are the settings of the pools that leave them unset.
+	PoolDefaults service.PoolDefaults
+	// LeaderElection elects the replica of the operator that reconciles the
+	// pools.
+	LeaderElection LeaderElectionConfig
+}
+
+// LeaderElectionConfig is the leader election configuration.
+type LeaderElectionConfig struct {
+	// Enabled runs the leader election, without it every replica reconciles
+	// the pools.
+	Enabled bool
+	// Namespace and Name are the config map that holds the lock.
+	Namespace string
+	Name      string
+	// LeaseDuration is the time the other replicas wait before taking over
+	// from a leader that stopped renewing its lock, RenewDeadline the time
+	// the leader keeps trying to renew it and RetryPeriod the time between
+	// two tries.
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
 }
@@ -0,0 +1,29 @@
+package operator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	floatingipscheme "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned/scheme"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+)
+
+const (
+	// eventComponent is the component the events of the operator are reported as.
+	eventComponent = "hcloud-floating-ip-operator"
+)
+
+// newEventRecorder returns an event recorder that writes the events of the
+// operator to kubernetes, it knows about the core and floating ip types.
+func newEventRecorder(kubeCli kubernetes.Interface, logger log.Logger) record.EventRecorder {
+	floatingipscheme.AddToScheme(kubescheme.Scheme)
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(logger.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeCli.CoreV1().Events("")})
+
+	return broadcaster.NewRecorder(kubescheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
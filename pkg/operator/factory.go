@@ -1,28 +1,99 @@
 package operator
 
 import (
-	"github.com/hetznercloud/hcloud-go/hcloud"
 	"github.com/spotahome/kooper/client/crd"
 	"github.com/spotahome/kooper/operator"
 	"github.com/spotahome/kooper/operator/controller"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	floatingipk8scli "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned"
 	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/service"
 )
 
-// New returns floating ip operator.
-func New(cfg Config, floatingIPClie floatingipk8scli.Interface, crdCli crd.Interface, kubeCli kubernetes.Interface, hcloudCli *hcloud.Client, logger log.Logger) (operator.Operator, error) {
+// Operator is the floating ip operator.
+type Operator interface {
+	operator.Operator
+	// Reload applies the settings of cfg that can change while the operator
+	// runs, see service.Service.Reload.
+	Reload(cfg Config)
+}
+
+// floatingIPOperator is the kooper operator that also runs the workers of
+// the ip assigner service.
+type floatingIPOperator struct {
+	operator.Operator
+	cfg     Config
+	kubeCli kubernetes.Interface
+	service *service.Service
+	events  record.EventRecorder
+	logger  log.Logger
+}
+
+// Run satisfies operator.Operator interface.
+func (o *floatingIPOperator) Run(stopC <-chan struct{}) error {
+	if o.cfg.LeaderElection.Enabled {
+		return o.runLeaderElected(stopC)
+	}
+	return o.run(stopC)
+}
+
+// run runs the operator until stopC is closed.
+func (o *floatingIPOperator) run(stopC <-chan struct{}) error {
+	go o.service.Run(stopC)
+	return o.Operator.Run(stopC)
+}
+
+// Reload satisfies Operator interface.
+func (o *floatingIPOperator) Reload(cfg Config) {
+	o.service.Reload(serviceConfig(cfg))
+}
+
+// New returns floating ip operator, hcloudToken is the token of the pools
+// without a token secret.
+func New(cfg Config, floatingIPClie floatingipk8scli.Interface, crdCli crd.Interface, kubeCli kubernetes.Interface, hcloudToken string, newHCloudClient service.HCloudClientFunc, recorder metrics.Recorder, logger log.Logger) (Operator, error) {
 
 	// Create crd.
 	ptCRD := newFloatingIPCRD(floatingIPClie, crdCli, kubeCli)
 
+	// Create service.
+	events := newEventRecorder(kubeCli, logger)
+	svc := service.NewService(serviceConfig(cfg), kubeCli, floatingIPClie, hcloudToken, newHCloudClient, recorder, events, logger)
+
 	// Create handler.
-	handler := newHandler(kubeCli, hcloudCli, logger)
+	handler := newHandler(svc, logger)
 
 	// Create controller.
 	ctrl := controller.NewSequential(cfg.ResyncPeriod, handler, ptCRD, nil, logger)
 
 	// Assemble CRD and controller to create the operator.
-	return operator.NewOperator(ptCRD, ctrl, logger), nil
+	return &floatingIPOperator{
+		Operator: operator.NewOperator(ptCRD, ctrl, logger),
+		cfg:      cfg,
+		kubeCli:  kubeCli,
+		service:  svc,
+		events:   events,
+		logger:   logger,
+	}, nil
+}
+
+// serviceConfig returns the configuration of the ip assigner service.
+func serviceConfig(cfg Config) service.Config {
+	return service.Config{
+		Workers:                 cfg.Workers,
+		MaxRetryDelay:           cfg.MaxRetryDelay,
+		InventoryRefreshPeriod:  cfg.InventoryRefreshPeriod,
+		ActionTimeout:           cfg.ActionTimeout,
+		AssignConcurrency:       cfg.AssignConcurrency,
+		HCloudQPS:               cfg.HCloudQPS,
+		HCloudBurst:             cfg.HCloudBurst,
+		CircuitFailureThreshold: cfg.CircuitFailureThreshold,
+		CircuitOpenPeriod:       cfg.CircuitOpenPeriod,
+		NodeServerKey:           cfg.NodeServerKey,
+		DryRun:                  cfg.DryRun,
+		HCloudTokenFile:         cfg.HCloudTokenFile,
+		PoolDefaults:            cfg.PoolDefaults,
+	}
 }
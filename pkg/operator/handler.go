@@ -4,9 +4,7 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/hetznercloud/hcloud-go/hcloud"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes"
 
 	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
 	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
@@ -21,14 +19,14 @@ type handler struct {
 }
 
 // newHandler returns a new handler.
-func newHandler(k8sCli kubernetes.Interface, hcloudCli *hcloud.Client, logger log.Logger) *handler {
+func newHandler(svc service.Syncer, logger log.Logger) *handler {
 	return &handler{
-		service: service.NewService(k8sCli, hcloudCli, logger),
+		service: svc,
 		logger:  logger,
 	}
 }
 
-// Add will ensure that the required assigner is running.
+// Add will ensure that the pool is reconciled.
 func (h *handler) Add(ctx context.Context, obj runtime.Object) error {
 	fip, ok := obj.(*hcloudv1alpha1.FloatingIPPool)
 	if !ok {
@@ -38,7 +36,7 @@ func (h *handler) Add(ctx context.Context, obj runtime.Object) error {
 	return h.service.EnsureFloatingIPPool(fip)
 }
 
-// Delete will ensure the reuited pod terminator is not running.
+// Delete will ensure the pool is no longer reconciled.
 func (h *handler) Delete(ctx context.Context, name string) error {
 	return h.service.DeleteFloatingIPPool(name)
 }
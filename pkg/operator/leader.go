@@ -0,0 +1,74 @@
+package operator
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// runLeaderElected runs the operator while this replica is the leader. It
+// returns an error when the replica loses the leadership, so it restarts and
+// runs for the leadership again with a clean state.
+func (o *floatingIPOperator) runLeaderElected(stopC <-chan struct{}) error {
+	cfg := o.cfg.LeaderElection
+	id, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("could not get the leader election identity: %s", err)
+	}
+
+	lock, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, cfg.Namespace, cfg.Name, o.kubeCli.CoreV1(), resourcelock.ResourceLockConfig{
+		Identity:      id,
+		EventRecorder: o.events,
+	})
+	if err != nil {
+		return err
+	}
+
+	errC := make(chan error, 2)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: cfg.LeaseDuration,
+		RenewDeadline: cfg.RenewDeadline,
+		RetryPeriod:   cfg.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leadingC <-chan struct{}) {
+				o.logger.Infof("%s is the leader, starting the operator", id)
+				// Stop on a lost leadership and on shutdown.
+				runC := make(chan struct{})
+				go func() {
+					select {
+					case <-leadingC:
+					case <-stopC:
+					}
+					close(runC)
+				}()
+				if err := o.run(runC); err != nil {
+					errC <- err
+				}
+			},
+			OnStoppedLeading: func() {
+				errC <- fmt.Errorf("%s lost the leadership", id)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != id {
+					o.logger.Infof("%s is the leader, waiting for the leadership", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid leader election configuration: %s", err)
+	}
+
+	o.logger.Infof("running for leadership of %s/%s as %s", cfg.Namespace, cfg.Name, id)
+	go elector.Run()
+
+	select {
+	case <-stopC:
+		return nil
+	case err := <-errC:
+		return err
+	}
+}
@@ -0,0 +1,90 @@
+package planner
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// largeCluster returns a pool of nbNodes nodes in 3 domains and nbIPs ips,
+// assigned decides the server id of the i-th ip.
+func largeCluster(nbNodes, nbIPs int, assigned func(i int) int) ([]Node, []IP) {
+	nodes := make([]Node, nbNodes)
+	for i := range nodes {
+		nodes[i] = Node{
+			Name:     fmt.Sprintf("node-%d", i),
+			ServerID: i + 1,
+			Domain:   fmt.Sprintf("zone-%d", i%3),
+			Location: fmt.Sprintf("loc-%d", i%3),
+		}
+	}
+
+	ips := make([]IP, nbIPs)
+	for i := range ips {
+		ips[i] = IP{
+			ID:           i + 1,
+			Address:      fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			HomeLocation: fmt.Sprintf("loc-%d", i%3),
+			ServerID:     assigned(i),
+		}
+	}
+
+	return nodes, ips
+}
+
+func benchmarkPlan(b *testing.B, nbNodes, nbIPs int, assigned func(i int) int) {
+	nodes, ips := largeCluster(nbNodes, nbIPs, assigned)
+	policy := Policy{Rebalance: true, PreferHomeLocation: true, Candidates: 3}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Plan(nodes, ips, policy, rand.New(rand.NewSource(int64(i))))
+	}
+}
+
+// BenchmarkPlanUnassigned places every ip.
+func BenchmarkPlanUnassigned(b *testing.B) {
+	benchmarkPlan(b, 1000, 200, func(i int) int { return 0 })
+}
+
+// BenchmarkPlanBalanced is the steady state, nothing moves.
+func BenchmarkPlanBalanced(b *testing.B) {
+	benchmarkPlan(b, 1000, 200, func(i int) int { return i + 1 })
+}
+
+// BenchmarkPlanRebalance moves the ips off the node that holds all of them.
+func BenchmarkPlanRebalance(b *testing.B) {
+	benchmarkPlan(b, 1000, 200, func(i int) int { return 1 })
+}
+
+// TestPlanScalesLinearly guards against planning becoming quadratic again,
+// planning for 4 times the nodes or 4 times the ips must take less than 8
+// times as long. Timings are unreliable on a busy machine, so it only runs
+// with PLANNER_TIMING set, as make bench does.
+func TestPlanScalesLinearly(t *testing.T) {
+	if os.Getenv("PLANNER_TIMING") == "" {
+		t.Skip("skipping timing test, set PLANNER_TIMING to run it")
+	}
+
+	unassigned := func(i int) int { return 0 }
+	measure := func(nbNodes, nbIPs int) testing.BenchmarkResult {
+		return testing.Benchmark(func(b *testing.B) {
+			benchmarkPlan(b, nbNodes, nbIPs, unassigned)
+		})
+	}
+
+	tests := []struct {
+		name         string
+		small, large testing.BenchmarkResult
+	}{
+		{"nodes", measure(250, 200), measure(1000, 200)},
+		{"ips", measure(1000, 50), measure(1000, 200)},
+	}
+	for _, test := range tests {
+		if ratio := float64(test.large.NsPerOp()) / float64(test.small.NsPerOp()); ratio > 8 {
+			t.Errorf("planning for 4 times the %s took %.1f times as long (%s vs %s)", test.name, ratio, test.large, test.small)
+		}
+	}
+}
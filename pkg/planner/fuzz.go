@@ -0,0 +1,95 @@
+package planner
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// fuzz plans for the nodes, the ips and the assignment the input bytes
+// describe. It panics when a plan breaks an invariant, e.g. leaves an ip
+// without a node or is not deterministic. It is run by go-fuzz through Fuzz
+// and by the tests.
+func fuzz(data []byte) int {
+	if len(data) < 3 {
+		return -1
+	}
+
+	nbNodes, nbIPs, flags := int(data[0]%32), int(data[1]%64), data[2]
+	data = data[3:]
+
+	next := func() int {
+		if len(data) == 0 {
+			return 0
+		}
+		b := data[0]
+		data = data[1:]
+		return int(b)
+	}
+
+	nodes := make([]Node, nbNodes)
+	for i := range nodes {
+		nodes[i] = Node{
+			Name:     fmt.Sprintf("node-%d", i),
+			ServerID: i + 1,
+			Domain:   fmt.Sprintf("zone-%d", next()%4),
+			Location: fmt.Sprintf("loc-%d", next()%4),
+		}
+	}
+
+	ips := make([]IP, nbIPs)
+	for i := range ips {
+		ips[i] = IP{
+			ID:           i + 1,
+			Address:      fmt.Sprintf("10.0.0.%d", i),
+			ServerID:     next() % (nbNodes + 2),
+			HomeLocation: fmt.Sprintf("loc-%d", next()%4),
+			Hold:         next()%8 == 0,
+			Preferred:    fmt.Sprintf("node-%d", next()%(nbNodes+1)),
+			Failback:     flags&4 != 0,
+			Pinned:       next()%4 == 0,
+		}
+	}
+
+	policy := Policy{Rebalance: flags&1 != 0, PreferHomeLocation: flags&2 != 0}
+	moves := Plan(nodes, ips, policy, rand.New(rand.NewSource(int64(flags))))
+	again := Plan(nodes, ips, policy, rand.New(rand.NewSource(int64(flags))))
+	if fmt.Sprint(moves) != fmt.Sprint(again) {
+		panic("plan is not deterministic")
+	}
+
+	if nbNodes == 0 {
+		if len(moves) != 0 {
+			panic("moves without nodes")
+		}
+		return 0
+	}
+
+	placed := map[int]bool{}
+	for _, ip := range ips {
+		if ip.ServerID > 0 && ip.ServerID <= nbNodes {
+			placed[ip.ID] = true
+		}
+	}
+	for _, move := range moves {
+		if move.IP.Hold {
+			panic(fmt.Sprintf("held ip %s moved", move.IP.Address))
+		}
+		if move.To() == move.From {
+			panic(fmt.Sprintf("ip %s moved to its own node", move.IP.Address))
+		}
+		if move.Reason == ReasonFailback && move.To() != move.IP.Preferred {
+			panic(fmt.Sprintf("ip %s failed back to %s instead of %s", move.IP.Address, move.To(), move.IP.Preferred))
+		}
+		if move.Reason == ReasonPinned && move.To() != move.IP.Preferred {
+			panic(fmt.Sprintf("pinned ip %s moved to %s instead of %s", move.IP.Address, move.To(), move.IP.Preferred))
+		}
+		placed[move.IP.ID] = true
+	}
+	for _, ip := range ips {
+		if !placed[ip.ID] && !ip.Hold {
+			panic(fmt.Sprintf("ip %s is not placed", ip.Address))
+		}
+	}
+
+	return 1
+}
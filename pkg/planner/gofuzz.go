@@ -0,0 +1,8 @@
+// +build gofuzz
+
+package planner
+
+// Fuzz is the entry point for go-fuzz.
+func Fuzz(data []byte) int {
+	return fuzz(data)
+}
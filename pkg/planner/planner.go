@@ -0,0 +1,491 @@
+// Package planner decides where the floating ips of a pool should go. It
+// knows nothing about hcloud or kubernetes, given the same input and random
+// source it always returns the same plan.
+package planner
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Reason is the reason a floating ip is moved.
+type Reason string
+
+const (
+	// ReasonUnassigned is a move of an ip that is not assigned to any server.
+	ReasonUnassigned Reason = "Unassigned"
+	// ReasonFailover is a move of an ip whose server is not an eligible node.
+	ReasonFailover Reason = "Failover"
+	// ReasonRebalance is a move of an ip from a node holding more than its
+	// share of the ips.
+	ReasonRebalance Reason = "Rebalance"
+	// ReasonFailback is a move of an ip back to its preferred node.
+	ReasonFailback Reason = "Failback"
+	// ReasonPinned is a move of a pinned ip to the node it is pinned to.
+	ReasonPinned Reason = "Pinned"
+	// ReasonRequested is a move of an ip requested by an operator.
+	ReasonRequested Reason = "Requested"
+)
+
+// Node is an eligible node of the pool and its server.
+type Node struct {
+	Name     string
+	ServerID int
+	// Domain is the topology domain of the node, empty when the pool has no
+	// topology key.
+	Domain string
+	// Location is the hcloud location of the server.
+	Location string
+}
+
+// IP is a floating ip of the pool.
+type IP struct {
+	ID      int
+	Address string
+	// ServerID is the server the ip is assigned to, 0 when it is not
+	// assigned.
+	ServerID int
+	// HomeLocation is the hcloud home location of the ip.
+	HomeLocation string
+	// Hold keeps the ip where it is, e.g. while its assignment is backing off.
+	Hold bool
+	// Preferred is the node the ip goes to whenever it needs a node and the
+	// preferred node is eligible, empty for none.
+	Preferred string
+	// Failback moves the ip back to its eligible preferred node when it is on
+	// another node.
+	Failback bool
+	// Pinned keeps the ip on its preferred node, it moves there whenever the
+	// node is eligible and it is never rebalanced.
+	Pinned bool
+	// MoveTo requests a move of the ip to the given node, MoveAwayFrom a move
+	// off the given node. Requested moves ignore Hold.
+	MoveTo       string
+	MoveAwayFrom string
+}
+
+// Policy is the placement policy of the pool.
+type Policy struct {
+	// Rebalance allows moving ips that are on an eligible node to spread the
+	// ips evenly over the topology domains and the nodes of every domain.
+	Rebalance bool
+	// PreferHomeLocation prefers nodes in the home location of an ip over
+	// equally loaded nodes elsewhere.
+	PreferHomeLocation bool
+	// Candidates is the maximum number of nodes of a move, 0 for all the
+	// nodes. A few candidates keep planning linear in the number of nodes.
+	Candidates int
+}
+
+// Move is the assignment of a floating ip to a node.
+type Move struct {
+	IP IP
+	// From is the node the ip is on, empty when it is not on an eligible node.
+	From string
+	// Nodes are the nodes to assign the ip to from best to worst, at most
+	// Policy.Candidates. The first one is the planned node, the others are
+	// fallbacks.
+	Nodes  []string
+	Reason Reason
+}
+
+// To returns the planned node of the move.
+func (m Move) To() string {
+	return m.Nodes[0]
+}
+
+// Plan returns the moves needed to place every ip of the pool on an eligible
+// node, to move ips back to their preferred node and to spread them evenly
+// when the policy allows rebalancing. Failovers are planned first, then
+// requested moves, pinned ips, failbacks and rebalances. A requested move to a
+// node that is not eligible is not planned. Ties between nodes are broken with
+// rnd, nil keeps the order of the nodes.
+func Plan(nodes []Node, ips []IP, policy Policy, rnd *rand.Rand) []Move {
+	if len(nodes) == 0 || len(ips) == 0 {
+		return nil
+	}
+
+	nodes = shuffle(nodes, rnd)
+	nodesByServerID := make(map[int]*Node, len(nodes))
+	eligible := make(map[string]bool, len(nodes))
+	for i := range nodes {
+		nodesByServerID[nodes[i].ServerID] = &nodes[i]
+		eligible[nodes[i].Name] = true
+	}
+
+	// Ips on an eligible node by node, the others need a node.
+	assignments := map[string][]IP{}
+	var pending, requested, pinned, failbacks []Move
+	for _, ip := range sortedIPs(ips) {
+		node, onNode := nodesByServerID[ip.ServerID]
+		onNode = onNode && ip.ServerID != 0
+		from := ""
+		if onNode {
+			from = node.Name
+		}
+
+		if (ip.MoveTo != "" && ip.MoveTo != from && eligible[ip.MoveTo]) || (ip.MoveAwayFrom != "" && ip.MoveAwayFrom == from) {
+			requested = append(requested, Move{IP: ip, From: from, Reason: ReasonRequested})
+			continue
+		}
+
+		if onNode {
+			switch {
+			case ip.Hold || ip.Preferred == node.Name || !eligible[ip.Preferred]:
+			case ip.Pinned:
+				pinned = append(pinned, Move{IP: ip, From: node.Name, Reason: ReasonPinned})
+				continue
+			case ip.Failback:
+				failbacks = append(failbacks, Move{IP: ip, From: node.Name, Reason: ReasonFailback})
+				continue
+			}
+			assignments[node.Name] = append(assignments[node.Name], ip)
+			continue
+		}
+		if ip.Hold {
+			continue
+		}
+
+		reason := ReasonFailover
+		if ip.ServerID == 0 {
+			reason = ReasonUnassigned
+		}
+		pending = append(pending, Move{IP: ip, Reason: reason})
+	}
+
+	pending = append(pending, requested...)
+	pending = append(pending, pinned...)
+	pending = append(pending, failbacks...)
+
+	var quota *quotas
+	if policy.Rebalance {
+		quota = newQuotas(assignments, nodes, len(ips))
+		pending = append(pending, rebalance(assignments, quota.nodes)...)
+	}
+
+	placement := newPlacement(nodes, assignments, quota)
+
+	var moves []Move
+	for _, move := range pending {
+		best := placement.best(move.IP, policy)
+		// Ips requested to move to a node go there, rebalanced ips go where
+		// they are needed and the others to their preferred node.
+		switch {
+		case move.Reason == ReasonRequested && move.IP.MoveTo != "":
+			best = []int{placement.index[move.IP.MoveTo]}
+		case move.Reason != ReasonRebalance:
+			best = placement.prefer(best, move.IP.Preferred, policy)
+		}
+		if move.IP.MoveAwayFrom != "" {
+			best = placement.without(best, move.IP.MoveAwayFrom)
+		}
+		if len(best) == 0 {
+			continue
+		}
+		placement.assign(best[0])
+
+		move.Nodes = make([]string, len(best))
+		for i, n := range best {
+			move.Nodes[i] = nodes[n].Name
+		}
+		// The ip is already on the best node.
+		if move.To() == move.From {
+			continue
+		}
+		moves = append(moves, move)
+	}
+
+	return moves
+}
+
+// shuffle returns a shuffled copy of the nodes.
+func shuffle(nodes []Node, rnd *rand.Rand) []Node {
+	shuffled := make([]Node, len(nodes))
+	copy(shuffled, nodes)
+	if rnd != nil {
+		rnd.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+	}
+	return shuffled
+}
+
+// sortedIPs returns a copy of the ips ordered by address.
+func sortedIPs(ips []IP) []IP {
+	sorted := make([]IP, len(ips))
+	copy(sorted, ips)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Address < sorted[j].Address
+	})
+	return sorted
+}
+
+// quotas are the number of ips every node may keep so the ips are spread
+// evenly over the topology domains, and over the nodes of every domain.
+type quotas struct {
+	nodes map[string]int
+	// extra and domainExtra are the nodes and domains that keep one ip above
+	// their even share.
+	extra       map[string]bool
+	domainExtra map[string]bool
+}
+
+// newQuotas returns the quotas of the nodes. Domains and nodes that already
+// have more than their share get the remainder, so the fewest ips need to
+// move. The rest of the remainder goes wherever the moved ips are placed.
+func newQuotas(assignments map[string][]IP, nodes []Node, total int) *quotas {
+	var domains []string
+	names := map[string][]string{}
+	domainLoad := map[string]int{}
+	load := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		if _, ok := names[node.Domain]; !ok {
+			domains = append(domains, node.Domain)
+		}
+		names[node.Domain] = append(names[node.Domain], node.Name)
+		load[node.Name] = len(assignments[node.Name])
+		domainLoad[node.Domain] += load[node.Name]
+	}
+
+	q := &quotas{nodes: make(map[string]int, len(nodes)), extra: map[string]bool{}}
+	var shares map[string]int
+	shares, q.domainExtra = share(domains, domainLoad, total)
+	for domain, n := range shares {
+		nodeShares, extra := share(names[domain], load, n)
+		for name, n := range nodeShares {
+			q.nodes[name] = n
+			q.extra[name] = extra[name]
+		}
+	}
+
+	return q
+}
+
+// share divides total evenly over the keys, the keys with the highest load
+// above the even share get the remainder and are returned as extra.
+func share(keys []string, load map[string]int, total int) (map[string]int, map[string]bool) {
+	ordered := make([]string, len(keys))
+	copy(ordered, keys)
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := load[ordered[i]], load[ordered[j]]
+		if a != b {
+			return a > b
+		}
+		return ordered[i] < ordered[j]
+	})
+
+	base, extra := total/len(ordered), total%len(ordered)
+	shares := make(map[string]int, len(ordered))
+	extras := map[string]bool{}
+	for i, key := range ordered {
+		shares[key] = base
+		if i < extra && load[key] > base {
+			shares[key]++
+			extras[key] = true
+		}
+	}
+
+	return shares, extras
+}
+
+// rebalance removes the ips that have to leave their node to reach the quota
+// of every node from assignments and returns their moves. The quotas spread
+// the ips over the topology domains, so ips also leave a domain that holds
+// more than its share. Only nodes above their quota give up ips, held ips,
+// ips on their preferred node and the lowest addresses are kept. Pinned ips
+// count as held, also on another node while their own node is not eligible.
+func rebalance(assignments map[string][]IP, quota map[string]int) []Move {
+	names := make([]string, 0, len(assignments))
+	for name := range assignments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var moves []Move
+	for _, name := range names {
+		ips := assignments[name]
+		if len(ips) <= quota[name] {
+			continue
+		}
+
+		// Held ips first, they can't move, then the ips on their preferred
+		// node.
+		held := func(ip IP) bool {
+			return ip.Hold || ip.Pinned
+		}
+		sort.SliceStable(ips, func(i, j int) bool {
+			if held(ips[i]) != held(ips[j]) {
+				return held(ips[i])
+			}
+			return ips[i].Preferred == name && ips[j].Preferred != name
+		})
+
+		keep := quota[name]
+		for keep < len(ips) && held(ips[keep]) {
+			keep++
+		}
+		for _, ip := range ips[keep:] {
+			moves = append(moves, Move{IP: ip, From: name, Reason: ReasonRebalance})
+		}
+		assignments[name] = ips[:keep]
+	}
+
+	return moves
+}
+
+// placement is the number of ips of every node and topology domain while the
+// moves are planned. Nodes and domains are referred to by index so picking the
+// best nodes for an ip is a single pass over the nodes.
+type placement struct {
+	nodes      []Node
+	index      map[string]int
+	load       []int
+	domain     []int
+	domainLoad []int
+	// extra and domainExtra are 1 for the nodes and domains that keep an ip
+	// above their even share.
+	extra       []int
+	domainExtra []int
+}
+
+// newPlacement returns the placement of the assigned ips, quota is nil when
+// not rebalancing.
+func newPlacement(nodes []Node, assignments map[string][]IP, quota *quotas) *placement {
+	p := &placement{
+		nodes:  nodes,
+		index:  make(map[string]int, len(nodes)),
+		load:   make([]int, len(nodes)),
+		domain: make([]int, len(nodes)),
+		extra:  make([]int, len(nodes)),
+	}
+
+	domains := map[string]int{}
+	for i, node := range nodes {
+		d, ok := domains[node.Domain]
+		if !ok {
+			d = len(domains)
+			domains[node.Domain] = d
+			p.domainLoad = append(p.domainLoad, 0)
+			p.domainExtra = append(p.domainExtra, 0)
+			if quota != nil && quota.domainExtra[node.Domain] {
+				p.domainExtra[d] = 1
+			}
+		}
+		p.index[node.Name] = i
+		p.domain[i] = d
+		p.load[i] = len(assignments[node.Name])
+		p.domainLoad[d] += p.load[i]
+		if quota != nil && quota.extra[node.Name] {
+			p.extra[i] = 1
+		}
+	}
+
+	return p
+}
+
+// assign adds an ip to the i-th node.
+func (p *placement) assign(i int) {
+	p.load[i]++
+	p.domainLoad[p.domain[i]]++
+}
+
+// better returns true when the i-th node is a better node for the ip than
+// the j-th node. Nodes in topology domains with less ips come first, then
+// nodes with less ips and then nodes in the home location of the ip when
+// preferred. This is the order the quotas spread the ips in. The ip a node or
+// domain keeps above its even share is not counted at first, so the quotas
+// are reached and rebalanced ips don't bounce between nodes. Equal nodes keep
+// their (shuffled) order.
+func (p *placement) better(i, j int, ip IP, policy Policy) bool {
+	di, dj := p.domain[i], p.domain[j]
+	if a, b := p.domainLoad[di]-p.domainExtra[di], p.domainLoad[dj]-p.domainExtra[dj]; a != b {
+		return a < b
+	}
+	if p.domainLoad[di] != p.domainLoad[dj] {
+		return p.domainLoad[di] < p.domainLoad[dj]
+	}
+	if a, b := p.load[i]-p.extra[i], p.load[j]-p.extra[j]; a != b {
+		return a < b
+	}
+	if p.load[i] != p.load[j] {
+		return p.load[i] < p.load[j]
+	}
+	if policy.PreferHomeLocation && ip.HomeLocation != "" {
+		hi, hj := p.nodes[i].Location == ip.HomeLocation, p.nodes[j].Location == ip.HomeLocation
+		if hi != hj {
+			return hi
+		}
+	}
+	return i < j
+}
+
+// best returns the indexes of the best nodes for the ip from best to worst, at
+// most policy.Candidates of them.
+func (p *placement) best(ip IP, policy Policy) []int {
+	n := policy.Candidates
+	if n <= 0 || n >= len(p.nodes) {
+		all := make([]int, len(p.nodes))
+		for i := range all {
+			all[i] = i
+		}
+		sort.Slice(all, func(a, b int) bool {
+			return p.better(all[a], all[b], ip, policy)
+		})
+		return all
+	}
+
+	// Keep the n best nodes seen so far in order.
+	best := make([]int, 0, n)
+	for i := range p.nodes {
+		pos := len(best)
+		for pos > 0 && p.better(i, best[pos-1], ip, policy) {
+			pos--
+		}
+		if pos == n {
+			continue
+		}
+		if len(best) < n {
+			best = append(best, 0)
+		}
+		copy(best[pos+1:], best[pos:len(best)-1])
+		best[pos] = i
+	}
+	return best
+}
+
+// prefer moves the preferred node to the front of the best nodes, at most
+// policy.Candidates nodes are kept. The best nodes are returned as is when the
+// preferred node is not eligible.
+func (p *placement) prefer(best []int, preferred string, policy Policy) []int {
+	i, ok := p.index[preferred]
+	if !ok || best[0] == i {
+		return best
+	}
+
+	nodes := []int{i}
+	for _, n := range best {
+		if n != i {
+			nodes = append(nodes, n)
+		}
+	}
+	if policy.Candidates > 0 && len(nodes) > policy.Candidates {
+		nodes = nodes[:policy.Candidates]
+	}
+	return nodes
+}
+
+// without returns the best nodes without the given node.
+func (p *placement) without(best []int, node string) []int {
+	i, ok := p.index[node]
+	if !ok {
+		return best
+	}
+
+	nodes := make([]int, 0, len(best))
+	for _, n := range best {
+		if n != i {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,434 @@
+package planner
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// cluster is a random pool used by the property tests.
+type cluster struct {
+	Nodes []Node
+	IPs   []IP
+	Seed  int64
+}
+
+// Generate satisfies quick.Generator interface.
+func (cluster) Generate(r *rand.Rand, size int) reflect.Value {
+	c := cluster{Seed: r.Int63()}
+
+	nbNodes := r.Intn(size + 1)
+	for i := 0; i < nbNodes; i++ {
+		c.Nodes = append(c.Nodes, Node{
+			Name:     fmt.Sprintf("node-%d", i),
+			ServerID: i + 1,
+			Domain:   fmt.Sprintf("zone-%d", r.Intn(3)),
+			Location: fmt.Sprintf("loc-%d", r.Intn(3)),
+		})
+	}
+
+	nbIPs := r.Intn(size + 1)
+	for i := 0; i < nbIPs; i++ {
+		ip := IP{
+			ID:           i + 1,
+			Address:      fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			HomeLocation: fmt.Sprintf("loc-%d", r.Intn(3)),
+		}
+		// Assigned to an eligible node, to an unknown server or not at all.
+		switch r.Intn(3) {
+		case 0:
+			if nbNodes > 0 {
+				ip.ServerID = r.Intn(nbNodes) + 1
+			}
+		case 1:
+			ip.ServerID = 1000 + r.Intn(10)
+		}
+		c.IPs = append(c.IPs, ip)
+	}
+
+	return reflect.ValueOf(c)
+}
+
+// apply returns the node of every ip after the moves.
+func apply(nodes []Node, ips []IP, moves []Move) map[int]string {
+	nodesByServerID := map[int]string{}
+	for _, node := range nodes {
+		nodesByServerID[node.ServerID] = node.Name
+	}
+
+	result := map[int]string{}
+	for _, ip := range ips {
+		if name, ok := nodesByServerID[ip.ServerID]; ok {
+			result[ip.ID] = name
+		}
+	}
+	for _, move := range moves {
+		result[move.IP.ID] = move.To()
+	}
+	return result
+}
+
+// counts returns the number of ips on every node.
+func counts(nodes []Node, placement map[int]string) map[string]int {
+	c := map[string]int{}
+	for _, node := range nodes {
+		c[node.Name] = 0
+	}
+	for _, name := range placement {
+		c[name]++
+	}
+	return c
+}
+
+// even returns true when the ips are spread evenly over the domains and over
+// the nodes of every domain.
+func even(nodes []Node, placement map[int]string) bool {
+	c := counts(nodes, placement)
+	domains := map[string]int{}
+	byDomain := map[string][]int{}
+	for _, node := range nodes {
+		domains[node.Domain] += c[node.Name]
+		byDomain[node.Domain] = append(byDomain[node.Domain], c[node.Name])
+	}
+
+	var loads []int
+	for _, n := range domains {
+		loads = append(loads, n)
+	}
+	if spread(loads) > 1 {
+		return false
+	}
+	for _, loads := range byDomain {
+		if spread(loads) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// spread returns the difference between the highest and the lowest number.
+func spread(numbers []int) int {
+	min, max := numbers[0], numbers[0]
+	for _, n := range numbers {
+		if n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return max - min
+}
+
+func TestPlanPlacesEveryIP(t *testing.T) {
+	f := func(c cluster) bool {
+		moves := Plan(c.Nodes, c.IPs, Policy{Rebalance: true}, rand.New(rand.NewSource(c.Seed)))
+		if len(c.Nodes) == 0 {
+			return len(moves) == 0
+		}
+		return len(apply(c.Nodes, c.IPs, moves)) == len(c.IPs)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanSpreadsEvenly(t *testing.T) {
+	f := func(c cluster) bool {
+		moves := Plan(c.Nodes, c.IPs, Policy{Rebalance: true}, rand.New(rand.NewSource(c.Seed)))
+		return len(c.Nodes) == 0 || even(c.Nodes, apply(c.Nodes, c.IPs, moves))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanKeepsBalancedAssignments(t *testing.T) {
+	f := func(c cluster) bool {
+		if len(c.Nodes) == 0 {
+			return true
+		}
+		// Balance the ips with a first plan.
+		serverIDs := map[string]int{}
+		for _, node := range c.Nodes {
+			serverIDs[node.Name] = node.ServerID
+		}
+		placement := apply(c.Nodes, c.IPs, Plan(c.Nodes, c.IPs, Policy{Rebalance: true}, rand.New(rand.NewSource(c.Seed))))
+		for i := range c.IPs {
+			c.IPs[i].ServerID = serverIDs[placement[c.IPs[i].ID]]
+		}
+		moves := Plan(c.Nodes, c.IPs, Policy{Rebalance: true}, rand.New(rand.NewSource(c.Seed+1)))
+		return len(moves) == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanOnlyMovesIPsOffEligibleNodesWhenRebalancing(t *testing.T) {
+	f := func(c cluster) bool {
+		for _, move := range Plan(c.Nodes, c.IPs, Policy{}, rand.New(rand.NewSource(c.Seed))) {
+			if move.From != "" || move.Reason == ReasonRebalance {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanIsDeterministic(t *testing.T) {
+	f := func(c cluster) bool {
+		a := Plan(c.Nodes, c.IPs, Policy{Rebalance: true, PreferHomeLocation: true}, rand.New(rand.NewSource(c.Seed)))
+		b := Plan(c.Nodes, c.IPs, Policy{Rebalance: true, PreferHomeLocation: true}, rand.New(rand.NewSource(c.Seed)))
+		return reflect.DeepEqual(a, b)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanNeverMovesHeldIPs(t *testing.T) {
+	f := func(c cluster) bool {
+		for i := range c.IPs {
+			c.IPs[i].Hold = c.IPs[i].ID%2 == 0
+		}
+		for _, move := range Plan(c.Nodes, c.IPs, Policy{Rebalance: true}, rand.New(rand.NewSource(c.Seed))) {
+			if move.IP.Hold {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanCandidatesAreTheBestNodes(t *testing.T) {
+	f := func(c cluster) bool {
+		all := Plan(c.Nodes, c.IPs, Policy{Rebalance: true, PreferHomeLocation: true}, rand.New(rand.NewSource(c.Seed)))
+		few := Plan(c.Nodes, c.IPs, Policy{Rebalance: true, PreferHomeLocation: true, Candidates: 3}, rand.New(rand.NewSource(c.Seed)))
+		if len(all) != len(few) {
+			return false
+		}
+		for i := range all {
+			if len(few[i].Nodes) > 3 || !reflect.DeepEqual(all[i].Nodes[:len(few[i].Nodes)], few[i].Nodes) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanOnlyFailsBackToThePreferredNode(t *testing.T) {
+	f := func(c cluster) bool {
+		for i := range c.IPs {
+			c.IPs[i].Failback = true
+			if len(c.Nodes) > 0 {
+				c.IPs[i].Preferred = c.Nodes[c.IPs[i].ID%len(c.Nodes)].Name
+			}
+		}
+		for _, move := range Plan(c.Nodes, c.IPs, Policy{Rebalance: true}, rand.New(rand.NewSource(c.Seed))) {
+			if move.Reason == ReasonFailback && move.To() != move.IP.Preferred {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanNeverPlacesIPsOnTheNodeToMoveAwayFrom(t *testing.T) {
+	f := func(c cluster) bool {
+		for i := range c.IPs {
+			if len(c.Nodes) > 0 {
+				c.IPs[i].MoveAwayFrom = c.Nodes[c.IPs[i].ID%len(c.Nodes)].Name
+			}
+		}
+		for _, move := range Plan(c.Nodes, c.IPs, Policy{Rebalance: true, Candidates: 3}, rand.New(rand.NewSource(c.Seed))) {
+			for _, node := range move.Nodes {
+				if node == move.IP.MoveAwayFrom {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanFuzzInvariants(t *testing.T) {
+	check := func(data []byte) (ok bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Logf("input %v: %v", data, r)
+				ok = false
+			}
+		}()
+		fuzz(data)
+		return true
+	}
+
+	corpus := [][]byte{
+		nil,
+		{0, 0, 0},
+		{1, 1, 7, 0, 0, 1, 0, 0, 0, 0},
+		{3, 9, 1, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		{8, 20, 7, 0, 1, 1, 2, 2, 3, 3, 0, 0, 1, 1, 2, 2, 3, 3, 255, 128, 64, 32, 16, 8, 4, 2, 1},
+	}
+	for _, data := range corpus {
+		if !check(data) {
+			t.Errorf("plan broke an invariant for %v", data)
+		}
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	nodes := []Node{
+		{Name: "node-1", ServerID: 1, Domain: "fsn1", Location: "fsn1"},
+		{Name: "node-2", ServerID: 2, Domain: "fsn1", Location: "fsn1"},
+		{Name: "node-3", ServerID: 3, Domain: "nbg1", Location: "nbg1"},
+	}
+
+	tests := []struct {
+		name   string
+		ips    []IP
+		policy Policy
+		moves  []string
+	}{
+		{
+			name: "unassigned ips are spread over the domains",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1"},
+				{ID: 2, Address: "10.0.0.2"},
+			},
+			policy: Policy{Rebalance: true},
+			moves:  []string{"10.0.0.1 -> node-1 (Unassigned)", "10.0.0.2 -> node-3 (Unassigned)"},
+		},
+		{
+			name: "ips on an unknown server fail over",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 3},
+				{ID: 2, Address: "10.0.0.2", ServerID: 42},
+			},
+			policy: Policy{Rebalance: true},
+			moves:  []string{"10.0.0.2 -> node-1 (Failover)"},
+		},
+		{
+			name: "only the surplus ips of a node are rebalanced",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 1},
+				{ID: 2, Address: "10.0.0.2", ServerID: 1},
+				{ID: 3, Address: "10.0.0.3", ServerID: 1},
+			},
+			policy: Policy{Rebalance: true},
+			moves:  []string{"node-1/10.0.0.2 -> node-3 (Rebalance)", "node-1/10.0.0.3 -> node-2 (Rebalance)"},
+		},
+		{
+			name: "ips in a single domain are spread over the domains",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 1},
+				{ID: 2, Address: "10.0.0.2", ServerID: 2},
+			},
+			policy: Policy{Rebalance: true},
+			moves:  []string{"node-2/10.0.0.2 -> node-3 (Rebalance)"},
+		},
+		{
+			name: "nothing is rebalanced without the policy",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 1},
+				{ID: 2, Address: "10.0.0.2", ServerID: 1},
+			},
+		},
+		{
+			name: "unassigned ips go to their preferred node",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", Preferred: "node-2"},
+				{ID: 2, Address: "10.0.0.2", Preferred: "node-2"},
+			},
+			moves: []string{"10.0.0.1 -> node-2 (Unassigned)", "10.0.0.2 -> node-2 (Unassigned)"},
+		},
+		{
+			name: "ips fail back to their preferred node",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 1, Preferred: "node-3", Failback: true},
+				{ID: 2, Address: "10.0.0.2", ServerID: 2, Preferred: "node-3"},
+				{ID: 3, Address: "10.0.0.3", ServerID: 2, Preferred: "node-9", Failback: true},
+			},
+			moves: []string{"node-1/10.0.0.1 -> node-3 (Failback)"},
+		},
+		{
+			name: "pinned ips go to their node and are never rebalanced",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 1, Preferred: "node-1", Pinned: true},
+				{ID: 2, Address: "10.0.0.2", ServerID: 1, Preferred: "node-1", Pinned: true},
+				{ID: 3, Address: "10.0.0.3", ServerID: 2, Preferred: "node-1", Pinned: true},
+			},
+			policy: Policy{Rebalance: true},
+			moves:  []string{"node-2/10.0.0.3 -> node-1 (Pinned)"},
+		},
+		{
+			name: "ips pinned to a node that is not eligible are never rebalanced",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 1, Preferred: "node-9", Pinned: true},
+				{ID: 2, Address: "10.0.0.2", ServerID: 1, Preferred: "node-9", Pinned: true},
+			},
+			policy: Policy{Rebalance: true},
+		},
+		{
+			name: "held pinned ips stay where they are",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 2, Preferred: "node-1", Pinned: true, Hold: true},
+			},
+		},
+		{
+			name: "requested moves ignore holds and the preferred node",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", ServerID: 1, Hold: true, MoveTo: "node-2"},
+				{ID: 2, Address: "10.0.0.2", ServerID: 2, Preferred: "node-2", MoveAwayFrom: "node-2"},
+				{ID: 3, Address: "10.0.0.3", ServerID: 3, MoveTo: "node-9"},
+				{ID: 4, Address: "10.0.0.4", ServerID: 3, MoveAwayFrom: "node-1"},
+			},
+			moves: []string{"node-1/10.0.0.1 -> node-2 (Requested)", "node-2/10.0.0.2 -> node-1 (Requested)"},
+		},
+		{
+			name: "the home location is preferred",
+			ips: []IP{
+				{ID: 1, Address: "10.0.0.1", HomeLocation: "nbg1"},
+			},
+			policy: Policy{PreferHomeLocation: true},
+			moves:  []string{"10.0.0.1 -> node-3 (Unassigned)"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, move := range Plan(nodes, test.ips, test.policy, nil) {
+				from := ""
+				if move.From != "" {
+					from = move.From + "/"
+				}
+				got = append(got, fmt.Sprintf("%s%s -> %s (%s)", from, move.IP.Address, move.To(), move.Reason))
+			}
+			if !reflect.DeepEqual(got, test.moves) {
+				t.Errorf("expected moves %v, got %v", test.moves, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+// Package plugin implements the kubectl floatingip plugin to inspect and
+// operate floating ip pools. It only works with kubernetes objects, the
+// operator does the actual work, so it needs no hcloud token.
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8scli "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+)
+
+// Plugin runs the commands of the plugin against a cluster and writes their
+// output to out.
+type Plugin struct {
+	floatingIPCli floatingipk8scli.Interface
+	k8sCli        kubernetes.Interface
+	out           io.Writer
+	now           func() time.Time
+}
+
+// New returns a new plugin.
+func New(floatingIPCli floatingipk8scli.Interface, k8sCli kubernetes.Interface, out io.Writer) *Plugin {
+	return &Plugin{
+		floatingIPCli: floatingIPCli,
+		k8sCli:        k8sCli,
+		out:           out,
+		now:           time.Now,
+	}
+}
+
+// List lists the pools with the number of assigned ips, the nodes holding
+// them and their health.
+func (p *Plugin) List() error {
+	pools, err := p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(pools.Items, func(i, j int) bool { return pools.Items[i].Name < pools.Items[j].Name })
+
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIPS\tNODES\tHEALTH")
+	for i := range pools.Items {
+		fip := &pools.Items[i]
+		fmt.Fprintf(w, "%s\t%d/%d\t%s\t%s\n", fip.Name, len(assigned(fip)), len(fip.Spec.Ips), orNone(holders(fip)), health(fip))
+	}
+	return w.Flush()
+}
+
+// Describe shows the controls, the assignment of every ip, the pending moves,
+// the drift and the recent events of a pool.
+func (p *Plugin) Describe(name string) error {
+	fip, err := p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", fip.Name)
+	fmt.Fprintf(w, "Health:\t%s\n", health(fip))
+	fmt.Fprintf(w, "Paused:\t%t\n", fip.Status.Paused)
+	fmt.Fprintf(w, "Dry run:\t%t\n", fip.Status.DryRun)
+	fmt.Fprintf(w, "Drift policy:\t%s\n", orNone(string(fip.Spec.DriftPolicy)))
+	fmt.Fprintf(w, "Pinned:\t%s\n", orNone(fip.Annotations[hcloudv1alpha1.PinAnnotation]))
+	fmt.Fprintf(w, "Pending move:\t%s\n", orNone(fip.Annotations[hcloudv1alpha1.MoveAnnotation]))
+	fmt.Fprintf(w, "Token secret:\t%s\n", orNone(tokenSecret(fip)))
+	fmt.Fprintf(w, "Circuit breaker:\t%s\n", orNone(fip.Status.CircuitBreaker))
+	fmt.Fprintf(w, "Failing nodes:\t%s\n", orNone(failingNodes(fip)))
+	fmt.Fprintf(w, "Quarantined nodes:\t%s\n", orNone(strings.Join(fip.Status.QuarantinedNodes, ",")))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(p.out, "\nIPs:")
+	w = tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  IP\tNODE\tPREFERRED\tSINCE\tFAILURES\tLAST ERROR")
+	for _, ip := range fip.Status.IPs {
+		since := "<unknown>"
+		if !ip.LastTransitionTime.IsZero() {
+			since = p.age(ip.LastTransitionTime.Time)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%d\t%s\n", ip.IP, orNone(ip.Node), orNone(ip.PreferredNode), since, ip.Failures, orNone(ip.LastError))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(fip.Status.PendingMoves) > 0 {
+		fmt.Fprintln(p.out, "\nPending moves:")
+		for _, move := range fip.Status.PendingMoves {
+			fmt.Fprintf(p.out, "  %s\n", move)
+		}
+	}
+
+	if len(fip.Status.Drift) > 0 {
+		fmt.Fprintln(p.out, "\nDrift:")
+		w = tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "  IP\tKIND\tEXPECTED NODE\tSERVER\tAGE\tCAUSE")
+		for _, d := range fip.Status.Drift {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%d\t%s\t%s\n", d.IP, d.Kind, d.ExpectedNode, d.ServerID, p.age(d.DetectedTime.Time), d.Cause)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	events, err := p.events(fip)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(p.out, "\nEvents:")
+	if len(events) == 0 {
+		fmt.Fprintln(p.out, "  <none>")
+		return nil
+	}
+	w = tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  TYPE\tREASON\tAGE\tMESSAGE")
+	for _, ev := range events {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", ev.Type, ev.Reason, p.age(ev.LastTimestamp.Time), ev.Message)
+	}
+	return w.Flush()
+}
+
+// Move requests a move of the ip to a node, or away from a node, with the move
+// annotation of its pool. The pool is looked up when empty.
+func (p *Plugin) Move(ip, pool, to, awayFrom string) error {
+	if (to == "") == (awayFrom == "") {
+		return fmt.Errorf("either a node to move to or a node to move away from is required")
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid ip %s", ip)
+	}
+	ip = parsed.String()
+
+	if pool == "" {
+		fip, err := p.poolOf(ip)
+		if err != nil {
+			return err
+		}
+		pool = fip.Name
+	}
+
+	node := to
+	if awayFrom != "" {
+		node = "!" + awayFrom
+	}
+	err := p.updatePool(pool, func(fip *hcloudv1alpha1.FloatingIPPool) {
+		// The operator ignores an invalid move annotation, it is replaced.
+		moves, err := hcloudv1alpha1.ParseAssignments(fip.Annotations[hcloudv1alpha1.MoveAnnotation])
+		if err != nil {
+			moves = map[string]string{}
+		}
+		moves[ip] = node
+		fip.Annotations[hcloudv1alpha1.MoveAnnotation] = hcloudv1alpha1.FormatAssignments(moves)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(p.out, "move of ip %s to %s requested on pool %s\n", ip, node, pool)
+	return nil
+}
+
+// Pause pauses the pool, its planned moves are only reported as pending.
+func (p *Plugin) Pause(name string) error {
+	err := p.updatePool(name, func(fip *hcloudv1alpha1.FloatingIPPool) {
+		fip.Annotations[hcloudv1alpha1.PausedAnnotation] = "true"
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(p.out, "pool %s paused\n", name)
+	return nil
+}
+
+// Resume resumes a paused pool.
+func (p *Plugin) Resume(name string) error {
+	err := p.updatePool(name, func(fip *hcloudv1alpha1.FloatingIPPool) {
+		delete(fip.Annotations, hcloudv1alpha1.PausedAnnotation)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(p.out, "pool %s resumed\n", name)
+	return nil
+}
+
+// DrainNode drains the node with the drain annotation and requests a
+// reconcile of the pools with ips on it, undo makes the node eligible again.
+// With a timeout it waits until no pool reports an ip on the node.
+func (p *Plugin) DrainNode(name string, undo bool, timeout time.Duration) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := p.k8sCli.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if node.Annotations == nil {
+			node.Annotations = map[string]string{}
+		}
+		if undo {
+			delete(node.Annotations, hcloudv1alpha1.DrainAnnotation)
+		} else {
+			node.Annotations[hcloudv1alpha1.DrainAnnotation] = "true"
+		}
+		_, err = p.k8sCli.CoreV1().Nodes().Update(node)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if undo {
+		fmt.Fprintf(p.out, "node %s is eligible again\n", name)
+		return nil
+	}
+
+	pools, err := p.poolsOn(name)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		err := p.updatePool(pool, func(fip *hcloudv1alpha1.FloatingIPPool) {
+			fip.Annotations[hcloudv1alpha1.ReconcileAnnotation] = p.now().UTC().Format(time.RFC3339Nano)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(p.out, "node %s drained, reconciling %d pools with ips on it\n", name, len(pools))
+
+	if timeout <= 0 {
+		return nil
+	}
+	err = wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		pools, err := p.poolsOn(name)
+		return len(pools) == 0, err
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for the ips to leave node %s: %s", name, err)
+	}
+	fmt.Fprintf(p.out, "no floating ips left on node %s\n", name)
+	return nil
+}
+
+// updatePool changes the pool with f and writes it back, f gets a pool with
+// annotations.
+func (p *Plugin) updatePool(name string, f func(fip *hcloudv1alpha1.FloatingIPPool)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		fip, err := p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if fip.Annotations == nil {
+			fip.Annotations = map[string]string{}
+		}
+		f(fip)
+		_, err = p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().Update(fip)
+		return err
+	})
+}
+
+// poolOf returns the pool of the ip.
+func (p *Plugin) poolOf(ip string) (*hcloudv1alpha1.FloatingIPPool, error) {
+	pools, err := p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pools.Items {
+		for _, poolIP := range pools.Items[i].Spec.Ips {
+			if net.ParseIP(poolIP).String() == ip {
+				return &pools.Items[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("ip %s is not in any pool", ip)
+}
+
+// poolsOn returns the names of the pools reporting ips on the node.
+func (p *Plugin) poolsOn(node string) ([]string, error) {
+	pools, err := p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for i := range pools.Items {
+		for _, ip := range pools.Items[i].Status.IPs {
+			if ip.Node == node {
+				names = append(names, pools.Items[i].Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// events returns the events of the pool, oldest first.
+func (p *Plugin) events(fip *hcloudv1alpha1.FloatingIPPool) ([]corev1.Event, error) {
+	list, err := p.k8sCli.CoreV1().Events(metav1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: "involvedObject.kind=FloatingIPPool,involvedObject.name=" + fip.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The field selector is not supported everywhere, filter again.
+	var events []corev1.Event
+	for _, ev := range list.Items {
+		if ev.InvolvedObject.Kind == "FloatingIPPool" && ev.InvolvedObject.Name == fip.Name {
+			events = append(events, ev)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].LastTimestamp.Before(&events[j].LastTimestamp)
+	})
+	return events, nil
+}
+
+// age returns how long ago t was, rounded to the second.
+func (p *Plugin) age(t time.Time) string {
+	return p.now().Sub(t).Round(time.Second).String()
+}
+
+// assigned returns the status of the ips of the pool that are on a node.
+func assigned(fip *hcloudv1alpha1.FloatingIPPool) []hcloudv1alpha1.IPStatus {
+	var ips []hcloudv1alpha1.IPStatus
+	for _, ip := range fip.Status.IPs {
+		if ip.Node != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// holders returns the nodes holding ips of the pool.
+func holders(fip *hcloudv1alpha1.FloatingIPPool) string {
+	seen := map[string]bool{}
+	var nodes []string
+	for _, ip := range assigned(fip) {
+		if !seen[ip.Node] {
+			seen[ip.Node] = true
+			nodes = append(nodes, ip.Node)
+		}
+	}
+	sort.Strings(nodes)
+	return strings.Join(nodes, ",")
+}
+
+// failingNodes returns the failing nodes of the pool.
+func failingNodes(fip *hcloudv1alpha1.FloatingIPPool) string {
+	var nodes []string
+	for _, f := range fip.Status.FailingNodes {
+		nodes = append(nodes, f.Node)
+	}
+	return strings.Join(nodes, ",")
+}
+
+// health summarizes the problems of the pool, Healthy when it has none.
+func health(fip *hcloudv1alpha1.FloatingIPPool) string {
+	var problems []string
+	if fip.Status.Paused {
+		problems = append(problems, "Paused")
+	}
+	if fip.Status.DryRun {
+		problems = append(problems, "DryRun")
+	}
+	for _, cond := range fip.Status.Conditions {
+		if cond.Type == hcloudv1alpha1.PoolCredentialsValid && cond.Status == corev1.ConditionFalse {
+			problems = append(problems, "InvalidCredentials")
+		}
+	}
+	if state := fip.Status.CircuitBreaker; state != "" && state != string(hcloudapi.CircuitClosed) {
+		problems = append(problems, "Circuit"+state)
+	}
+	if n := len(fip.Status.Drift); n > 0 {
+		problems = append(problems, fmt.Sprintf("%d drifted", n))
+	}
+	if n := len(fip.Spec.Ips) - len(assigned(fip)); n > 0 {
+		problems = append(problems, fmt.Sprintf("%d unassigned", n))
+	}
+	var failing int
+	for _, ip := range fip.Status.IPs {
+		if ip.Failures > 0 {
+			failing++
+		}
+	}
+	if failing > 0 {
+		problems = append(problems, fmt.Sprintf("%d failing", failing))
+	}
+	if n := len(fip.Status.FailingNodes); n > 0 {
+		problems = append(problems, fmt.Sprintf("%d failing nodes", n))
+	}
+	if n := len(fip.Status.QuarantinedNodes); n > 0 {
+		problems = append(problems, fmt.Sprintf("%d quarantined nodes", n))
+	}
+
+	if len(problems) == 0 {
+		return "Healthy"
+	}
+	return strings.Join(problems, ", ")
+}
+
+// tokenSecret returns the namespace/name of the token secret of the pool,
+// empty when it uses the token of the operator.
+func tokenSecret(fip *hcloudv1alpha1.FloatingIPPool) string {
+	if ref := fip.Spec.TokenSecretRef; ref != nil {
+		return ref.Namespace + "/" + ref.Name
+	}
+	return ""
+}
+
+// orNone returns s or <none> when it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
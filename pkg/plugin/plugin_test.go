@@ -0,0 +1,208 @@
+package plugin
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8sfake "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned/fake"
+)
+
+var now = time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+
+func testPools() []*hcloudv1alpha1.FloatingIPPool {
+	return []*hcloudv1alpha1.FloatingIPPool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web"},
+			Spec:       hcloudv1alpha1.FloatinIPPoolSpec{Ips: []string{"10.0.0.1", "10.0.0.2"}},
+			Status: hcloudv1alpha1.FloatingIPPoolStatus{
+				CircuitBreaker: "Closed",
+				IPs: []hcloudv1alpha1.IPStatus{
+					{IP: "10.0.0.1", Node: "node-1", PreferredNode: "node-1", LastTransitionTime: metav1.NewTime(now.Add(-time.Minute))},
+					{IP: "10.0.0.2", Node: "node-2", PreferredNode: "node-2"},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "mail"},
+			Spec:       hcloudv1alpha1.FloatinIPPoolSpec{Ips: []string{"10.0.1.1", "10.0.1.2"}},
+			Status: hcloudv1alpha1.FloatingIPPoolStatus{
+				CircuitBreaker: "Open",
+				Paused:         true,
+				PendingMoves:   []string{"10.0.1.2 -->node-1"},
+				Drift: []hcloudv1alpha1.IPDrift{
+					{IP: "10.0.1.2", Kind: hcloudv1alpha1.DriftUnassigned, ExpectedNode: "node-2", Cause: "unassign_floating_ip action 7 started at 2018-07-01T11:00:00Z", DetectedTime: metav1.NewTime(now.Add(-time.Hour))},
+				},
+				Conditions: []hcloudv1alpha1.PoolCondition{
+					{Type: hcloudv1alpha1.PoolCredentialsValid, Status: corev1.ConditionFalse, Reason: "SecretNotFound"},
+				},
+				IPs: []hcloudv1alpha1.IPStatus{
+					{IP: "10.0.1.1", Node: "node-1"},
+					{IP: "10.0.1.2", Failures: 2, LastError: "server is locked"},
+				},
+			},
+		},
+	}
+}
+
+func newTestPlugin() (*Plugin, *floatingipk8sfake.Clientset, *kubefake.Clientset, *bytes.Buffer) {
+	fipCli := floatingipk8sfake.NewSimpleClientset()
+	for _, pool := range testPools() {
+		fipCli.HcloudV1alpha1().FloatingIPPools().Create(pool)
+	}
+
+	k8sCli := kubefake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "web.1", Namespace: metav1.NamespaceDefault},
+			InvolvedObject: corev1.ObjectReference{Kind: "FloatingIPPool", Name: "web"},
+			Type:           corev1.EventTypeNormal,
+			Reason:         "AssignPlan",
+			Message:        "1 failovers, 0 failbacks, 0 rebalances, 0 manual: 10.0.0.1 -->node-1",
+			LastTimestamp:  metav1.NewTime(now.Add(-time.Minute)),
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "mail.1", Namespace: metav1.NamespaceDefault},
+			InvolvedObject: corev1.ObjectReference{Kind: "FloatingIPPool", Name: "mail"},
+			Reason:         "Paused",
+		},
+	)
+
+	out := &bytes.Buffer{}
+	p := New(fipCli, k8sCli, out)
+	p.now = func() time.Time { return now }
+	return p, fipCli, k8sCli, out
+}
+
+func annotations(t *testing.T, fipCli *floatingipk8sfake.Clientset, name string) map[string]string {
+	fip, err := fipCli.HcloudV1alpha1().FloatingIPPools().Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fip.Annotations
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	p, _, _, out := newTestPlugin()
+	if err := p.List(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectLines(t, out.String(),
+		"NAME  IPS  NODES          HEALTH",
+		"mail  1/2  node-1         Paused, InvalidCredentials, CircuitOpen, 1 drifted, 1 unassigned, 1 failing",
+		"web   2/2  node-1,node-2  Healthy",
+	)
+}
+
+func TestDescribe(t *testing.T) {
+	p, _, _, out := newTestPlugin()
+	if err := p.Describe("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectLines(t, out.String(),
+		"Health:             Healthy",
+		"10.0.0.1  node-1  node-1     1m0s",
+		"AssignPlan  1m0s  1 failovers",
+	)
+	if strings.Contains(out.String(), "Paused") && strings.Contains(out.String(), "mail") {
+		t.Errorf("expected only the events of the pool:\n%s", out)
+	}
+}
+
+func TestDescribeDrift(t *testing.T) {
+	p, _, _, out := newTestPlugin()
+	if err := p.Describe("mail"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectLines(t, out.String(),
+		"Drift:",
+		"10.0.1.2  Unassigned  node-2         0       1h0m0s  unassign_floating_ip action 7",
+	)
+}
+
+func TestMove(t *testing.T) {
+	p, fipCli, _, _ := newTestPlugin()
+
+	if err := p.Move("10.0.0.1", "", "node-2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Move("10.0.0.2", "web", "", "node-2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := annotations(t, fipCli, "web")[hcloudv1alpha1.MoveAnnotation]; got != "10.0.0.1=node-2,10.0.0.2=!node-2" {
+		t.Errorf("unexpected move annotation %q", got)
+	}
+
+	if err := p.Move("10.0.9.9", "", "node-2", ""); err == nil {
+		t.Errorf("expected an error for an ip that is not in any pool")
+	}
+	if err := p.Move("10.0.0.1", "", "node-2", "node-1"); err == nil {
+		t.Errorf("expected an error for a move to and away from a node")
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	p, fipCli, _, _ := newTestPlugin()
+
+	if err := p.Pause("web"); err != nil {
+		t.Fatal(err)
+	}
+	if got := annotations(t, fipCli, "web")[hcloudv1alpha1.PausedAnnotation]; got != "true" {
+		t.Errorf("expected the pool to be paused, got %q", got)
+	}
+
+	if err := p.Resume("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := annotations(t, fipCli, "web")[hcloudv1alpha1.PausedAnnotation]; ok {
+		t.Errorf("expected the pool to be resumed")
+	}
+}
+
+func TestDrainNode(t *testing.T) {
+	p, fipCli, k8sCli, _ := newTestPlugin()
+
+	if err := p.DrainNode("node-1", false, 0); err != nil {
+		t.Fatal(err)
+	}
+	node, err := k8sCli.CoreV1().Nodes().Get("node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Annotations[hcloudv1alpha1.DrainAnnotation] != "true" {
+		t.Errorf("expected the node to be drained, got %v", node.Annotations)
+	}
+	for _, pool := range []string{"web", "mail"} {
+		if _, ok := annotations(t, fipCli, pool)[hcloudv1alpha1.ReconcileAnnotation]; !ok {
+			t.Errorf("expected a reconcile of pool %s", pool)
+		}
+	}
+
+	if err := p.DrainNode("node-1", true, 0); err != nil {
+		t.Fatal(err)
+	}
+	node, err = k8sCli.CoreV1().Nodes().Get("node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.Annotations[hcloudv1alpha1.DrainAnnotation]; ok {
+		t.Errorf("expected the node to be eligible again")
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/planner"
+)
+
+const (
+	// ActionPollInterval is the time between two checks of a running hcloud action.
+	ActionPollInterval = 500 * time.Millisecond
+	// DefaultActionTimeout is the time an hcloud action may take before it is
+	// considered stuck.
+	DefaultActionTimeout = 60 * time.Second
+)
+
+// ActionError is the error of an hcloud action that finished unsuccessfully.
+type ActionError struct {
+	ID      int
+	Command string
+	Code    string
+	Message string
+}
+
+// Error satisfies error interface.
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("action %d (%s) failed with %s: %s", e.ID, e.Command, e.Code, e.Message)
+}
+
+// priority returns the priority of the hcloud api calls of the move, only
+// ips that are not on an eligible node are essential.
+func priority(move planner.Move) hcloudapi.Priority {
+	if move.Reason == planner.ReasonFailover || move.Reason == planner.ReasonUnassigned {
+		return hcloudapi.PriorityHigh
+	}
+	return hcloudapi.PriorityLow
+}
+
+// assignIP assigns the floating ip to the server, waits for the action to
+// complete and verifies the floating ip is assigned to the server afterwards.
+// All the calls are made with the given priority.
+func (p *IPAssigner) assignIP(ctx context.Context, fip *hcloud.FloatingIP, server *hcloud.Server, prio hcloudapi.Priority) error {
+	if err := p.guard.Before(ctx, prio); err != nil {
+		return err
+	}
+	action, resp, err := p.hcloudCli.FloatingIP.Assign(ctx, fip, server)
+	p.guard.After(resp, err)
+	// The project changed (or might have), make sure nobody keeps
+	// working with the old state.
+	defer p.inventory.Invalidate()
+	if err != nil {
+		return err
+	}
+
+	if err := p.waitForAction(ctx, action, prio); err != nil {
+		return err
+	}
+
+	return p.verifyAssignment(ctx, fip, server, prio)
+}
+
+// waitForAction polls the hcloud action until it succeeded or failed, an
+// action that didn't finish within the action timeout is reported as stuck.
+func (p *IPAssigner) waitForAction(ctx context.Context, action *hcloud.Action, prio hcloudapi.Priority) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.ActionTimeout)
+	defer cancel()
+
+	for {
+		switch action.Status {
+		case hcloud.ActionStatusSuccess:
+			return nil
+		case hcloud.ActionStatusError:
+			return &ActionError{
+				ID:      action.ID,
+				Command: action.Command,
+				Code:    action.ErrorCode,
+				Message: action.ErrorMessage,
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("action %d (%s) did not finish within %s, progress %d%%", action.ID, action.Command, p.cfg.ActionTimeout, action.Progress)
+		case <-p.time.After(ActionPollInterval):
+		}
+
+		if err := p.guard.Before(ctx, prio); err != nil {
+			return err
+		}
+		a, resp, err := p.hcloudCli.Action.GetByID(ctx, action.ID)
+		p.guard.After(resp, err)
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			return fmt.Errorf("action %d (%s) not found", action.ID, action.Command)
+		}
+		action = a
+	}
+}
+
+// verifyAssignment re-reads the floating ip and checks it is assigned to the
+// server.
+func (p *IPAssigner) verifyAssignment(ctx context.Context, fip *hcloud.FloatingIP, server *hcloud.Server, prio hcloudapi.Priority) error {
+	if err := p.guard.Before(ctx, prio); err != nil {
+		return err
+	}
+	current, resp, err := p.hcloudCli.FloatingIP.GetByID(ctx, fip.ID)
+	p.guard.After(resp, err)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case current == nil:
+		return fmt.Errorf("ip %s no longer exists", fip.IP.String())
+	case current.Server == nil:
+		return fmt.Errorf("ip %s is not assigned to server %s after assignment", fip.IP.String(), server.Name)
+	case current.Server.ID != server.ID:
+		return fmt.Errorf("ip %s is assigned to server %d instead of %s after assignment", fip.IP.String(), current.Server.ID, server.Name)
+	}
+
+	return nil
+}
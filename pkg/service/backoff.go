@@ -0,0 +1,75 @@
+package service
+
+import (
+	"time"
+)
+
+const (
+	// BaseIPRetryDelay is the delay before an ip that failed to be assigned is
+	// tried again, it doubles on every following failure of the same ip.
+	BaseIPRetryDelay = 5 * time.Second
+)
+
+// ipBackoff is the retry state of a floating ip that failed to be assigned.
+type ipBackoff struct {
+	failures  int
+	lastError string
+	next      time.Time
+}
+
+// backoffUntil returns until when the ip is backing off, false when the ip
+// can be assigned right away.
+func (p *IPAssigner) backoffUntil(ip string) (time.Time, bool) {
+	b, ok := p.backoffs[ip]
+	if !ok || !p.time.Now().Before(b.next) {
+		return time.Time{}, false
+	}
+	return b.next, true
+}
+
+// ipFailed records a failed assignment of the ip and returns the time of the
+// next attempt.
+func (p *IPAssigner) ipFailed(ip string, err error) time.Time {
+	b, ok := p.backoffs[ip]
+	if !ok {
+		b = &ipBackoff{}
+		p.backoffs[ip] = b
+	}
+
+	maxDelay := p.cfg.MaxRetryDelay
+	if maxDelay < BaseIPRetryDelay {
+		maxDelay = BaseIPRetryDelay
+	}
+
+	delay := BaseIPRetryDelay
+	for i := 1; i < b.failures+1 && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	b.next = p.time.Now().Add(delay)
+	return b.next
+}
+
+// ipSucceeded resets the retry state of the ip.
+func (p *IPAssigner) ipSucceeded(ip string) {
+	delete(p.backoffs, ip)
+}
+
+// forgetIPs drops the retry state of the ips that are no longer in the pool,
+// so an ip that is added back starts without failures.
+func (p *IPAssigner) forgetIPs(ips []string) {
+	keep := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		keep[ip] = true
+	}
+	for ip := range p.backoffs {
+		if !keep[ip] {
+			delete(p.backoffs, ip)
+		}
+	}
+}
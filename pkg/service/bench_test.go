@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/inventory"
+)
+
+// largeScenario is a pool of 1000 nodes in 3 locations and 200 ips, spread
+// over the first 200 nodes.
+func largeScenario() scenario {
+	s := scenario{name: "large"}
+	locations := []string{"fsn1", "nbg1", "hel1"}
+	for i := 0; i < 1000; i++ {
+		s.nodes = append(s.nodes, testNode{name: fmt.Sprintf("node-%d", i), location: locations[i%3]})
+	}
+	for i := 0; i < 200; i++ {
+		s.ips = append(s.ips, testIP{ip: fmt.Sprintf("10.0.%d.%d", i/256, i%256), on: fmt.Sprintf("node-%d", i)})
+	}
+	return s
+}
+
+// BenchmarkReconcile is a reconcile of a balanced pool, the inventory is
+// cached so only the work of the operator itself is measured.
+func BenchmarkReconcile(b *testing.B) {
+	e := newEnv(largeScenario())
+	defer e.api.Close()
+	e.ipa.inventory = inventory.New(e.ipa.hcloudCli, e.ipa.guard, time.Hour)
+
+	if err := e.ipa.Reconcile(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := e.ipa.Reconcile(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetTargets resolves the servers of 1000 nodes.
+func BenchmarkGetTargets(b *testing.B) {
+	e := newEnv(largeScenario())
+	defer e.api.Close()
+
+	pool := e.ipa.pool()
+	nodes, err := e.ipa.getProbableNodes(pool)
+	if err != nil {
+		b.Fatal(err)
+	}
+	inv, err := e.ipa.inventory.Get(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if targets := e.ipa.getTargets(pool, nodes.Items, inv); len(targets) != len(nodes.Items) {
+			b.Fatalf("expected %d targets, got %d", len(nodes.Items), len(targets))
+		}
+	}
+}
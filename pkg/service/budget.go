@@ -0,0 +1,82 @@
+package service
+
+import (
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/planner"
+)
+
+// voluntary returns true for the moves of ips that are on an eligible node,
+// rebalances and failbacks.
+func voluntary(move planner.Move) bool {
+	return move.Reason == planner.ReasonRebalance || move.Reason == planner.ReasonFailback
+}
+
+// limitVoluntaryMoves drops the voluntary moves that exceed the disruption
+// budget of the pool, failovers are never dropped. unavailable is the number
+// of ips of the pool that are not on an eligible node.
+func (p *IPAssigner) limitVoluntaryMoves(fip *hcloudv1alpha1.FloatingIPPool, moves []planner.Move, unavailable int) []planner.Move {
+	budget, limited := p.voluntaryBudget(fip, unavailable)
+	if !limited {
+		return moves
+	}
+
+	// Voluntary moves are planned after the failovers, dropping the last
+	// ones doesn't change where the others go.
+	var kept []planner.Move
+	var postponed int
+	for _, move := range moves {
+		if voluntary(move) {
+			if budget <= 0 {
+				postponed++
+				continue
+			}
+			budget--
+		}
+		kept = append(kept, move)
+	}
+
+	if postponed > 0 {
+		p.logger.Infof("%s disruption budget exhausted, postponing %d rebalances and failbacks", fip.Name, postponed)
+	}
+	return kept
+}
+
+// voluntaryBudget returns the number of ips that may be moved to rebalance
+// the pool or fail back right now, false when the pool has no disruption
+// budget.
+func (p *IPAssigner) voluntaryBudget(fip *hcloudv1alpha1.FloatingIPPool, unavailable int) (int, bool) {
+	var budget int
+	var limited bool
+
+	if fip.Spec.MaxMovesPerInterval > 0 {
+		budget, limited = fip.Spec.MaxMovesPerInterval-p.recentVoluntaryMoves(), true
+	}
+
+	if fip.Spec.MaxUnavailable != nil {
+		maxUnavailable, err := intstr.GetValueFromIntOrPercent(fip.Spec.MaxUnavailable, len(fip.Spec.Ips), true)
+		if err != nil {
+			p.logger.Warningf("%s invalid maxUnavailable, not rebalancing: %s", fip.Name, err)
+			maxUnavailable = 0
+		}
+		if !limited || maxUnavailable-unavailable < budget {
+			budget = maxUnavailable - unavailable
+		}
+		limited = true
+	}
+
+	return budget, limited
+}
+
+// recentVoluntaryMoves returns the number of voluntary moves made within the
+// current window. A window lasts one interval from its start, reconciles in
+// between don't start a new one.
+func (p *IPAssigner) recentVoluntaryMoves() int {
+	now := p.time.Now()
+	if !now.Before(p.movesWindowEnd) {
+		p.movesWindowEnd = now.Add(p.Interval())
+		p.voluntaryMoves = 0
+	}
+	return p.voluntaryMoves
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/planner"
+)
+
+// Event reasons.
+const (
+	// ReasonPaused and ReasonResumed are the reasons of the events on a pool
+	// that got paused or resumed with the paused annotation.
+	ReasonPaused  = "Paused"
+	ReasonResumed = "Resumed"
+	// ReasonPendingMoves is the reason of the event on a paused or dry run
+	// pool with the moves a reconcile would have made.
+	ReasonPendingMoves = "PendingMoves"
+	// ReasonPinned is the reason of the event on a pool whose pinned ips
+	// changed.
+	ReasonPinned = "Pinned"
+	// ReasonMoved and ReasonMoveFailed are the reasons of the events
+	// acknowledging a move requested with the move annotation.
+	ReasonMoved      = "Moved"
+	ReasonMoveFailed = "MoveFailed"
+	// ReasonInvalidAnnotation is the reason of the event on a pool with a
+	// control annotation that can't be parsed.
+	ReasonInvalidAnnotation = "InvalidAnnotation"
+)
+
+// controlAnnotations are the annotations of a pool that change how it is
+// reconciled.
+var controlAnnotations = []string{
+	hcloudv1alpha1.ReconcileAnnotation,
+	hcloudv1alpha1.PausedAnnotation,
+	hcloudv1alpha1.PinAnnotation,
+	hcloudv1alpha1.MoveAnnotation,
+}
+
+// moveRequest is a move of a floating ip requested with the move annotation,
+// to a node or away from a node.
+type moveRequest struct {
+	to       string
+	awayFrom string
+}
+
+// controls are the operator controls of a pool, set with its annotations.
+type controls struct {
+	paused bool
+	// pins are the nodes the ips are pinned to by ip.
+	pins map[string]string
+	// moves are the requested moves by ip and move the value of the move
+	// annotation to acknowledge, empty when there is nothing to acknowledge.
+	moves map[string]moveRequest
+	move  string
+}
+
+// controls returns the controls of the pool. Pausing, resuming and pinning
+// are reported with an event when they change, invalid annotations with a
+// warning event.
+func (p *IPAssigner) controls(fip *hcloudv1alpha1.FloatingIPPool) controls {
+	ctl := controls{paused: fip.Annotations[hcloudv1alpha1.PausedAnnotation] == "true"}
+
+	if ctl.paused != p.paused {
+		if ctl.paused {
+			p.logger.Infof("%s paused, planned moves are only reported", fip.Name)
+			p.events.Event(fip, corev1.EventTypeNormal, ReasonPaused, "pool paused, planned moves are only reported as pending moves")
+		} else {
+			p.logger.Infof("%s resumed", fip.Name)
+			p.events.Event(fip, corev1.EventTypeNormal, ReasonResumed, "pool resumed")
+		}
+		p.paused = ctl.paused
+	}
+
+	value := fip.Annotations[hcloudv1alpha1.PinAnnotation]
+	pins, err := parseAssignments(fip, value)
+	for ip, node := range pins {
+		if strings.HasPrefix(node, "!") {
+			err = fmt.Errorf("ip %s can only be pinned to a node", ip)
+		}
+	}
+	switch {
+	case err != nil:
+		if value != p.pin {
+			p.logger.Warningf("%s invalid %s annotation, ignoring it: %s", fip.Name, hcloudv1alpha1.PinAnnotation, err)
+			p.events.Eventf(fip, corev1.EventTypeWarning, ReasonInvalidAnnotation, "ignoring %s annotation: %s", hcloudv1alpha1.PinAnnotation, err)
+		}
+	case value != p.pin && value == "":
+		p.events.Event(fip, corev1.EventTypeNormal, ReasonPinned, "no floating ips pinned")
+	case value != p.pin:
+		p.events.Eventf(fip, corev1.EventTypeNormal, ReasonPinned, "floating ips pinned: %s", hcloudv1alpha1.FormatAssignments(pins))
+		fallthrough
+	default:
+		ctl.pins = pins
+	}
+	p.pin = value
+
+	// The move annotation is removed once handled, until the removal is seen
+	// the same value is not handled twice.
+	value = fip.Annotations[hcloudv1alpha1.MoveAnnotation]
+	if value == "" || value == p.move {
+		p.move = value
+		return ctl
+	}
+	ctl.move = value
+	moves, err := parseAssignments(fip, value)
+	if err != nil {
+		p.logger.Warningf("%s invalid %s annotation, ignoring it: %s", fip.Name, hcloudv1alpha1.MoveAnnotation, err)
+		p.events.Eventf(fip, corev1.EventTypeWarning, ReasonInvalidAnnotation, "ignoring %s annotation: %s", hcloudv1alpha1.MoveAnnotation, err)
+		return ctl
+	}
+	ctl.moves = make(map[string]moveRequest, len(moves))
+	for ip, node := range moves {
+		if strings.HasPrefix(node, "!") {
+			ctl.moves[ip] = moveRequest{awayFrom: strings.TrimPrefix(node, "!")}
+		} else {
+			ctl.moves[ip] = moveRequest{to: node}
+		}
+	}
+
+	return ctl
+}
+
+// parseAssignments parses the ip=node pairs of a control annotation, all ips
+// have to be floating ips of the pool.
+func parseAssignments(fip *hcloudv1alpha1.FloatingIPPool, value string) (map[string]string, error) {
+	assignments, err := hcloudv1alpha1.ParseAssignments(value)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make(map[string]bool, len(fip.Spec.Ips))
+	for _, ip := range fip.Spec.Ips {
+		ips[net.ParseIP(ip).String()] = true
+	}
+	for ip := range assignments {
+		if !ips[ip] {
+			return nil, fmt.Errorf("%s is not a floating ip of the pool", ip)
+		}
+	}
+
+	return assignments, nil
+}
+
+// pausedMoves splits the moves of a paused pool in the moves that are made
+// anyway, the requested ones, and the pending moves that are only reported.
+func pausedMoves(moves []planner.Move) (requested, pending []planner.Move) {
+	for _, move := range moves {
+		if move.Reason == planner.ReasonRequested {
+			requested = append(requested, move)
+		} else {
+			pending = append(pending, move)
+		}
+	}
+	return requested, pending
+}
+
+// acknowledgeMoves reports the outcome of every requested move with an event
+// and removes the move annotation. current is the node every ip was on before
+// the moves and eligible the eligible nodes.
+func (p *IPAssigner) acknowledgeMoves(fip *hcloudv1alpha1.FloatingIPPool, ctl controls, jobs []*assignJob, current map[string]string, eligible map[string]*target) error {
+	if ctl.move == "" {
+		return nil
+	}
+
+	done := map[string]*assignJob{}
+	for _, job := range jobs {
+		if job.move.Reason == planner.ReasonRequested {
+			done[job.move.IP.Address] = job
+		}
+	}
+
+	ips := make([]string, 0, len(ctl.moves))
+	for ip := range ctl.moves {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	for _, ip := range ips {
+		req := ctl.moves[ip]
+		job, ok := done[ip]
+		switch {
+		case ok && job.err != nil:
+			p.events.Eventf(fip, corev1.EventTypeWarning, ReasonMoveFailed, "requested move of ip %s failed: %s", ip, job.err)
+		case ok:
+			p.events.Eventf(fip, corev1.EventTypeNormal, ReasonMoved, "ip %s moved from %s to %s as requested", ip, from(job.move), job.target.node.Name)
+		case req.to != "" && current[ip] == req.to:
+			p.events.Eventf(fip, corev1.EventTypeNormal, ReasonMoved, "ip %s is already on %s", ip, req.to)
+		case req.to != "" && eligible[req.to] == nil:
+			p.events.Eventf(fip, corev1.EventTypeWarning, ReasonMoveFailed, "ip %s can't move to %s, it is not an eligible node", ip, req.to)
+		case req.awayFrom != "" && current[ip] != req.awayFrom:
+			p.events.Eventf(fip, corev1.EventTypeNormal, ReasonMoved, "ip %s is not on %s", ip, req.awayFrom)
+		default:
+			p.events.Eventf(fip, corev1.EventTypeWarning, ReasonMoveFailed, "ip %s can't move away from %s, there is no other eligible node", ip, req.awayFrom)
+		}
+	}
+
+	p.move = ctl.move
+	return p.removeAnnotation(fip.Name, hcloudv1alpha1.MoveAnnotation, ctl.move)
+}
+
+// removeAnnotation removes the annotation from the pool unless its value
+// changed in the meantime.
+func (p *IPAssigner) removeAnnotation(name, key, value string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		fip, err := p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if fip.Annotations[key] != value {
+			return nil
+		}
+
+		delete(fip.Annotations, key)
+		_, err = p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().Update(fip)
+		return err
+	})
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/inventory"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+)
+
+// Event reasons.
+const (
+	// ReasonInvalidCredentials and ReasonCredentialsValid are the reasons of
+	// the events on a pool whose hcloud token became invalid or valid again.
+	ReasonInvalidCredentials = "InvalidCredentials"
+	ReasonCredentialsValid   = "CredentialsValid"
+)
+
+// Reasons of the credentials condition of a pool.
+const (
+	CredentialsReasonValid          = "Valid"
+	CredentialsReasonNoToken        = "NoToken"
+	CredentialsReasonSecretNotFound = "SecretNotFound"
+	CredentialsReasonKeyNotFound    = "KeyNotFound"
+	CredentialsReasonUnauthorized   = "Unauthorized"
+)
+
+const (
+	// DefaultTokenKey is the key of the token in the secret of a pool that
+	// doesn't set one.
+	DefaultTokenKey = "token"
+	// defaultProject is the name of the hcloud project of the token of the
+	// operator.
+	defaultProject = "default"
+)
+
+// HCloudClientFunc returns an hcloud client that authenticates with the
+// token.
+type HCloudClientFunc func(token string) *hcloud.Client
+
+// CredentialsError is the error of a pool whose hcloud token is missing or
+// rejected, Reason is the reason of its credentials condition.
+type CredentialsError struct {
+	Reason  string
+	Message string
+}
+
+// Error satisfies error interface.
+func (e *CredentialsError) Error() string {
+	return e.Message
+}
+
+// project is the hcloud project of a token with the client, rate limiter,
+// circuit breaker and inventory shared by all the pools of the project.
+type project struct {
+	name      string
+	hcloudCli *hcloud.Client
+	guard     *hcloudapi.Guard
+	inventory *inventory.Inventory
+}
+
+// projects builds and caches a project per hcloud token. The token of a pool
+// is read from the secret it references, pools without one use the token of
+// the operator.
+type projects struct {
+	cfg       Config
+	newClient HCloudClientFunc
+	secrets   *secretWatcher
+	metrics   metrics.Recorder
+	logger    log.Logger
+
+	mutex sync.Mutex
+	token string
+	// byToken are the projects by hash of their token and pools the hash of
+	// the token of every pool, a project without pools is dropped.
+	byToken map[string]*project
+	pools   map[string]string
+}
+
+// newProjects returns a new project cache, token is the token of the
+// operator and secrets the watcher of the secrets the pools reference.
+func newProjects(cfg Config, token string, newClient HCloudClientFunc, secrets *secretWatcher, recorder metrics.Recorder, logger log.Logger) *projects {
+	return &projects{
+		cfg:       cfg,
+		newClient: newClient,
+		secrets:   secrets,
+		metrics:   recorder,
+		logger:    logger,
+		token:     token,
+		byToken:   map[string]*project{},
+		pools:     map[string]string{},
+	}
+}
+
+// get returns the project of the pool, a CredentialsError when its token is
+// missing.
+func (p *projects) get(fip *hcloudv1alpha1.FloatingIPPool) (*project, error) {
+	name, token, err := p.credentials(fip)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err != nil {
+		delete(p.pools, fip.Name)
+		p.prune()
+		return nil, err
+	}
+
+	key := hash(token)
+	proj, ok := p.byToken[key]
+	if !ok {
+		guard := hcloudapi.NewGuard(
+			hcloudapi.NewLimiter(p.cfg.HCloudQPS, p.cfg.HCloudBurst),
+			hcloudapi.NewBreaker(p.cfg.CircuitFailureThreshold, p.cfg.CircuitOpenPeriod),
+		)
+		hcloudCli := p.newClient(token)
+		proj = &project{
+			name:      name,
+			hcloudCli: hcloudCli,
+			guard:     guard,
+			inventory: inventory.New(hcloudCli, guard, p.cfg.InventoryRefreshPeriod),
+		}
+		p.byToken[key] = proj
+		p.logger.Infof("added hcloud project %s", name)
+	}
+	p.pools[fip.Name] = key
+	p.prune()
+
+	return proj, nil
+}
+
+// setToken replaces the token of the operator, it returns false when the
+// token didn't change.
+func (p *projects) setToken(token string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if token == p.token {
+		return false
+	}
+	p.token = token
+	return true
+}
+
+// setRateLimit changes the rate limit of all the projects, new projects get
+// it too.
+func (p *projects) setRateLimit(qps float64, burst int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.cfg.HCloudQPS, p.cfg.HCloudBurst = qps, burst
+	for _, proj := range p.byToken {
+		proj.guard.SetRateLimit(qps, burst)
+	}
+}
+
+// release forgets the project of a deleted pool.
+func (p *projects) release(pool string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.pools, pool)
+	p.prune()
+}
+
+// prune drops the projects no pool uses anymore. The metrics of a project
+// are only deleted when no project with the same name is left, e.g. the
+// project of a rotated token. The mutex must be held.
+func (p *projects) prune() {
+	used := map[string]bool{}
+	for _, key := range p.pools {
+		used[key] = true
+	}
+
+	var removed []string
+	for key, proj := range p.byToken {
+		if used[key] {
+			continue
+		}
+		delete(p.byToken, key)
+		removed = append(removed, proj.name)
+		p.logger.Infof("removed hcloud project %s", proj.name)
+	}
+
+	names := make(map[string]bool, len(p.byToken))
+	for _, proj := range p.byToken {
+		names[proj.name] = true
+	}
+	for _, name := range removed {
+		if !names[name] {
+			p.metrics.DeleteProject(name)
+		}
+	}
+}
+
+// credentials returns the name of the project of the pool and its token,
+// the name is the namespace/name of the secret of the token.
+func (p *projects) credentials(fip *hcloudv1alpha1.FloatingIPPool) (string, string, error) {
+	ref := fip.Spec.TokenSecretRef
+	if ref == nil {
+		p.mutex.Lock()
+		token := p.token
+		p.mutex.Unlock()
+
+		if token == "" {
+			return "", "", &CredentialsError{Reason: CredentialsReasonNoToken, Message: "the pool has no token secret and the operator has no hcloud token"}
+		}
+		return defaultProject, token, nil
+	}
+
+	key := ref.Key
+	if key == "" {
+		key = DefaultTokenKey
+	}
+	name := ref.Namespace + "/" + ref.Name
+
+	secret, ok, err := p.secrets.get(ref.Namespace, ref.Name)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", &CredentialsError{Reason: CredentialsReasonSecretNotFound, Message: fmt.Sprintf("token secret %s not found", name)}
+	}
+	token := strings.TrimSpace(string(secret.Data[key]))
+	if token == "" {
+		return "", "", &CredentialsError{Reason: CredentialsReasonKeyNotFound, Message: fmt.Sprintf("token secret %s has no %s key", name, key)}
+	}
+
+	return name, token, nil
+}
+
+// hash returns the sha256 of the token, so tokens aren't kept around as map
+// keys.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// useProject makes the ip assigner work with the hcloud project, it is only
+// called right before a reconcile.
+func (p *IPAssigner) useProject(proj *project) {
+	p.hcloudCli, p.guard, p.inventory = proj.hcloudCli, proj.guard, proj.inventory
+}
+
+// reportCredentials sets the credentials condition of the pool, it is false
+// for a CredentialsError and true when err is nil. A change of the condition
+// is logged and reported with an event. It returns err.
+func (p *IPAssigner) reportCredentials(err error) error {
+	fip := p.pool()
+
+	cond := hcloudv1alpha1.PoolCondition{
+		Type:    hcloudv1alpha1.PoolCredentialsValid,
+		Status:  corev1.ConditionTrue,
+		Reason:  CredentialsReasonValid,
+		Message: "the hcloud token is accepted",
+	}
+	cerr, ok := err.(*CredentialsError)
+	switch {
+	case ok:
+		cond.Status, cond.Reason, cond.Message = corev1.ConditionFalse, cerr.Reason, cerr.Message
+	case err != nil:
+		return err
+	}
+
+	status := *p.status.DeepCopy()
+	previous, changed := setCondition(&status, cond, metav1.NewTime(p.time.Now()))
+	if !changed {
+		return err
+	}
+
+	switch {
+	case cond.Status == corev1.ConditionFalse:
+		p.logger.Errorf("%s invalid credentials: %s", fip.Name, cond.Message)
+		p.events.Event(fip, corev1.EventTypeWarning, ReasonInvalidCredentials, cond.Message)
+	case previous == corev1.ConditionFalse:
+		p.logger.Infof("%s credentials valid again", fip.Name)
+		p.events.Event(fip, corev1.EventTypeNormal, ReasonCredentialsValid, cond.Message)
+	}
+
+	if uerr := p.updateStatus(fip.Name, status); uerr != nil {
+		if err != nil {
+			return fmt.Errorf("%s, updating the status failed too: %s", err, uerr)
+		}
+		return uerr
+	}
+	return err
+}
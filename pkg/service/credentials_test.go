@@ -0,0 +1,216 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	kooperlog "github.com/spotahome/kooper/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8sfake "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned/fake"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudtest"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+)
+
+// projectNode returns a ready node of the project with its server.
+func projectNode(name, project string, serverID int) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"project": project}},
+		Spec:       corev1.NodeSpec{ProviderID: providerIDPrefix + strconv.Itoa(serverID)},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+// projectMetrics records the projects whose metrics are deleted.
+type projectMetrics struct {
+	metrics.Recorder
+	deleted []string
+}
+
+func (m *projectMetrics) DeleteProject(project string) {
+	m.deleted = append(m.deleted, project)
+}
+
+func credentialsCondition(t *testing.T, fipCli *floatingipk8sfake.Clientset, name string) hcloudv1alpha1.PoolCondition {
+	pool, err := fipCli.HcloudV1alpha1().FloatingIPPools().Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cond := range pool.Status.Conditions {
+		if cond.Type == hcloudv1alpha1.PoolCredentialsValid {
+			return cond
+		}
+	}
+	t.Fatalf("expected a credentials condition on pool %s, got %v", name, pool.Status.Conditions)
+	return hcloudv1alpha1.PoolCondition{}
+}
+
+func TestPoolsUseTheProjectOfTheirToken(t *testing.T) {
+	apiA, apiB := hcloudtest.NewAPI(), hcloudtest.NewAPI()
+	defer apiA.Close()
+	defer apiB.Close()
+	apiA.SetToken("token-a")
+	apiB.SetToken("token-b")
+	apiA.AddServer(hcloudtest.Server{ID: 100, Name: "node-a", Location: "fsn1", Datacenter: "fsn1-dc1"})
+	apiB.AddServer(hcloudtest.Server{ID: 200, Name: "node-b", Location: "fsn1", Datacenter: "fsn1-dc1"})
+	apiA.AddFloatingIP(hcloudtest.FloatingIP{IP: "10.0.0.1"})
+	apiB.AddFloatingIP(hcloudtest.FloatingIP{IP: "10.0.1.1"})
+	newClient := func(token string) *hcloud.Client {
+		if token == "token-b" {
+			return apiB.Client(hcloud.WithToken(token))
+		}
+		return apiA.Client(hcloud.WithToken(token))
+	}
+
+	k8sCli := kubefake.NewSimpleClientset(projectNode("node-a", "a", 100), projectNode("node-b", "b", 200))
+	pools := []*hcloudv1alpha1.FloatingIPPool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "a"},
+			Spec:       hcloudv1alpha1.FloatinIPPoolSpec{Ips: []string{"10.0.0.1"}, NodeSelector: map[string]string{"project": "a"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "b"},
+			Spec: hcloudv1alpha1.FloatinIPPoolSpec{
+				Ips:            []string{"10.0.1.1"},
+				NodeSelector:   map[string]string{"project": "b"},
+				TokenSecretRef: &hcloudv1alpha1.SecretKeyRef{Name: "hcloud-b", Namespace: metav1.NamespaceDefault},
+			},
+		},
+	}
+	fipCli := floatingipk8sfake.NewSimpleClientset(pools[0], pools[1])
+	recorder := record.NewFakeRecorder(100)
+	cfg := Config{ActionTimeout: 5 * time.Second, HCloudQPS: 1000, HCloudBurst: 1000, CircuitFailureThreshold: 5, CircuitOpenPeriod: time.Minute}
+	projMetrics := &projectMetrics{Recorder: metrics.Dummy}
+	c := NewService(cfg, k8sCli, fipCli, "token-a", newClient, projMetrics, recorder, kooperlog.Dummy)
+
+	stopC := make(chan struct{})
+	defer close(stopC)
+	c.secrets.run(stopC)
+
+	for _, pool := range pools {
+		if err := c.EnsureFloatingIPPool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range pools {
+		key, _ := c.queue.Get()
+		c.queue.Done(key)
+	}
+
+	// nextQueued waits for a pool to be queued and returns it.
+	nextQueued := func() string {
+		err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			return c.queue.Len() > 0, nil
+		})
+		if err != nil {
+			t.Fatal("expected a pool to be queued")
+		}
+		key, _ := c.queue.Get()
+		c.queue.Done(key)
+		return key.(string)
+	}
+
+	// The pool without a token secret uses the token of the operator.
+	if err := c.reconcile(c.get("a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := apiA.Assignments()["10.0.0.1"]; got != 100 {
+		t.Errorf("expected 10.0.0.1 on server 100, got %d", got)
+	}
+	if cond := credentialsCondition(t, fipCli, "a"); cond.Status != corev1.ConditionTrue {
+		t.Errorf("expected valid credentials, got %+v", cond)
+	}
+
+	// The secret of the other pool doesn't exist yet.
+	if err := c.reconcile(c.get("b")); err == nil {
+		t.Errorf("expected an error without the token secret")
+	}
+	if cond := credentialsCondition(t, fipCli, "b"); cond.Status != corev1.ConditionFalse || cond.Reason != CredentialsReasonSecretNotFound {
+		t.Errorf("expected a missing secret, got %+v", cond)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "hcloud-b", Namespace: metav1.NamespaceDefault},
+		Data:       map[string][]byte{DefaultTokenKey: []byte("token-b\n")},
+	}
+	if _, err := k8sCli.CoreV1().Secrets(metav1.NamespaceDefault).Create(secret); err != nil {
+		t.Fatal(err)
+	}
+	if name := nextQueued(); name != "b" {
+		t.Fatalf("expected pool b to be reconciled when its secret is created, got %s", name)
+	}
+	if err := c.reconcile(c.get("b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := apiB.Assignments()["10.0.1.1"]; got != 200 {
+		t.Errorf("expected 10.0.1.1 on server 200, got %d", got)
+	}
+	if cond := credentialsCondition(t, fipCli, "b"); cond.Status != corev1.ConditionTrue {
+		t.Errorf("expected valid credentials, got %+v", cond)
+	}
+
+	// A revoked token is rejected by the hcloud api.
+	secret.Data[DefaultTokenKey] = []byte("revoked")
+	if _, err := k8sCli.CoreV1().Secrets(metav1.NamespaceDefault).Update(secret); err != nil {
+		t.Fatal(err)
+	}
+	if name := nextQueued(); name != "b" {
+		t.Fatalf("expected pool b to be reconciled when its secret changes, got %s", name)
+	}
+	if err := c.reconcile(c.get("b")); err == nil {
+		t.Errorf("expected an error with a revoked token")
+	}
+	if cond := credentialsCondition(t, fipCli, "b"); cond.Status != corev1.ConditionFalse || cond.Reason != CredentialsReasonUnauthorized {
+		t.Errorf("expected a rejected token, got %+v", cond)
+	}
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	for _, reason := range []string{ReasonInvalidCredentials + " token secret default/hcloud-b not found", ReasonCredentialsValid, ReasonInvalidCredentials + " the hcloud token of project default/hcloud-b was rejected"} {
+		found := false
+		for _, ev := range events {
+			found = found || strings.Contains(ev, reason)
+		}
+		if !found {
+			t.Errorf("expected a %q event, got %v", reason, events)
+		}
+	}
+
+	// The project of the old token is dropped, its metrics are kept for the
+	// project of the new token with the same name. The project of a deleted
+	// pool is dropped with its metrics.
+	if n := len(c.projects.byToken); n != 2 {
+		t.Errorf("expected 2 projects, got %d", n)
+	}
+	if len(projMetrics.deleted) != 0 {
+		t.Errorf("expected the metrics of the rotated project to be kept, got deleted %v", projMetrics.deleted)
+	}
+	if err := c.DeleteFloatingIPPool("b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.projects.byToken); n != 1 {
+		t.Errorf("expected 1 project, got %d", n)
+	}
+	if len(projMetrics.deleted) != 1 || projMetrics.deleted[0] != "default/hcloud-b" {
+		t.Errorf("expected the metrics of default/hcloud-b to be deleted, got %v", projMetrics.deleted)
+	}
+
+	// Only the secrets of the namespace of the token secret are read.
+	for _, action := range k8sCli.Actions() {
+		if action.GetResource().Resource == "secrets" && action.GetNamespace() != metav1.NamespaceDefault {
+			t.Errorf("expected only secrets in %s to be read, got %s of secrets in %q", metav1.NamespaceDefault, action.GetVerb(), action.GetNamespace())
+		}
+	}
+}
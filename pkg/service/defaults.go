@@ -0,0 +1,83 @@
+package service
+
+import (
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+)
+
+// PoolDefaults are the settings of the pools that leave them unset.
+type PoolDefaults struct {
+	IntervalSeconds      hcloudv1alpha1.Seconds
+	FailoverAfterSeconds hcloudv1alpha1.Seconds
+	MinHoldSeconds       hcloudv1alpha1.Seconds
+	DriftPolicy          hcloudv1alpha1.DriftPolicy
+}
+
+// apply returns the pool with the defaults for the settings it leaves unset,
+// the pool itself when no default applies.
+func (d PoolDefaults) apply(fip *hcloudv1alpha1.FloatingIPPool) *hcloudv1alpha1.FloatingIPPool {
+	spec := fip.Spec
+	if spec.IntervalSeconds == 0 {
+		spec.IntervalSeconds = d.IntervalSeconds
+	}
+	if spec.FailoverAfterSeconds == 0 {
+		spec.FailoverAfterSeconds = d.FailoverAfterSeconds
+	}
+	if spec.MinHoldSeconds == 0 {
+		spec.MinHoldSeconds = d.MinHoldSeconds
+	}
+	if spec.DriftPolicy == "" {
+		spec.DriftPolicy = d.DriftPolicy
+	}
+
+	if spec.IntervalSeconds == fip.Spec.IntervalSeconds &&
+		spec.FailoverAfterSeconds == fip.Spec.FailoverAfterSeconds &&
+		spec.MinHoldSeconds == fip.Spec.MinHoldSeconds &&
+		spec.DriftPolicy == fip.Spec.DriftPolicy {
+		return fip
+	}
+	fip = fip.DeepCopy()
+	fip.Spec.IntervalSeconds = spec.IntervalSeconds
+	fip.Spec.FailoverAfterSeconds = spec.FailoverAfterSeconds
+	fip.Spec.MinHoldSeconds = spec.MinHoldSeconds
+	fip.Spec.DriftPolicy = spec.DriftPolicy
+	return fip
+}
+
+// setDefaults replaces the pool defaults of the ip assigner, they are
+// applied on the next reconcile.
+func (p *IPAssigner) setDefaults(defaults PoolDefaults) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.defaults = defaults
+}
+
+// defaultedPool returns the pool the ip assigner is currently working with,
+// with the pool defaults applied.
+func (p *IPAssigner) defaultedPool() *hcloudv1alpha1.FloatingIPPool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.defaults.apply(p.fip)
+}
+
+// Reload applies the settings of cfg that can change while the service runs:
+// the hcloud rate limits and the pool defaults, the other settings are
+// ignored. The pools are reconciled right away with the new defaults.
+func (c *Service) Reload(cfg Config) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if cfg.HCloudQPS != c.cfg.HCloudQPS || cfg.HCloudBurst != c.cfg.HCloudBurst {
+		c.logger.Infof("hcloud rate limit changed to %g qps with a burst of %d", cfg.HCloudQPS, cfg.HCloudBurst)
+		c.cfg.HCloudQPS, c.cfg.HCloudBurst = cfg.HCloudQPS, cfg.HCloudBurst
+		c.projects.setRateLimit(cfg.HCloudQPS, cfg.HCloudBurst)
+	}
+
+	if cfg.PoolDefaults != c.cfg.PoolDefaults {
+		c.logger.Infof("pool defaults changed to %+v", cfg.PoolDefaults)
+		c.cfg.PoolDefaults = cfg.PoolDefaults
+		for name, ipa := range c.pools {
+			ipa.setDefaults(cfg.PoolDefaults)
+			c.queue.Add(name)
+		}
+	}
+}
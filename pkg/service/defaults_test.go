@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	kooperlog "github.com/spotahome/kooper/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8sfake "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned/fake"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudtest"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+)
+
+func TestReloadAppliesPoolDefaults(t *testing.T) {
+	api := hcloudtest.NewAPI()
+	defer api.Close()
+	newClient := func(token string) *hcloud.Client {
+		return api.Client()
+	}
+
+	pools := []*hcloudv1alpha1.FloatingIPPool{
+		{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "custom"}, Spec: hcloudv1alpha1.FloatinIPPoolSpec{IntervalSeconds: 30, DriftPolicy: hcloudv1alpha1.DriftEnforce}},
+	}
+	cfg := Config{HCloudQPS: 1, HCloudBurst: 10, PoolDefaults: PoolDefaults{IntervalSeconds: 60}}
+	c := NewService(cfg, kubefake.NewSimpleClientset(), floatingipk8sfake.NewSimpleClientset(pools[0], pools[1]), "token", newClient, metrics.Dummy, record.NewFakeRecorder(100), kooperlog.Dummy)
+	for _, pool := range pools {
+		if err := c.EnsureFloatingIPPool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range pools {
+		key, _ := c.queue.Get()
+		c.queue.Done(key)
+	}
+
+	if got := c.get("default").Interval(); got != time.Minute {
+		t.Errorf("expected the default interval, got %s", got)
+	}
+
+	cfg.PoolDefaults = PoolDefaults{IntervalSeconds: 120, DriftPolicy: hcloudv1alpha1.DriftObserve}
+	cfg.HCloudQPS = 5
+	c.Reload(cfg)
+
+	if got := c.get("default").Interval(); got != 2*time.Minute {
+		t.Errorf("expected the reloaded default interval, got %s", got)
+	}
+	if got := c.get("custom").Interval(); got != 30*time.Second {
+		t.Errorf("expected the interval of the pool to win over the default, got %s", got)
+	}
+	if !observeDrift(c.get("default").defaultedPool()) || observeDrift(c.get("custom").defaultedPool()) {
+		t.Errorf("expected the default drift policy only on the pool without one")
+	}
+	if c.get("default").pool().Spec.IntervalSeconds != 0 {
+		t.Errorf("expected the defaults to leave the pool alone")
+	}
+	if n := c.queue.Len(); n != 2 {
+		t.Errorf("expected both pools to be reconciled with the new defaults, got %d", n)
+	}
+	if c.projects.cfg.HCloudQPS != 5 {
+		t.Errorf("expected new projects to get the reloaded rate limit")
+	}
+}
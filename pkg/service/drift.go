@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/inventory"
+)
+
+// Event reasons.
+const (
+	// ReasonDrift is the reason of the event on a pool with a floating ip
+	// that was reassigned outside of the operator.
+	ReasonDrift = "Drift"
+	// ReasonDriftResolved is the reason of the event on a pool with an
+	// observed drift that got resolved.
+	ReasonDriftResolved = "DriftResolved"
+)
+
+// driftActions is the number of recent actions of a floating ip searched
+// for the cause of a drift.
+const driftActions = 25
+
+// observeDrift returns true when the pool leaves drifted floating ips alone.
+func observeDrift(fip *hcloudv1alpha1.FloatingIPPool) bool {
+	return fip.Spec.DriftPolicy == hcloudv1alpha1.DriftObserve
+}
+
+// detectDrift compares the floating ips with the servers the operator last
+// assigned them to, previous holds the last status of every ip and
+// p.assigned the assignments since, and returns
+// the drift by ip. A new drift is logged and reported with a warning event,
+// an observed drift that got resolved with an event. A floating ip whose
+// server was deleted is not drift, the operator fails it over.
+func (p *IPAssigner) detectDrift(fip *hcloudv1alpha1.FloatingIPPool, hetznerIps []*hcloud.FloatingIP, previous map[string]hcloudv1alpha1.IPStatus, inv *inventory.Snapshot) map[string]hcloudv1alpha1.IPDrift {
+	observed := map[string]hcloudv1alpha1.IPDrift{}
+	for _, d := range p.status.Drift {
+		observed[d.IP] = d
+	}
+
+	drift := map[string]hcloudv1alpha1.IPDrift{}
+	for _, hetznerIp := range hetznerIps {
+		ip := hetznerIp.IP.String()
+		last, assigned := p.assigned[ip]
+		if !assigned {
+			last = previous[ip]
+		}
+		d, ok := observed[ip]
+		if !ok {
+			d = hcloudv1alpha1.IPDrift{IP: ip, ExpectedNode: last.Node, ExpectedServerID: last.ServerID}
+		}
+		var serverID int
+		if hetznerIp.Server != nil {
+			serverID = hetznerIp.Server.ID
+		}
+
+		if d.ExpectedServerID == 0 || serverID == d.ExpectedServerID || inv.ServerByID(d.ExpectedServerID) == nil {
+			if ok {
+				p.logger.Infof("%s ip %s drift resolved", fip.Name, ip)
+				p.events.Eventf(fip, corev1.EventTypeNormal, ReasonDriftResolved, "ip %s is no longer drifted", ip)
+			}
+			continue
+		}
+		if ok && serverID == d.ServerID {
+			drift[ip] = d
+			continue
+		}
+
+		d.ServerID = serverID
+		d.Kind = hcloudv1alpha1.DriftReassigned
+		if serverID == 0 {
+			d.Kind = hcloudv1alpha1.DriftUnassigned
+		}
+		d.Cause = p.driftCause(hetznerIp, last.LastTransitionTime.Time)
+		d.DetectedTime = metav1.NewTime(p.time.Now())
+		drift[ip] = d
+
+		msg := describeDrift(d, inv)
+		p.logger.Warningf("%s %s", fip.Name, msg)
+		p.events.Event(fip, corev1.EventTypeWarning, ReasonDrift, msg)
+		p.metrics.ObserveDrift(fip.Name, string(d.Kind))
+	}
+
+	return drift
+}
+
+// driftCause returns the hcloud action that most likely changed the floating
+// ip, the newest assign or unassign action started since the operator last
+// moved it.
+func (p *IPAssigner) driftCause(fip *hcloud.FloatingIP, since time.Time) string {
+	ctx, cancel := context.WithTimeout(context.TODO(), p.cfg.ActionTimeout)
+	defer cancel()
+
+	if err := p.guard.Before(ctx, hcloudapi.PriorityLow); err != nil {
+		return fmt.Sprintf("unknown, could not list the actions: %s", err)
+	}
+	req, err := p.hcloudCli.NewRequest(ctx, "GET", fmt.Sprintf("/floating_ips/%d/actions?sort=started:desc&page=1&per_page=%d", fip.ID, driftActions), nil)
+	if err != nil {
+		return fmt.Sprintf("unknown, could not list the actions: %s", err)
+	}
+	var body schema.ActionListResponse
+	resp, err := p.hcloudCli.Do(req, &body)
+	p.guard.After(resp, err)
+	if err != nil {
+		return fmt.Sprintf("unknown, could not list the actions: %s", err)
+	}
+
+	for _, a := range body.Actions {
+		action := hcloud.ActionFromSchema(a)
+		if action.Command != "assign_floating_ip" && action.Command != "unassign_floating_ip" {
+			continue
+		}
+		if action.Started.Before(since) {
+			break
+		}
+		return fmt.Sprintf("%s action %d started at %s", action.Command, action.ID, action.Started.UTC().Format(time.RFC3339))
+	}
+	return "unknown, no recent assign or unassign action"
+}
+
+// describeDrift returns a human readable description of the drift.
+func describeDrift(d hcloudv1alpha1.IPDrift, inv *inventory.Snapshot) string {
+	if d.Kind == hcloudv1alpha1.DriftUnassigned {
+		return fmt.Sprintf("ip %s was unassigned from node %s outside of the operator, cause: %s", d.IP, d.ExpectedNode, d.Cause)
+	}
+
+	server := fmt.Sprintf("server %d", d.ServerID)
+	if s := inv.ServerByID(d.ServerID); s != nil {
+		server = fmt.Sprintf("server %s (%d)", s.Name, s.ID)
+	}
+	return fmt.Sprintf("ip %s was reassigned from node %s to %s outside of the operator, cause: %s", d.IP, d.ExpectedNode, server, d.Cause)
+}
+
+// driftList returns the drift ordered as the floating ips.
+func driftList(hetznerIps []*hcloud.FloatingIP, drift map[string]hcloudv1alpha1.IPDrift) []hcloudv1alpha1.IPDrift {
+	var list []hcloudv1alpha1.IPDrift
+	for _, hetznerIp := range hetznerIps {
+		if d, ok := drift[hetznerIp.IP.String()]; ok {
+			list = append(list, d)
+		}
+	}
+	return list
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+)
+
+// preferredNode returns the preferred node of the ip, from the spec or as
+// remembered in the status of the pool. Empty when the ip has none yet.
+func preferredNode(fip *hcloudv1alpha1.FloatingIPPool, ip string, previous hcloudv1alpha1.IPStatus) string {
+	if node, ok := fip.Spec.PreferredNodes[ip]; ok {
+		return node
+	}
+	return previous.PreferredNode
+}
+
+// failbackAllowed returns a function telling whether floating ips may return
+// to the given preferred node right now, according to the failback policy of
+// the pool.
+func (p *IPAssigner) failbackAllowed(fip *hcloudv1alpha1.FloatingIPPool) func(node string) bool {
+	never := func(string) bool { return false }
+
+	policy := fip.Spec.Failback
+	if policy == nil {
+		return never
+	}
+
+	switch policy.Mode {
+	case "", hcloudv1alpha1.FailbackNever:
+		return never
+	case hcloudv1alpha1.FailbackImmediate:
+		return func(string) bool { return true }
+	case hcloudv1alpha1.FailbackAfterStableSeconds:
+		stable := time.Duration(policy.StableSeconds) * time.Second
+		return func(node string) bool {
+			h, ok := p.health[node]
+			return ok && h.healthy && p.time.Now().Sub(h.since) >= stable
+		}
+	case hcloudv1alpha1.FailbackMaintenanceWindow:
+		open, err := windowOpen(policy.Window, p.time.Now())
+		if err != nil {
+			p.logger.Warningf("%s invalid failback maintenance window, not failing back: %s", fip.Name, err)
+			return never
+		}
+		return func(string) bool { return open }
+	default:
+		p.logger.Warningf("%s unknown failback mode %s, not failing back", fip.Name, policy.Mode)
+		return never
+	}
+}
+
+// windowOpen returns true when the maintenance window is open at the given
+// time.
+func windowOpen(w *hcloudv1alpha1.MaintenanceWindow, now time.Time) (bool, error) {
+	if w == nil {
+		return false, fmt.Errorf("no window")
+	}
+
+	start, err := minuteOfDay(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := minuteOfDay(w.End)
+	if err != nil {
+		return false, err
+	}
+	for _, day := range w.Days {
+		if _, err := weekday(day); err != nil {
+			return false, err
+		}
+	}
+
+	startsOn := func(t time.Time) bool {
+		if len(w.Days) == 0 {
+			return true
+		}
+		for _, day := range w.Days {
+			if d, _ := weekday(day); d == t.Weekday() {
+				return true
+			}
+		}
+		return false
+	}
+
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return startsOn(now) && minute >= start && minute < end, nil
+	}
+	// The window ends the next day.
+	return (startsOn(now) && minute >= start) || (startsOn(now.AddDate(0, 0, -1)) && minute < end), nil
+}
+
+// minuteOfDay parses a HH:MM time.
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// weekday parses the name of a day of the week, e.g. Sat or Saturday.
+func weekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := d.String()
+		if strings.EqualFold(s, name) || strings.EqualFold(s, name[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+)
+
+func TestWindowOpen(t *testing.T) {
+	// 2018-07-07 is a Saturday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2018, time.July, day, hour, minute, 0, 0, time.UTC)
+	}
+	weekend := &hcloudv1alpha1.MaintenanceWindow{Start: "22:00", End: "02:00", Days: []string{"Saturday", "sun"}}
+
+	tests := []struct {
+		name   string
+		window *hcloudv1alpha1.MaintenanceWindow
+		now    time.Time
+		open   bool
+		err    bool
+	}{
+		{"within a daily window", &hcloudv1alpha1.MaintenanceWindow{Start: "02:00", End: "03:00"}, at(4, 2, 30), true, false},
+		{"at the end of a daily window", &hcloudv1alpha1.MaintenanceWindow{Start: "02:00", End: "03:00"}, at(4, 3, 0), false, false},
+		{"before midnight", weekend, at(7, 23, 0), true, false},
+		{"after midnight", weekend, at(8, 1, 0), true, false},
+		{"after midnight the day after the last day", weekend, at(9, 1, 0), true, false},
+		{"after midnight the day after another day", weekend, at(7, 1, 0), false, false},
+		{"on another day", weekend, at(6, 23, 0), false, false},
+		{"invalid time", &hcloudv1alpha1.MaintenanceWindow{Start: "2am", End: "03:00"}, at(4, 2, 30), false, true},
+		{"invalid day", &hcloudv1alpha1.MaintenanceWindow{Start: "02:00", End: "03:00", Days: []string{"Caturday"}}, at(4, 2, 30), false, true},
+		{"no window", nil, at(4, 2, 30), false, true},
+	}
+
+	for _, test := range tests {
+		open, err := windowOpen(test.window, test.now)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if open != test.open {
+			t.Errorf("%s: expected open %t, got %t", test.name, test.open, open)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+)
+
+// Event reasons.
+const (
+	// ReasonNodeQuarantined is the reason of the event on a node that is
+	// flapping and gets no new floating ips of a pool.
+	ReasonNodeQuarantined = "NodeQuarantined"
+)
+
+// nodeHealth is the health of a node as seen by the reconciles of a pool.
+type nodeHealth struct {
+	healthy bool
+	// since is the time the node became healthy or failing, transitions
+	// the times of the recent changes.
+	since       time.Time
+	transitions []time.Time
+	quarantined bool
+}
+
+// observeNode records the health of the node and returns its history.
+func (p *IPAssigner) observeNode(name string, healthy bool) *nodeHealth {
+	now := p.time.Now()
+
+	h, ok := p.health[name]
+	if !ok {
+		h = &nodeHealth{healthy: healthy, since: now}
+		p.health[name] = h
+		return h
+	}
+
+	if h.healthy != healthy {
+		h.healthy = healthy
+		h.since = now
+		h.transitions = append(h.transitions, now)
+	}
+	return h
+}
+
+// failingSince returns when the node started failing: the earliest of the
+// first time the node was seen failing, the last transition of its ready
+// condition and, while the node wasn't seen healthy since the operator
+// started, the time in the last status of the pool. The grace period of a
+// node with a stopped or locked server so continues after a restart of the
+// operator or a change of leader instead of starting over.
+func (p *IPAssigner) failingSince(node *corev1.Node, h *nodeHealth) time.Time {
+	since := h.since
+	for _, c := range node.Status.Conditions {
+		if c.Type != corev1.NodeReady || c.Status == corev1.ConditionTrue {
+			continue
+		}
+		if !c.LastTransitionTime.IsZero() && c.LastTransitionTime.Time.Before(since) {
+			since = c.LastTransitionTime.Time
+		}
+	}
+	if len(h.transitions) > 0 {
+		return since
+	}
+	for _, f := range p.status.FailingNodes {
+		if f.Node == node.Name && !f.Since.IsZero() && f.Since.Time.Before(since) {
+			since = f.Since.Time
+		}
+	}
+	return since
+}
+
+// holdUntil returns until when the ip has to stay on its node because it
+// moved recently, false when it may be moved. previous is the last status of
+// the ip.
+func (p *IPAssigner) holdUntil(fip *hcloudv1alpha1.FloatingIPPool, previous hcloudv1alpha1.IPStatus) (time.Time, bool) {
+	if fip.Spec.MinHoldSeconds <= 0 || previous.IP == "" {
+		return time.Time{}, false
+	}
+	until := previous.LastTransitionTime.Add(time.Duration(fip.Spec.MinHoldSeconds) * time.Second)
+	return until, p.time.Now().Before(until)
+}
+
+// forgetNodes drops the history of the nodes that are no longer seen.
+func (p *IPAssigner) forgetNodes(seen map[string]bool) {
+	for name := range p.health {
+		if !seen[name] {
+			delete(p.health, name)
+		}
+	}
+}
+
+// checkFlapping updates the quarantine of the node, a node is quarantined
+// while it changed health at least the flapping transitions within the
+// flapping window.
+func (p *IPAssigner) checkFlapping(fip *hcloudv1alpha1.FloatingIPPool, node *corev1.Node, h *nodeHealth) bool {
+	policy := fip.Spec.Flapping
+	if policy == nil || policy.Transitions < 1 {
+		h.quarantined = false
+		return false
+	}
+
+	since := p.time.Now().Add(-time.Duration(policy.WindowSeconds) * time.Second)
+	recent := h.transitions[:0]
+	for _, t := range h.transitions {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+	h.transitions = recent
+
+	flapping := len(recent) >= policy.Transitions
+	switch {
+	case flapping && !h.quarantined:
+		p.logger.Warningf("%s node %s changed health %d times within %ds, quarantining it", fip.Name, node.Name, len(recent), policy.WindowSeconds)
+		p.events.Eventf(node, corev1.EventTypeWarning, ReasonNodeQuarantined, "node changed health %d times within %ds, it gets no new floating ips of pool %s until it is stable", len(recent), policy.WindowSeconds, fip.Name)
+	case !flapping && h.quarantined:
+		p.logger.Infof("%s node %s is stable again, ending its quarantine", fip.Name, node.Name)
+	}
+	h.quarantined = flapping
+
+	return flapping
+}
+
+// quarantinedNodes returns the names of the quarantined nodes in order.
+func (p *IPAssigner) quarantinedNodes() []string {
+	var names []string
+	for name, h := range p.health {
+		if h.quarantined {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -12,17 +12,27 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/hetznercloud/hcloud-go/hcloud"
 
 	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8scli "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/inventory"
 	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/planner"
 )
 
 const (
 	// MinimalIntervalSeconds is the lower bound for refreshing floating ips
 	MinimalIntervalSeconds hcloudv1alpha1.Seconds = 5
+	// MaxAssignAttempts is the number of nodes an ip is tried to be assigned
+	// to in a single reconcile before giving up on it.
+	MaxAssignAttempts = 3
 )
 
 // TimeWrapper is a wrapper around time so it can be mocked
@@ -38,100 +48,166 @@ type timeStd struct{}
 func (t *timeStd) After(d time.Duration) <-chan time.Time { return time.After(d) }
 func (t *timeStd) Now() time.Time                         { return time.Now() }
 
-// IPAssigner will verify ip assignment at regular intervals.
+// IPAssigner verifies the ip assignment of a pool each time it is reconciled.
 type IPAssigner struct {
-	fip       *hcloudv1alpha1.FloatingIPPool
-	k8sCli    kubernetes.Interface
-	hcloudCli *hcloud.Client
-	logger    log.Logger
-	time      TimeWrapper
-
-	running bool
-	mutex   sync.Mutex
-	stopC   chan struct{}
+	cfg           Config
+	fip           *hcloudv1alpha1.FloatingIPPool
+	k8sCli        kubernetes.Interface
+	floatingIPCli floatingipk8scli.Interface
+	hcloudCli     *hcloud.Client
+	guard         *hcloudapi.Guard
+	inventory     *inventory.Inventory
+	metrics       metrics.Recorder
+	events        record.EventRecorder
+	logger        log.Logger
+	time          TimeWrapper
+	// rand breaks ties between equally good nodes, it is only used from
+	// within a reconcile.
+	rand *rand.Rand
+
+	// status is the last status written to the pool and backoffs the retry
+	// state of the ips that failed to be assigned, both are only used from
+	// within a reconcile.
+	status   hcloudv1alpha1.FloatingIPPoolStatus
+	backoffs map[string]*ipBackoff
+	// assigned are the assignments of ips the operator made that are not in
+	// the written status yet, drift is detected against them so a failed
+	// status write doesn't turn the own moves of the operator into drift.
+	// Only used from within a reconcile.
+	assigned map[string]hcloudv1alpha1.IPStatus
+	// health is the health history of the nodes of the pool, only used from
+	// within a reconcile.
+	health map[string]*nodeHealth
+	// unresolved is why the nodes without a matching hcloud server are not
+	// eligible by node name, so they are only reported when that changes.
+	// Only used from within a reconcile.
+	unresolved map[string]string
+	// voluntaryMoves is the number of rebalances and failbacks made within
+	// the disruption budget window that ends at movesWindowEnd, both are only
+	// used from within a reconcile.
+	voluntaryMoves int
+	movesWindowEnd time.Time
+	// graceEnds is the earliest end of the failover grace period of a
+	// failing node, zero when no node is failing. Only used from within a
+	// reconcile and by the worker that ran it.
+	graceEnds time.Time
+	// paused, pin and move are the last seen control annotations, only used
+	// from within a reconcile.
+	paused bool
+	pin    string
+	move   string
+
+	// defaults are the pool defaults, guarded by the mutex like the pool.
+	defaults PoolDefaults
+	mutex    sync.Mutex
 }
 
 // NewIPAssigner returns a new ip assigner.
-func NewIPAssigner(fip *hcloudv1alpha1.FloatingIPPool, k8sCli kubernetes.Interface, hcloudCli *hcloud.Client, logger log.Logger) *IPAssigner {
-	return &IPAssigner{
-		fip:       fip,
-		k8sCli:    k8sCli,
-		hcloudCli: hcloudCli,
-		logger:    logger,
-		time:      &timeStd{},
-	}
+func NewIPAssigner(cfg Config, fip *hcloudv1alpha1.FloatingIPPool, k8sCli kubernetes.Interface, floatingIPCli floatingipk8scli.Interface, hcloudCli *hcloud.Client, guard *hcloudapi.Guard, inv *inventory.Inventory, recorder metrics.Recorder, events record.EventRecorder, logger log.Logger) *IPAssigner {
+	return NewCustomIPAssigner(cfg, fip, k8sCli, floatingIPCli, hcloudCli, guard, inv, recorder, events, &timeStd{}, logger)
 }
 
 // NewCustomIPAssigner is a constructor that lets you customize everything on the object construction.
-func NewCustomIPAssigner(fip *hcloudv1alpha1.FloatingIPPool, k8sCli kubernetes.Interface, hcloudCli *hcloud.Client, time TimeWrapper, logger log.Logger) *IPAssigner {
+func NewCustomIPAssigner(cfg Config, fip *hcloudv1alpha1.FloatingIPPool, k8sCli kubernetes.Interface, floatingIPCli floatingipk8scli.Interface, hcloudCli *hcloud.Client, guard *hcloudapi.Guard, inv *inventory.Inventory, recorder metrics.Recorder, events record.EventRecorder, time TimeWrapper, logger log.Logger) *IPAssigner {
+	if cfg.ActionTimeout <= 0 {
+		cfg.ActionTimeout = DefaultActionTimeout
+	}
+	if cfg.AssignConcurrency < 1 {
+		cfg.AssignConcurrency = 1
+	}
+
 	return &IPAssigner{
-		fip:       fip,
-		k8sCli:    k8sCli,
-		hcloudCli: hcloudCli,
-		logger:    logger,
-		time:      time,
+		cfg:           cfg,
+		fip:           fip,
+		k8sCli:        k8sCli,
+		floatingIPCli: floatingIPCli,
+		hcloudCli:     hcloudCli,
+		guard:         guard,
+		inventory:     inv,
+		metrics:       recorder,
+		events:        events,
+		logger:        logger,
+		time:          time,
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		status:        *fip.Status.DeepCopy(),
+		backoffs:      map[string]*ipBackoff{},
+		assigned:      map[string]hcloudv1alpha1.IPStatus{},
+		health:        map[string]*nodeHealth{},
+		unresolved:    map[string]string{},
+		defaults:      cfg.PoolDefaults,
 	}
 }
 
 // SameSpec checks if the ip assigner has the same spec.
 func (p *IPAssigner) SameSpec(fip *hcloudv1alpha1.FloatingIPPool) bool {
-	return reflect.DeepEqual(p.fip.Spec, fip.Spec)
+	return reflect.DeepEqual(p.pool().Spec, fip.Spec)
 }
 
-// Start will run the ip assigner at regular intervals.
-func (p *IPAssigner) Start() error {
+// ReconcileRequested checks if the reconcile annotation or one of the control
+// annotations of the pool changed since the ip assigner last saw them. The
+// removal of the move annotation, which the operator does itself once the
+// moves are done, is not a request.
+func (p *IPAssigner) ReconcileRequested(fip *hcloudv1alpha1.FloatingIPPool) bool {
+	current := p.pool()
+	for _, annotation := range controlAnnotations {
+		if annotation == hcloudv1alpha1.MoveAnnotation && fip.Annotations[annotation] == "" {
+			continue
+		}
+		if current.Annotations[annotation] != fip.Annotations[annotation] {
+			return true
+		}
+	}
+	return false
+}
+
+// Update replaces the pool of the ip assigner, the new spec is applied on
+// the next reconcile.
+func (p *IPAssigner) Update(fip *hcloudv1alpha1.FloatingIPPool) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	if p.running {
-		return fmt.Errorf("already running")
-	}
+	p.fip = fip
+}
 
-	p.stopC = make(chan struct{})
-	p.running = true
+// Interval returns the time to wait between two reconciles of the pool.
+func (p *IPAssigner) Interval() time.Duration {
+	return time.Duration(max(p.defaultedPool().Spec.IntervalSeconds, MinimalIntervalSeconds)) * time.Second
+}
 
-	go func() {
-		p.logger.Infof("started %s ip assigner", p.fip.Name)
-		if err := p.run(); err != nil {
-			p.logger.Errorf("error executing ip assigner: %s", err)
+// NextReconcile returns the time to wait before the next reconcile of the
+// pool, the interval or less when the grace period of a failing node ends
+// earlier.
+func (p *IPAssigner) NextReconcile() time.Duration {
+	next := p.Interval()
+	if !p.graceEnds.IsZero() {
+		if left := p.graceEnds.Sub(p.time.Now()); left < next {
+			next = left
 		}
-	}()
-
-	return nil
+	}
+	return next
 }
 
-// Stop stops the ip assigner.
-func (p *IPAssigner) Stop() error {
+// pool returns the pool the ip assigner is currently working with.
+func (p *IPAssigner) pool() *hcloudv1alpha1.FloatingIPPool {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	if p.running {
-		close(p.stopC)
-		p.logger.Infof("stopped %s ip assigner", p.fip.Name)
-	}
-
-	p.running = false
-	return nil
+	return p.fip
 }
 
-// run will run the loop that will kill eventually the required pods.
-func (p *IPAssigner) run() error {
-	for {
-		select {
-		case <-p.time.After(time.Duration(max(p.fip.Spec.IntervalSeconds, MinimalIntervalSeconds)) * time.Second):
-			if err := p.assign(); err != nil {
-				p.logger.Errorf("error assigning ip: %s", err)
-			}
-		case <-p.stopC:
-			return nil
-		}
-	}
+// Reconcile verifies the current assignment of the floating ips of the pool
+// once and corrects it where needed.
+func (p *IPAssigner) Reconcile() error {
+	return p.assign()
 }
 
 // asign will verify current assignment of the floating ip and change
 // assignment to a node matching the nodeSelector in case the floating
 // ip is currently not correctly assigned
 func (p *IPAssigner) assign() error {
+	fip := p.defaultedPool()
+	p.forgetIPs(fip.Spec.Ips)
+
 	// Get all probable targets.
-	nodes, err := p.getProbableNodes()
+	nodes, err := p.getProbableNodes(fip)
 	if err != nil {
 		return err
 	}
@@ -139,222 +215,293 @@ func (p *IPAssigner) assign() error {
 	total := len(nodes.Items)
 	if total == 0 {
 		p.logger.Errorf("0 nodes probable targets")
-		return fmt.Errorf("%s ip assigner: 0 nodes probable targets", p.fip.Name)
+		return fmt.Errorf("%s ip assigner: 0 nodes probable targets", fip.Name)
 	}
 
-	// Get nodes in random order.
-	targets, targetNames := p.getRandomNodes(nodes)
-
-	// Get available Hetzner IPs
-	hetznerIps, err := p.findHCloudFloatingIps()
+	// Get the floating ips and servers of the project.
+	inv, err := p.inventory.Get(context.TODO())
 	if err != nil {
 		return err
 	}
 
-	// Get all Hetzner servers #TODO: support pagination or filter to get only nodes in probableNodes?
-	hetznerServers, err := p.findServers()
-	if err != nil {
-		return err
+	// Only the nodes with a server are targets.
+	targets := p.getTargets(fip, nodes.Items, inv)
+	if len(targets) == 0 {
+		return fmt.Errorf("%s ip assigner: none of the %d probable nodes has a matching hcloud server", fip.Name, total)
 	}
-	var hetznerServersByID = make(map[int]*hcloud.Server)
-	var hetznerServersByName = make(map[string]*hcloud.Server)
 
-	for i := range hetznerServers {
-		server := hetznerServers[i]
-		hetznerServersByID[server.ID] = server
-		hetznerServersByName[server.Name] = server
+	var targetsByName = make(map[string]*target, len(targets))
+	var targetsByServerID = make(map[int]*target, len(targets))
+	var planNodes = make([]planner.Node, 0, len(targets))
+	for _, t := range targets {
+		targetsByServerID[t.server.ID] = t
+		// Failing and quarantined nodes keep their ips but get no new ones.
+		if t.keepsOnly() {
+			continue
+		}
+		targetsByName[t.node.Name] = t
+		planNodes = append(planNodes, planner.Node{
+			Name:     t.node.Name,
+			ServerID: t.server.ID,
+			Domain:   t.domain,
+			Location: location(t.server),
+		})
 	}
 
-	var hetznerIpsToAssign = make([]*hcloud.FloatingIP, 0)
-	var assignedServers = make([]string, 0)
-	var assignments = map[string]([]*hcloud.FloatingIP){}
+	// Get available Hetzner IPs
+	hetznerIps, err := p.findHCloudFloatingIps(fip, inv)
+	if err != nil {
+		return err
+	}
 
-	// Check which ips needs to be assigned
-	for i := range hetznerIps {
-		if hetznerIps[i].Server == nil {
-			p.logger.Infof("%s ip %s is not assigned to any node", p.fip.Name, hetznerIps[i].IP.String())
-			hetznerIpsToAssign = append(hetznerIpsToAssign, hetznerIps[i])
-		} else {
-			var found = false
-			var serverName = "---"
-			var server = hetznerServersByID[hetznerIps[i].Server.ID]
+	var previous = make(map[string]hcloudv1alpha1.IPStatus, len(p.status.IPs))
+	for _, status := range p.status.IPs {
+		previous[status.IP] = status
+	}
+	failback := p.failbackAllowed(fip)
+	ctl := p.controls(fip)
+	drift := p.detectDrift(fip, hetznerIps, previous, inv)
+	observe := observeDrift(fip)
+
+	var hetznerIpsByID = make(map[int]*hcloud.FloatingIP, len(hetznerIps))
+	// Target of each floating ip that is assigned to a node of the pool.
+	var placed = map[int]*target{}
+	// Preferred node of each floating ip that has one.
+	var preferred = map[string]string{}
+	// Node of each floating ip that is on a node of the pool.
+	var current = map[string]string{}
+	var planIPs = make([]planner.IP, len(hetznerIps))
+	for i, hetznerIp := range hetznerIps {
+		ip := hetznerIp.IP.String()
+		hetznerIpsByID[hetznerIp.ID] = hetznerIp
+		planIPs[i] = planner.IP{ID: hetznerIp.ID, Address: ip}
+
+		if node := preferredNode(fip, ip, previous[ip]); node != "" {
+			preferred[ip] = node
+			planIPs[i].Preferred = node
+			planIPs[i].Failback = failback(node)
+		}
+		_, pinned := ctl.pins[ip]
+		if pinned {
+			preferred[ip] = ctl.pins[ip]
+			planIPs[i].Preferred = ctl.pins[ip]
+			planIPs[i].Pinned = true
+		}
+		if req, ok := ctl.moves[ip]; ok {
+			planIPs[i].MoveTo = req.to
+			planIPs[i].MoveAwayFrom = req.awayFrom
+		}
 
-			if server != nil {
-				serverName = server.Name
-			}
+		if hetznerIp.HomeLocation != nil {
+			planIPs[i].HomeLocation = hetznerIp.HomeLocation.Name
+		}
+		if until, ok := p.backoffUntil(ip); ok {
+			p.logger.Infof("%s ip %s is backing off until %s", fip.Name, ip, until.Format(time.RFC3339))
+			planIPs[i].Hold = true
+		}
+		if _, ok := drift[ip]; ok && observe {
+			p.logger.Infof("%s ip %s drifted, leaving it alone", fip.Name, ip)
+			planIPs[i].Hold = true
+		}
 
-			for j := range targets {
-				if targets[j].Name == serverName {
-					found = true
-				}
-			}
-			if found {
-				assignedServers = append(assignedServers, serverName)
-				assignments[serverName] = append(assignments[serverName], hetznerIps[i])
-			} else {
-				p.logger.Infof("%s ip %s is assigned to unknown node", p.fip.Name, hetznerIps[i].IP.String())
-				hetznerIpsToAssign = append(hetznerIpsToAssign, hetznerIps[i])
+		if hetznerIp.Server == nil {
+			p.logger.Infof("%s ip %s is not assigned to any node", fip.Name, ip)
+			continue
+		}
+		planIPs[i].ServerID = hetznerIp.Server.ID
+		if t, ok := targetsByServerID[hetznerIp.Server.ID]; ok {
+			placed[hetznerIp.ID] = t
+			current[ip] = t.node.Name
+			if t.keepsOnly() {
+				planIPs[i].Hold = true
+			} else if until, ok := p.holdUntil(fip, previous[ip]); ok && !pinned {
+				p.logger.Infof("%s ip %s moved recently, holding it on node %s until %s", fip.Name, ip, t.node.Name, until.Format(time.RFC3339))
+				planIPs[i].Hold = true
 			}
+		} else {
+			p.logger.Infof("%s ip %s is assigned to unknown node", fip.Name, ip)
 		}
 	}
 
-	if (len(hetznerIps)-len(hetznerIpsToAssign)) >= len(targets) &&
-		len(assignments) < len(targets) &&
-		len(assignments) < (len(hetznerIps)-len(hetznerIpsToAssign)) {
-		i := 0
-		j := 0
-		nbIpsToReassign := ((len(hetznerIps) - len(hetznerIpsToAssign)) - len(assignments))
-
-		p.logger.Infof("%s ips are not equally spread over possible targets", p.fip.Name)
-
-		for i < nbIpsToReassign && j < 100 { // prevent endless loop
-			for k, v := range assignments {
-				if len(v) > 1 {
-					ip, v := v[0], v[1:]
-					assignments[k] = v
-					hetznerIpsToAssign = append(hetznerIpsToAssign, ip)
-					p.logger.Infof("%s ip %s will be reassigned", p.fip.Name, ip.IP.String())
-					i++
-				}
-				if i >= nbIpsToReassign {
-					break
-				}
-			}
-			j++
+	policy := planner.Policy{
+		Rebalance:          true,
+		PreferHomeLocation: fip.Spec.PreferHomeLocation,
+		Candidates:         MaxAssignAttempts,
+	}
+	// Rebalancing and failing back are not essential, they are skipped while
+	// the hcloud api is unhealthy to keep the remaining calls for failovers.
+	if p.guard.Degraded() {
+		p.logger.Warningf("%s hcloud api circuit is %s, skipping rebalancing and failbacks", fip.Name, p.guard.CircuitState())
+		policy.Rebalance = false
+		for i := range planIPs {
+			planIPs[i].Failback = false
 		}
 	}
 
-	unassignedServers := p.difference(targetNames, assignedServers)
+	moves := planner.Plan(planNodes, planIPs, policy, p.rand)
+	moves = p.limitVoluntaryMoves(fip, moves, len(hetznerIps)-len(placed))
+	// A pool in dry run makes no moves, a paused pool only the requested
+	// ones.
+	dryRun := p.cfg.DryRun || fip.Spec.DryRun
+	var pending []planner.Move
+	switch {
+	case dryRun:
+		moves, pending = nil, moves
+	case ctl.paused:
+		moves, pending = pausedMoves(moves)
+	}
+	pendingMoves := p.reportPendingMoves(fip, pending, dryRun)
 
-	for i := range hetznerIpsToAssign {
-		var nodeName string
+	// Every ip is handled on its own, a failing ip doesn't stop the others.
+	var jobs []*assignJob
+	for _, move := range moves {
+		jobs = append(jobs, &assignJob{fip: hetznerIpsByID[move.IP.ID], move: move})
+	}
 
-		// first use any servers with no ip assigned yet
-		if len(unassignedServers) > 0 {
-			nodeName, unassignedServers = unassignedServers[0], unassignedServers[1:]
-		} else {
-			nodeName = targetNames[i%len(targetNames)]
-		}
+	// The plan is reported before anything is changed.
+	p.logPlan(fip, jobs)
 
-		server := hetznerServersByName[nodeName]
+	p.runAssignJobs(fip.Name, jobs, targetsByName)
 
-		_, _, err = p.hcloudCli.FloatingIP.Assign(context.TODO(), hetznerIpsToAssign[i], server)
-		if err != nil {
-			return err
+	var errs []error
+	// Requested moves wait for the dry run to end.
+	if !dryRun {
+		if err := p.acknowledgeMoves(fip, ctl, jobs, current, targetsByName); err != nil {
+			errs = append(errs, err)
 		}
-
-		p.logger.Infof("%s ip %s assigned to node %s", p.fip.Name, hetznerIpsToAssign[i].IP.String(), nodeName)
 	}
+	for _, job := range jobs {
+		ip := job.fip.IP.String()
+
+		if job.err != nil {
+			until := p.ipFailed(ip, job.err)
+			p.logger.Errorf("%s ip %s could not be assigned, retrying after %s: %s", fip.Name, ip, until.Format(time.RFC3339), job.err)
+			errs = append(errs, hcloudapi.Wrap(job.err, "ip "+ip))
+			continue
+		}
 
-	return nil
-}
-
-// Gets all the pods filtered that can be a target of termination.
-func (p *IPAssigner) getProbableNodes() (*corev1.NodeList, error) {
-	set := labels.Set(p.fip.Spec.NodeSelector)
-	slc := set.AsSelector()
-	opts := metav1.ListOptions{
-		LabelSelector: slc.String(),
+		p.ipSucceeded(ip)
+		p.assigned[ip] = hcloudv1alpha1.IPStatus{
+			IP:                 ip,
+			Node:               job.target.node.Name,
+			ServerID:           job.target.server.ID,
+			LastTransitionTime: metav1.NewTime(p.time.Now()),
+		}
+		if voluntary(job.move) {
+			p.voluntaryMoves++
+		}
+		placed[job.fip.ID] = job.target
+		// The operator placed the ip, it is no longer drifted.
+		delete(drift, ip)
+		// A requested move changes the preferred node, unless the spec or a
+		// pin decides it.
+		if _, ok := fip.Spec.PreferredNodes[ip]; job.move.Reason == planner.ReasonRequested && !ok && ctl.pins[ip] == "" {
+			preferred[ip] = job.target.node.Name
+		}
+		p.logger.Infof("%s ip %s assigned to node %s", fip.Name, ip, job.target.node.Name)
 	}
-	return p.k8sCli.CoreV1().Nodes().List(opts)
-}
 
-// getRandomNodes will shuffle the list of available nodes.
-func (p *IPAssigner) getRandomNodes(nodes *corev1.NodeList) ([]corev1.Node, []string) {
-	items := nodes.Items
-	nodeNames := make([]string, len(items))
-
-	r := rand.New(rand.NewSource(time.Now().Unix()))
-	// We start at the end of the items, inserting our random
-	// values one at a time.
-	for n := len(items); n > 0; n-- {
-		randIndex := r.Intn(n)
-		// We swap the value at index n-1 and the random index
-		// to move our randomly chosen value to the end of the
-		// items, and to move the value that was at n-1 into our
-		// unshuffled portion of the items.
-		items[n-1], items[randIndex] = items[randIndex], items[n-1]
+	p.metrics.SetPoolIPs(fip.Name, len(placed), len(hetznerIps)-len(placed))
+	status := p.buildStatus(hetznerIps, placed, targets, preferred)
+	status.Paused, status.DryRun, status.PendingMoves = ctl.paused, dryRun, pendingMoves
+	// Only observed drift lasts, enforced drift is corrected right away.
+	if observe {
+		status.Drift = driftList(hetznerIps, drift)
 	}
-
-	for i := range items {
-		nodeNames[i] = items[i].Name
+	p.metrics.SetDriftedIPs(fip.Name, len(status.Drift))
+	if err := p.updateStatus(fip.Name, status); err != nil {
+		errs = append(errs, err)
+	} else {
+		// The assignments are in the status now.
+		p.assigned = map[string]hcloudv1alpha1.IPStatus{}
 	}
 
-	return items, nodeNames
+	return utilerrors.NewAggregate(errs)
 }
 
-// findHCloudFloatingIP will return a hcloud FloatingIP resource that matches
-// the ip specified in the FloatingIP CRD resource
-func (p *IPAssigner) findHCloudFloatingIps() ([]*hcloud.FloatingIP, error) {
-	ips := make([]net.IP, len(p.fip.Spec.Ips))
+// assignJob is the assignment of a single floating ip to the best of the
+// given nodes.
+type assignJob struct {
+	fip  *hcloud.FloatingIP
+	move planner.Move
 
-	for i := range p.fip.Spec.Ips {
-		ips[i] = net.ParseIP(p.fip.Spec.Ips[i])
-		if ips[i] == nil {
-			return nil, fmt.Errorf("error parsing ip from spec: %s", p.fip.Spec.Ips[i])
-		}
-	}
+	target *target
+	err    error
+}
 
-	fips, err := p.hcloudCli.FloatingIP.All(context.TODO())
-	if err != nil {
-		return nil, err
+// runAssignJobs runs the assign jobs in parallel, at most AssignConcurrency
+// at a time, and waits for all of them to finish.
+func (p *IPAssigner) runAssignJobs(pool string, jobs []*assignJob, targets map[string]*target) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, p.cfg.AssignConcurrency)
+
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job *assignJob) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			job.target, job.err = p.assignToBestNode(pool, job.fip, job.move, targets)
+		}(job)
 	}
 
-	hetznerIps := make([]*hcloud.FloatingIP, len(ips))
+	wg.Wait()
+}
 
-	for i := range fips {
-		for j := range ips {
-			if fips[i].IP.Equal(ips[j]) {
-				hetznerIps[j] = fips[i]
-			}
+// assignToBestNode tries to assign the floating ip to the nodes of the move
+// in order, at most MaxAssignAttempts nodes are tried. It returns the target
+// the floating ip got assigned to.
+func (p *IPAssigner) assignToBestNode(pool string, fip *hcloud.FloatingIP, move planner.Move, targets map[string]*target) (*target, error) {
+	var errs []error
+	for i, nodeName := range move.Nodes {
+		if i >= MaxAssignAttempts {
+			break
 		}
-	}
 
-	for i := range hetznerIps {
-		if hetznerIps[i] == nil {
-			return nil, fmt.Errorf("ip %s does not match any floating ip resource", ips[i].String())
+		t := targets[nodeName]
+
+		start := p.time.Now()
+		err := p.assignIP(context.TODO(), fip, t.server, priority(move))
+		p.metrics.ObserveAssignment(pool, err, p.time.Now().Sub(start))
+		if err == nil {
+			return t, nil
 		}
+
+		p.logger.Warningf("%s ip %s could not be assigned to node %s: %s", pool, fip.IP.String(), nodeName, err)
+		errs = append(errs, hcloudapi.Wrap(err, "node "+nodeName))
 	}
 
-	return hetznerIps, nil
+	return nil, utilerrors.NewAggregate(errs)
 }
 
-func (p *IPAssigner) findServer(nodeName string) (*hcloud.Server, error) {
-	server, _, err := p.hcloudCli.Server.GetByName(context.TODO(), nodeName)
-
-	return server, err
+// Gets all the pods filtered that can be a target of termination.
+func (p *IPAssigner) getProbableNodes(fip *hcloudv1alpha1.FloatingIPPool) (*corev1.NodeList, error) {
+	set := labels.Set(fip.Spec.NodeSelector)
+	slc := set.AsSelector()
+	opts := metav1.ListOptions{
+		LabelSelector: slc.String(),
+	}
+	return p.k8sCli.CoreV1().Nodes().List(opts)
 }
 
-func (p *IPAssigner) findServers() ([]*hcloud.Server, error) {
-	servers, err := p.hcloudCli.Server.All(context.TODO())
-
-	return servers, err
-}
+// findHCloudFloatingIps will return the hcloud FloatingIP resources that
+// match the ips specified in the FloatingIPPool CRD resource
+func (p *IPAssigner) findHCloudFloatingIps(fip *hcloudv1alpha1.FloatingIPPool, inv *inventory.Snapshot) ([]*hcloud.FloatingIP, error) {
+	hetznerIps := make([]*hcloud.FloatingIP, len(fip.Spec.Ips))
 
-func (p *IPAssigner) difference(slice1 []string, slice2 []string) []string {
-	var diff []string
-
-	// Loop two times, first to find slice1 strings not in slice2,
-	// second loop to find slice2 strings not in slice1
-	for i := 0; i < 2; i++ {
-		for _, s1 := range slice1 {
-			found := false
-			for _, s2 := range slice2 {
-				if s1 == s2 {
-					found = true
-					break
-				}
-			}
-			// String not found. We add it to return slice
-			if !found {
-				diff = append(diff, s1)
-			}
+	for i := range fip.Spec.Ips {
+		ip := net.ParseIP(fip.Spec.Ips[i])
+		if ip == nil {
+			return nil, fmt.Errorf("error parsing ip from spec: %s", fip.Spec.Ips[i])
 		}
-		// Swap the slices, only if it was the first loop
-		if i == 0 {
-			slice1, slice2 = slice2, slice1
+
+		hetznerIps[i] = inv.FloatingIPByIP(ip)
+		if hetznerIps[i] == nil {
+			return nil, fmt.Errorf("ip %s does not match any floating ip resource", ip.String())
 		}
 	}
 
-	return diff
+	return hetznerIps, nil
 }
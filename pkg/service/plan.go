@@ -0,0 +1,87 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/planner"
+)
+
+// Event reasons.
+const (
+	// ReasonAssignPlan is the reason of the event on a pool with the moves
+	// a reconcile is about to make.
+	ReasonAssignPlan = "AssignPlan"
+)
+
+// logPlan logs the planned moves and reports them as an event on the pool
+// and in the metrics before they are executed.
+func (p *IPAssigner) logPlan(fip *hcloudv1alpha1.FloatingIPPool, jobs []*assignJob) {
+	if len(jobs) == 0 {
+		return
+	}
+
+	var failovers, failbacks, rebalances, manual int
+	var steps []string
+	for _, job := range jobs {
+		switch job.move.Reason {
+		case planner.ReasonRebalance:
+			rebalances++
+		case planner.ReasonFailback:
+			failbacks++
+		case planner.ReasonPinned, planner.ReasonRequested:
+			manual++
+		default:
+			failovers++
+		}
+
+		steps = append(steps, step(job.move))
+		p.logger.Infof("%s plan: ip %s from %s to %s (%s)", fip.Name, job.move.IP.Address, from(job.move), job.move.To(), job.move.Reason)
+	}
+
+	p.metrics.ObservePlan(fip.Name, failovers, failbacks, rebalances, manual)
+	p.events.Eventf(fip, corev1.EventTypeNormal, ReasonAssignPlan, "%d failovers, %d failbacks, %d rebalances, %d manual: %s", failovers, failbacks, rebalances, manual, strings.Join(steps, ", "))
+}
+
+// reportPendingMoves logs the moves a paused or dry run pool doesn't make and
+// reports them as an event when they changed since the last reconcile. It
+// returns the pending moves for the status of the pool.
+func (p *IPAssigner) reportPendingMoves(fip *hcloudv1alpha1.FloatingIPPool, moves []planner.Move, dryRun bool) []string {
+	var pending []string
+	for _, move := range moves {
+		pending = append(pending, step(move))
+	}
+	if len(pending) == 0 || reflect.DeepEqual(pending, p.status.PendingMoves) {
+		return pending
+	}
+
+	if dryRun {
+		for _, move := range moves {
+			p.logger.Infof("%s dry run: would assign ip %s from %s to %s (%s)", fip.Name, move.IP.Address, from(move), move.To(), move.Reason)
+		}
+		p.events.Eventf(fip, corev1.EventTypeNormal, ReasonPendingMoves, "dry run, would make %d moves: %s", len(pending), strings.Join(pending, ", "))
+	} else {
+		p.logger.Infof("%s is paused, not making %d moves: %s", fip.Name, len(pending), strings.Join(pending, ", "))
+		p.events.Eventf(fip, corev1.EventTypeNormal, ReasonPendingMoves, "paused, not making %d moves: %s", len(pending), strings.Join(pending, ", "))
+	}
+	return pending
+}
+
+// step returns the move as `ip from->to`, from is `-` when the ip is not on an
+// eligible node.
+func step(move planner.Move) string {
+	return fmt.Sprintf("%s %s->%s", move.IP.Address, from(move), move.To())
+}
+
+// from returns the node the ip of the move is on, `-` when it is not on an
+// eligible node.
+func from(move planner.Move) string {
+	if move.From == "" {
+		return "-"
+	}
+	return move.From
+}
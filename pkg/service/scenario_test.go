@@ -0,0 +1,1390 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	kooperlog "github.com/spotahome/kooper/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8sfake "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned/fake"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudtest"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/inventory"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+)
+
+// fakeTime is a clock that only moves when the scenario moves it, After fires
+// right away so polling doesn't slow the scenarios down.
+type fakeTime struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (f *fakeTime) After(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	c <- f.Now().Add(d)
+	return c
+}
+
+func (f *fakeTime) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeTime) set(now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = now
+}
+
+// testNode is a node of a scenario and its hcloud server.
+type testNode struct {
+	name     string
+	location string
+	labels   map[string]string
+	// serverLabels are the labels of the hcloud server.
+	serverLabels map[string]string
+	// noServer leaves the node without an hcloud server.
+	noServer bool
+	// privateIP matches the node to its server by ip only: the node has no
+	// provider id and the server another name.
+	privateIP string
+	// placementGroup is the placement group of the hcloud server.
+	placementGroup string
+}
+
+// testIP is a floating ip of a scenario.
+type testIP struct {
+	ip   string
+	home string
+	// on is the node the ip is assigned to at the start.
+	on string
+}
+
+// event is something that happens at a point of the timeline of a scenario,
+// do is run before and expect after the reconcile at that time.
+type event struct {
+	at     time.Duration
+	do     func(e *env)
+	expect func(t *testing.T, e *env)
+}
+
+type scenario struct {
+	name     string
+	spec     hcloudv1alpha1.FloatinIPPoolSpec
+	nodes    []testNode
+	ips      []testIP
+	timeline []event
+}
+
+// env is the world a scenario runs in.
+type env struct {
+	api      *hcloudtest.API
+	k8sCli   *kubefake.Clientset
+	fipCli   *floatingipk8sfake.Clientset
+	recorder *record.FakeRecorder
+	clock    *fakeTime
+	ipa      *IPAssigner
+	// servers are the server ids by node name, ips the floating ip ids by
+	// ip.
+	servers map[string]int
+	ips     map[string]int
+	// err is the error of the last reconcile, events all the events so far.
+	err    error
+	events []string
+	// saved is for scenarios to remember the nodes of ips.
+	saved map[string]string
+}
+
+const scenarioPool = "pool"
+
+func newEnv(s scenario) *env {
+	e := &env{
+		api:      hcloudtest.NewAPI(),
+		k8sCli:   kubefake.NewSimpleClientset(),
+		recorder: record.NewFakeRecorder(1000),
+		clock:    &fakeTime{now: time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)},
+		servers:  map[string]int{},
+		ips:      map[string]int{},
+	}
+
+	for _, n := range s.nodes {
+		e.addNode(n)
+	}
+
+	spec := *s.spec.DeepCopy()
+	for _, ip := range s.ips {
+		e.ips[ip.ip] = e.api.AddFloatingIP(hcloudtest.FloatingIP{IP: ip.ip, HomeLocation: ip.home, ServerID: e.servers[ip.on]})
+		spec.Ips = append(spec.Ips, ip.ip)
+	}
+
+	pool := &hcloudv1alpha1.FloatingIPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: scenarioPool},
+		Spec:       spec,
+	}
+	e.fipCli = floatingipk8sfake.NewSimpleClientset(pool)
+	e.start(pool)
+
+	return e
+}
+
+// start starts a new ip assigner for the pool, as the operator does on
+// startup.
+func (e *env) start(pool *hcloudv1alpha1.FloatingIPPool) {
+	guard := hcloudapi.NewGuard(hcloudapi.NewLimiter(1000, 1000), hcloudapi.NewBreaker(5, time.Minute))
+	hcloudCli := e.api.Client()
+	cfg := Config{ActionTimeout: 5 * time.Second, AssignConcurrency: 2, MaxRetryDelay: time.Minute}
+	e.ipa = NewCustomIPAssigner(cfg, pool, e.k8sCli, e.fipCli, hcloudCli, guard, inventory.New(hcloudCli, guard, 0), metrics.Dummy, e.recorder, e.clock, kooperlog.Dummy)
+}
+
+// restart replaces the ip assigner with a new one for the pool as stored in
+// the cluster, as if the operator restarted.
+func restart(e *env) {
+	pool, err := e.fipCli.HcloudV1alpha1().FloatingIPPools().Get(scenarioPool, metav1.GetOptions{})
+	if err != nil {
+		panic(err)
+	}
+	e.start(pool)
+}
+
+func unassign(ips ...string) func(e *env) {
+	return func(e *env) {
+		for _, ip := range ips {
+			e.api.AssignFloatingIP(e.ips[ip], 0)
+		}
+	}
+}
+
+// addNode adds a ready node and, unless it has none, its running server.
+func (e *env) addNode(n testNode) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: n.name, Labels: n.labels},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+
+	if !n.noServer {
+		location := n.location
+		if location == "" {
+			location = "fsn1"
+		}
+		server := hcloudtest.Server{
+			Name:           n.name,
+			Location:       location,
+			Datacenter:     location + "-dc1",
+			Labels:         n.serverLabels,
+			PlacementGroup: n.placementGroup,
+		}
+		if n.privateIP != "" {
+			server.Name = "server-" + n.name
+			server.PrivateIPs = []string{n.privateIP}
+		}
+		id := e.api.AddServer(server)
+		e.servers[n.name] = id
+		if n.privateIP != "" {
+			node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: n.privateIP}}
+		} else {
+			node.Spec.ProviderID = providerIDPrefix + strconv.Itoa(id)
+		}
+	}
+
+	if _, err := e.k8sCli.CoreV1().Nodes().Create(node); err != nil {
+		panic(err)
+	}
+}
+
+// nodeOf returns the node the ip is assigned to, empty when it is not
+// assigned to a node of the scenario.
+func (e *env) nodeOf(ip string) string {
+	serverID := e.api.Assignments()[ip]
+	for name, id := range e.servers {
+		if id == serverID {
+			return name
+		}
+	}
+	return ""
+}
+
+// counts returns the number of ips on every node of the scenario.
+func (e *env) counts() map[string]int {
+	counts := map[string]int{}
+	for ip := range e.api.Assignments() {
+		if node := e.nodeOf(ip); node != "" {
+			counts[node]++
+		}
+	}
+	return counts
+}
+
+// status returns the status of the pool as written to the cluster.
+func (e *env) status(t *testing.T) hcloudv1alpha1.FloatingIPPoolStatus {
+	pool, err := e.fipCli.HcloudV1alpha1().FloatingIPPools().Get(scenarioPool, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool.Status
+}
+
+// drainEvents moves the recorded events to events.
+func (e *env) drainEvents() {
+	for {
+		select {
+		case ev := <-e.recorder.Events:
+			e.events = append(e.events, ev)
+		default:
+			return
+		}
+	}
+}
+
+// annotate sets or, when empty, removes an annotation of the pool and hands
+// the pool to the ip assigner, as the operator does when the pool changes.
+func annotate(key, value string) func(e *env) {
+	return func(e *env) {
+		pool, err := e.fipCli.HcloudV1alpha1().FloatingIPPools().Get(scenarioPool, metav1.GetOptions{})
+		if err != nil {
+			panic(err)
+		}
+		if pool.Annotations == nil {
+			pool.Annotations = map[string]string{}
+		}
+		if value == "" {
+			delete(pool.Annotations, key)
+		} else {
+			pool.Annotations[key] = value
+		}
+		if pool, err = e.fipCli.HcloudV1alpha1().FloatingIPPools().Update(pool); err != nil {
+			panic(err)
+		}
+		e.ipa.Update(pool)
+	}
+}
+
+// setIPs replaces the ips of the pool and hands the pool to the ip assigner.
+func setIPs(ips ...string) func(e *env) {
+	return func(e *env) {
+		pool, err := e.fipCli.HcloudV1alpha1().FloatingIPPools().Get(scenarioPool, metav1.GetOptions{})
+		if err != nil {
+			panic(err)
+		}
+		pool.Spec.Ips = ips
+		if pool, err = e.fipCli.HcloudV1alpha1().FloatingIPPools().Update(pool); err != nil {
+			panic(err)
+		}
+		e.ipa.Update(pool)
+	}
+}
+
+func setNodeReady(name string, ready bool) func(e *env) {
+	return func(e *env) {
+		node, err := e.k8sCli.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+		if err != nil {
+			panic(err)
+		}
+		status := corev1.ConditionTrue
+		if !ready {
+			status = corev1.ConditionFalse
+		}
+		node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}
+		if _, err := e.k8sCli.CoreV1().Nodes().Update(node); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// failStatusWrites fails the next n updates of the pool.
+func failStatusWrites(n int) func(e *env) {
+	return func(e *env) {
+		e.fipCli.PrependReactor("update", "floatingippools", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if n <= 0 {
+				return false, nil, nil
+			}
+			n--
+			return true, nil, fmt.Errorf("status write failed")
+		})
+	}
+}
+
+func drainNode(name string) func(e *env) {
+	return func(e *env) {
+		node, err := e.k8sCli.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+		if err != nil {
+			panic(err)
+		}
+		node.Annotations = map[string]string{hcloudv1alpha1.DrainAnnotation: "true"}
+		if _, err := e.k8sCli.CoreV1().Nodes().Update(node); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// addServer adds a server that is not a node of the cluster.
+func addServer(name string) func(e *env) {
+	return func(e *env) {
+		e.servers[name] = e.api.AddServer(hcloudtest.Server{Name: name, Location: "fsn1", Datacenter: "fsn1-dc1"})
+	}
+}
+
+// consoleAssign assigns the ip to the server of the node, or unassigns it
+// when the node is empty, through the hcloud api as someone using the hcloud
+// console would.
+func consoleAssign(ip, node string) func(e *env) {
+	return func(e *env) {
+		fip := &hcloud.FloatingIP{ID: e.ips[ip]}
+		var err error
+		if node == "" {
+			_, _, err = e.api.Client().FloatingIP.Unassign(context.Background(), fip)
+		} else {
+			_, _, err = e.api.Client().FloatingIP.Assign(context.Background(), fip, &hcloud.Server{ID: e.servers[node]})
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func updateServer(name string, f func(s *hcloudtest.Server)) func(e *env) {
+	return func(e *env) {
+		e.api.UpdateServer(e.servers[name], f)
+	}
+}
+
+func deleteServer(name string) func(e *env) {
+	return func(e *env) {
+		e.api.DeleteServer(e.servers[name])
+		delete(e.servers, name)
+	}
+}
+
+func addNode(n testNode) func(e *env) {
+	return func(e *env) {
+		e.addNode(n)
+	}
+}
+
+func expectOn(ip, node string) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		if got := e.nodeOf(ip); got != node {
+			t.Errorf("expected ip %s on node %s, got %q", ip, node, got)
+		}
+	}
+}
+
+func expectNothingOn(node string) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		if n := e.counts()[node]; n != 0 {
+			t.Errorf("expected no ips on node %s, got %d", node, n)
+		}
+	}
+}
+
+// expectCounts checks the number of ips per node, regardless of which node
+// holds which number.
+func expectCounts(counts ...int) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		var got []int
+		for _, n := range e.counts() {
+			got = append(got, n)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(got)))
+		if fmt.Sprint(got) != fmt.Sprint(counts) {
+			t.Errorf("expected %v ips per node, got %v (%v)", counts, got, e.counts())
+		}
+	}
+}
+
+func expectNoError() func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		if e.err != nil {
+			t.Errorf("expected no error, got %s", e.err)
+		}
+	}
+}
+
+func expectError(substr string) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		if e.err == nil || !strings.Contains(e.err.Error(), substr) {
+			t.Errorf("expected an error containing %q, got %v", substr, e.err)
+		}
+	}
+}
+
+// expectNoAnnotation checks the annotation was removed from the pool.
+func expectNoAnnotation(key string) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		pool, err := e.fipCli.HcloudV1alpha1().FloatingIPPools().Get(scenarioPool, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, ok := pool.Annotations[key]; ok {
+			t.Errorf("expected annotation %s to be removed, got %q", key, value)
+		}
+	}
+}
+
+// expectEvent checks an event containing all the given parts was recorded.
+func expectEvent(parts ...string) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+	events:
+		for _, ev := range e.events {
+			for _, part := range parts {
+				if !strings.Contains(ev, part) {
+					continue events
+				}
+			}
+			return
+		}
+		t.Errorf("expected an event with %q, got %v", parts, e.events)
+	}
+}
+
+// expectEvents expects n events with all the parts so far.
+func expectEvents(n int, parts ...string) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		var found int
+	events:
+		for _, ev := range e.events {
+			for _, part := range parts {
+				if !strings.Contains(ev, part) {
+					continue events
+				}
+			}
+			found++
+		}
+		if found != n {
+			t.Errorf("expected %d events with %q, got %v", n, parts, e.events)
+		}
+	}
+}
+
+func expectStatus(f func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus)) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		f(t, e.status(t))
+	}
+}
+
+// all runs all the expectations.
+func all(expects ...func(t *testing.T, e *env)) func(t *testing.T, e *env) {
+	return func(t *testing.T, e *env) {
+		for _, expect := range expects {
+			expect(t, e)
+		}
+	}
+}
+
+func threeNodes() []testNode {
+	return []testNode{{name: "node-1"}, {name: "node-2"}, {name: "node-3"}}
+}
+
+func fourIPsOn(node string) []testIP {
+	return []testIP{{ip: "10.0.0.1", on: node}, {ip: "10.0.0.2", on: node}, {ip: "10.0.0.3", on: node}, {ip: "10.0.0.4", on: node}}
+}
+
+func intOrString(s string) *intstr.IntOrString {
+	v := intstr.Parse(s)
+	return &v
+}
+
+var scenarios = []scenario{
+	{
+		name:  "unassigned ips are spread over the nodes",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}, {ip: "10.0.0.3"}},
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectCounts(1, 1, 1), expectEvent(ReasonAssignPlan, "3 failovers, 0 failbacks, 0 rebalances"))},
+			{at: 0, expect: expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+				if len(status.IPs) != 3 {
+					t.Fatalf("expected the status of 3 ips, got %v", status.IPs)
+				}
+				for _, ip := range status.IPs {
+					if ip.Node == "" || ip.ServerID == 0 {
+						t.Errorf("expected ip %s on a node, got %+v", ip.IP, ip)
+					}
+				}
+			})},
+		},
+	},
+	{
+		name:  "nodes are matched to their servers by private ip",
+		nodes: []testNode{{name: "node-1", privateIP: "192.168.0.1"}, {name: "node-2", privateIP: "192.168.0.2"}},
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}},
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectCounts(1, 1))},
+		},
+	},
+	{
+		name:  "ips stay on their nodes",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}, {ip: "10.0.0.3", on: "node-3"}},
+		timeline: []event{
+			{at: 30 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.1", "node-1"),
+				expectOn("10.0.0.2", "node-2"),
+				expectOn("10.0.0.3", "node-3"),
+			)},
+			{at: 30 * time.Second, expect: func(t *testing.T, e *env) {
+				if n := e.api.Requests("POST /floating_ips/{id}/actions/assign"); n != 0 {
+					t.Errorf("expected no assignments, got %d", n)
+				}
+			}},
+		},
+	},
+	{
+		name:  "ips fail over from a node that is not ready",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}, {ip: "10.0.0.3", on: "node-2"}},
+		timeline: []event{
+			{at: 0, expect: all(expectCounts(1, 1, 1), expectOn("10.0.0.1", "node-1"))},
+			{at: 30 * time.Second, do: setNodeReady("node-2", false)},
+			{at: 35 * time.Second, expect: all(expectNoError(), expectNothingOn("node-2"), expectCounts(2, 1))},
+			{at: 60 * time.Second, do: setNodeReady("node-2", true)},
+			{at: 65 * time.Second, expect: all(expectCounts(1, 1, 1), expectEvent("1 failovers, 0 failbacks, 0 rebalances"), expectEvent("0 failovers, 0 failbacks, 1 rebalances"))},
+		},
+	},
+	{
+		name:  "ips fail over from a server that is powered off",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: updateServer("node-2", func(s *hcloudtest.Server) { s.Status = string(hcloud.ServerStatusOff) })},
+			{at: 15 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"), expectOn("10.0.0.2", "node-3"))},
+		},
+	},
+	{
+		name:  "ips fail over from a deleted server",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: deleteServer("node-2")},
+			{at: 15 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.1", "node-1"),
+				expectOn("10.0.0.2", "node-3"),
+				expectEvent(corev1.EventTypeWarning, ReasonServerNotFound),
+			)},
+		},
+	},
+	{
+		name:  "ips move to a new node",
+		nodes: []testNode{{name: "node-1"}, {name: "node-2"}},
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}, {ip: "10.0.0.3"}, {ip: "10.0.0.4"}},
+		timeline: []event{
+			{at: 0, expect: expectCounts(2, 2)},
+			{at: 30 * time.Second, do: addNode(testNode{name: "node-3"})},
+			{at: 35 * time.Second, expect: all(expectNoError(), expectCounts(2, 1, 1), expectEvent("0 failovers, 0 failbacks, 1 rebalances", "->node-3"))},
+		},
+	},
+	{
+		name: "only nodes whose server matches the server selector get ips",
+		spec: hcloudv1alpha1.FloatinIPPoolSpec{ServerSelector: map[string]string{"ingress": "true"}},
+		nodes: []testNode{
+			{name: "node-1", serverLabels: map[string]string{"ingress": "true"}},
+			{name: "node-2"},
+			{name: "node-3", serverLabels: map[string]string{"ingress": "true"}},
+		},
+		ips: []testIP{{ip: "10.0.0.1", on: "node-2"}, {ip: "10.0.0.2"}},
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectNothingOn("node-2"), expectCounts(1, 1))},
+		},
+	},
+	{
+		name: "only nodes matching the node selector get ips",
+		spec: hcloudv1alpha1.FloatinIPPoolSpec{NodeSelector: map[string]string{"role": "ingress"}},
+		nodes: []testNode{
+			{name: "node-1", labels: map[string]string{"role": "ingress"}},
+			{name: "node-2", labels: map[string]string{"role": "worker"}},
+		},
+		ips: []testIP{{ip: "10.0.0.1", on: "node-2"}, {ip: "10.0.0.2"}},
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectCounts(2), expectOn("10.0.0.1", "node-1"))},
+		},
+	},
+	{
+		name: "nodes without a server are reported",
+		nodes: []testNode{
+			{name: "node-1"},
+			{name: "node-2", noServer: true},
+		},
+		ips: []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}},
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectCounts(2), expectEvent(corev1.EventTypeWarning, ReasonServerNotFound, "no hcloud server named node-2"))},
+			// The node is only reported again when the reason changes.
+			{at: 30 * time.Second, expect: expectEvents(1, ReasonServerNotFound)},
+			{at: 35 * time.Second, do: addServer("node-2")},
+			{at: 40 * time.Second, do: deleteServer("node-2")},
+			{at: 45 * time.Second, expect: expectEvents(2, ReasonServerNotFound)},
+		},
+	},
+	{
+		name:  "ips in one placement group are spread over the placement groups",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{TopologyKey: hcloudv1alpha1.TopologyPlacementGroup},
+		nodes: []testNode{{name: "node-1", placementGroup: "a"}, {name: "node-2", placementGroup: "a"}, {name: "node-3", placementGroup: "b"}, {name: "node-4", placementGroup: "b"}},
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 0, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.1", "node-1"),
+				func(t *testing.T, e *env) {
+					if b := e.counts()["node-3"] + e.counts()["node-4"]; b != 1 {
+						t.Errorf("expected an ip in every placement group, got %v", e.counts())
+					}
+				},
+			)},
+		},
+	},
+	{
+		name:  "ips are spread over the topology domains",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{TopologyKey: hcloudv1alpha1.TopologyLocation},
+		nodes: []testNode{{name: "node-1", location: "fsn1"}, {name: "node-2", location: "fsn1"}, {name: "node-3", location: "nbg1"}, {name: "node-4", location: "nbg1"}},
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}},
+		timeline: []event{
+			{at: 0, expect: func(t *testing.T, e *env) {
+				fsn1 := e.counts()["node-1"] + e.counts()["node-2"]
+				nbg1 := e.counts()["node-3"] + e.counts()["node-4"]
+				if fsn1 != 1 || nbg1 != 1 {
+					t.Errorf("expected an ip in every location, got %v", e.counts())
+				}
+			}},
+		},
+	},
+	{
+		name:  "ips prefer their home location",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{PreferHomeLocation: true},
+		nodes: []testNode{{name: "node-1", location: "fsn1"}, {name: "node-2", location: "nbg1"}, {name: "node-3", location: "hel1"}},
+		ips:   []testIP{{ip: "10.0.0.1", home: "nbg1"}, {ip: "10.0.0.2", home: "hel1"}},
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectOn("10.0.0.1", "node-2"), expectOn("10.0.0.2", "node-3"))},
+		},
+	},
+	{
+		name:  "failed assignments back off",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1"}},
+		timeline: []event{
+			{at: 0, do: func(e *env) {
+				e.api.AddActionFault(hcloudtest.ActionFault{Command: "assign_floating_ip", Code: "server_error", Message: "boom"})
+			}},
+			{at: 0, expect: all(
+				expectError("boom"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if ip := status.IPs[0]; ip.Failures != 1 || !strings.Contains(ip.LastError, "boom") {
+						t.Errorf("expected a failure in the status, got %+v", ip)
+					}
+				}),
+			)},
+			{at: 5 * time.Second, expect: expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+				if ip := status.IPs[0]; ip.Failures != 2 {
+					t.Errorf("expected a second failure in the status, got %+v", ip)
+				}
+			})},
+			// The second failure backs off for 10s.
+			{at: 10 * time.Second, do: func(e *env) { e.api.ClearFaults() }},
+			{at: 10 * time.Second, expect: all(expectNoError(), expectCounts())},
+			{at: 15 * time.Second, expect: all(
+				expectNoError(),
+				expectCounts(1),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if ip := status.IPs[0]; ip.Failures != 0 || ip.Node == "" {
+						t.Errorf("expected the ip on a node without failures, got %+v", ip)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "the retry state of a removed ip is forgotten",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1"}},
+		timeline: []event{
+			{at: 0, do: func(e *env) {
+				e.api.AddActionFault(hcloudtest.ActionFault{Command: "assign_floating_ip", Code: "server_error", Message: "boom"})
+			}},
+			// The third failure at 15s backs off until 35s.
+			{at: 15 * time.Second, expect: expectError("boom")},
+			{at: 20 * time.Second, do: func(e *env) {
+				e.api.ClearFaults()
+				e.ips["10.0.0.2"] = e.api.AddFloatingIP(hcloudtest.FloatingIP{IP: "10.0.0.2"})
+				setIPs("10.0.0.2")(e)
+			}},
+			{at: 20 * time.Second, expect: all(expectNoError(), expectCounts(1))},
+			{at: 25 * time.Second, do: setIPs("10.0.0.1", "10.0.0.2")},
+			{at: 25 * time.Second, expect: all(
+				expectNoError(),
+				expectCounts(1, 1),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					for _, ip := range status.IPs {
+						if ip.Failures != 0 || ip.LastError != "" {
+							t.Errorf("expected no failures of %s, got %+v", ip.IP, ip)
+						}
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "rebalancing is limited to maxMovesPerInterval",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{MaxMovesPerInterval: 1},
+		nodes: append(threeNodes(), testNode{name: "node-4"}),
+		ips:   fourIPsOn("node-1"),
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectCounts(3, 1))},
+			{at: 5 * time.Second, expect: expectCounts(2, 1, 1)},
+			{at: 10 * time.Second, expect: expectCounts(1, 1, 1, 1)},
+		},
+	},
+	{
+		name:  "failed rebalances don't use up maxMovesPerInterval",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{MaxMovesPerInterval: 1},
+		nodes: append(threeNodes(), testNode{name: "node-4"}),
+		ips:   fourIPsOn("node-1"),
+		timeline: []event{
+			{at: 0, do: func(e *env) {
+				// A requeue right before the scheduled reconcile fails to
+				// move the ip.
+				e.api.AddActionFault(hcloudtest.ActionFault{Command: "assign_floating_ip", Code: "server_error", Message: "boom"})
+				e.ipa.Reconcile()
+				e.api.ClearFaults()
+			}},
+			{at: 0, expect: expectCounts(3, 1)},
+			{at: 5 * time.Second, expect: expectCounts(2, 1, 1)},
+		},
+	},
+	{
+		name:  "rebalancing is limited to maxUnavailable percent",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{MaxUnavailable: intOrString("50%")},
+		nodes: append(threeNodes(), testNode{name: "node-4"}),
+		ips:   fourIPsOn("node-1"),
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectCounts(2, 1, 1))},
+			{at: 5 * time.Second, expect: expectCounts(1, 1, 1, 1)},
+		},
+	},
+	{
+		name:  "failovers are never limited and use up maxUnavailable",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{MaxUnavailable: intOrString("1")},
+		nodes: append(threeNodes(), testNode{name: "node-4"}),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-1"}, {ip: "10.0.0.3", on: "node-1"}, {ip: "10.0.0.4", on: "node-2"}},
+		timeline: []event{
+			{at: 0, do: setNodeReady("node-2", false)},
+			{at: 0, expect: all(expectNoError(), expectCounts(3, 1), expectEvent("1 failovers, 0 failbacks, 0 rebalances"))},
+			{at: 5 * time.Second, expect: all(expectCounts(2, 1, 1), expectEvent("0 failovers, 0 failbacks, 1 rebalances"))},
+		},
+	},
+	{
+		name:  "ips stay on a failing node for failoverAfterSeconds",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{FailoverAfterSeconds: 20},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 30 * time.Second, do: setNodeReady("node-2", false)},
+			{at: 45 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.2", "node-2"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.FailingNodes) != 1 || status.FailingNodes[0].Node != "node-2" {
+						t.Errorf("expected node-2 to be failing, got %v", status.FailingNodes)
+					}
+				}),
+			)},
+			{at: 50 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.2", "node-3"))},
+		},
+	},
+	{
+		name:  "ips stay on a node that blips",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{FailoverAfterSeconds: 20},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 30 * time.Second, do: setNodeReady("node-2", false)},
+			{at: 40 * time.Second, do: setNodeReady("node-2", true)},
+			{at: 60 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.2", "node-2"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.FailingNodes) != 0 {
+						t.Errorf("expected no failing nodes, got %v", status.FailingNodes)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "the failover grace period starts when the node became not ready",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{FailoverAfterSeconds: 20},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 0, do: func(e *env) {
+				node, err := e.k8sCli.CoreV1().Nodes().Get("node-2", metav1.GetOptions{})
+				if err != nil {
+					panic(err)
+				}
+				node.Status.Conditions = []corev1.NodeCondition{{
+					Type:               corev1.NodeReady,
+					Status:             corev1.ConditionFalse,
+					LastTransitionTime: metav1.NewTime(e.clock.Now().Add(-15 * time.Second)),
+				}}
+				if _, err := e.k8sCli.CoreV1().Nodes().Update(node); err != nil {
+					panic(err)
+				}
+			}},
+			{at: 0, expect: all(expectNoError(), expectOn("10.0.0.2", "node-2"))},
+			{at: 5 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.2", "node-3"))},
+		},
+	},
+	{
+		name:  "the failover grace period continues after a restart",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{FailoverAfterSeconds: 20},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 30 * time.Second, do: updateServer("node-2", func(s *hcloudtest.Server) { s.Status = string(hcloud.ServerStatusOff) })},
+			{at: 40 * time.Second, do: restart},
+			{at: 45 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.2", "node-2"))},
+			{at: 50 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.2", "node-3"))},
+		},
+	},
+	{
+		name:  "the pool is reconciled when a failover grace period ends",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{FailoverAfterSeconds: 3},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 0, expect: func(t *testing.T, e *env) {
+				if got := e.ipa.NextReconcile(); got != 5*time.Second {
+					t.Errorf("expected the next reconcile after the interval, got %s", got)
+				}
+			}},
+			{at: 10 * time.Second, do: setNodeReady("node-2", false)},
+			{at: 10 * time.Second, expect: all(
+				expectOn("10.0.0.2", "node-2"),
+				func(t *testing.T, e *env) {
+					if got := e.ipa.NextReconcile(); got != 3*time.Second {
+						t.Errorf("expected the next reconcile when the grace period ends, got %s", got)
+					}
+				},
+			)},
+		},
+	},
+	{
+		name:  "quarantined nodes keep their ips",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{FailoverAfterSeconds: 20, Flapping: &hcloudv1alpha1.FlappingPolicy{Transitions: 2, WindowSeconds: 60}},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: setNodeReady("node-2", false)},
+			{at: 15 * time.Second, do: setNodeReady("node-2", true)},
+			{at: 15 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.2", "node-2"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if fmt.Sprint(status.QuarantinedNodes) != "[node-2]" {
+						t.Errorf("expected node-2 to be quarantined, got %v", status.QuarantinedNodes)
+					}
+				}),
+			)},
+			{at: 30 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.2", "node-2"))},
+		},
+	},
+	{
+		name:  "ips are not rebalanced within minHoldSeconds of a move",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{MinHoldSeconds: 60},
+		nodes: []testNode{{name: "node-1"}, {name: "node-2"}},
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}, {ip: "10.0.0.3"}, {ip: "10.0.0.4"}},
+		timeline: []event{
+			{at: 0, expect: expectCounts(2, 2)},
+			{at: 10 * time.Second, do: addNode(testNode{name: "node-3"})},
+			{at: 55 * time.Second, expect: all(expectNoError(), expectNothingOn("node-3"))},
+			{at: 60 * time.Second, expect: expectCounts(2, 1, 1)},
+		},
+	},
+	{
+		name:  "ips that moved recently still fail over",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{MinHoldSeconds: 60},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}, {ip: "10.0.0.3"}},
+		timeline: []event{
+			{at: 0, expect: expectCounts(1, 1, 1)},
+			{at: 10 * time.Second, do: setNodeReady("node-1", false)},
+			{at: 10 * time.Second, expect: all(expectNoError(), expectNothingOn("node-1"), expectCounts(2, 1))},
+		},
+	},
+	{
+		name:  "flapping nodes are quarantined",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{Flapping: &hcloudv1alpha1.FlappingPolicy{Transitions: 3, WindowSeconds: 60}},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}, {ip: "10.0.0.3", on: "node-3"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: setNodeReady("node-2", false)},
+			{at: 15 * time.Second, do: setNodeReady("node-2", true)},
+			{at: 15 * time.Second, expect: expectCounts(1, 1, 1)},
+			{at: 20 * time.Second, do: setNodeReady("node-2", false)},
+			{at: 25 * time.Second, do: setNodeReady("node-2", true)},
+			{at: 70 * time.Second, expect: all(
+				expectNoError(),
+				expectNothingOn("node-2"),
+				expectEvent(corev1.EventTypeWarning, ReasonNodeQuarantined),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if fmt.Sprint(status.QuarantinedNodes) != "[node-2]" {
+						t.Errorf("expected node-2 to be quarantined, got %v", status.QuarantinedNodes)
+					}
+				}),
+			)},
+			{at: 75 * time.Second, expect: all(
+				expectCounts(1, 1, 1),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.QuarantinedNodes) != 0 {
+						t.Errorf("expected no quarantined nodes, got %v", status.QuarantinedNodes)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "ips don't fail back by default",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: setNodeReady("node-1", false)},
+			{at: 10 * time.Second, expect: expectOn("10.0.0.1", "node-3")},
+			{at: 20 * time.Second, do: setNodeReady("node-1", true)},
+			{at: 60 * time.Second, expect: all(
+				expectOn("10.0.0.1", "node-3"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if ip := status.IPs[0]; ip.PreferredNode != "node-1" {
+						t.Errorf("expected ip %s to prefer node-1, got %q", ip.IP, ip.PreferredNode)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "ips fail back immediately",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{Failback: &hcloudv1alpha1.FailbackPolicy{Mode: hcloudv1alpha1.FailbackImmediate}},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: setNodeReady("node-1", false)},
+			{at: 10 * time.Second, expect: expectOn("10.0.0.1", "node-3")},
+			{at: 20 * time.Second, do: setNodeReady("node-1", true)},
+			{at: 20 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"), expectEvent("0 failovers, 1 failbacks, 0 rebalances", "node-3->node-1"))},
+		},
+	},
+	{
+		name:  "ips fail back once the preferred node is stable",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{Failback: &hcloudv1alpha1.FailbackPolicy{Mode: hcloudv1alpha1.FailbackAfterStableSeconds, StableSeconds: 30}},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: setNodeReady("node-1", false)},
+			{at: 20 * time.Second, do: setNodeReady("node-1", true)},
+			{at: 45 * time.Second, expect: expectOn("10.0.0.1", "node-3")},
+			{at: 50 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"))},
+		},
+	},
+	{
+		name: "ips fail back in the maintenance window",
+		spec: hcloudv1alpha1.FloatinIPPoolSpec{Failback: &hcloudv1alpha1.FailbackPolicy{
+			Mode:   hcloudv1alpha1.FailbackMaintenanceWindow,
+			Window: &hcloudv1alpha1.MaintenanceWindow{Start: "00:10", End: "00:20", Days: []string{"Sun"}},
+		}},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: setNodeReady("node-1", false)},
+			{at: 20 * time.Second, do: setNodeReady("node-1", true)},
+			{at: 9*time.Minute + 55*time.Second, expect: expectOn("10.0.0.1", "node-3")},
+			{at: 10 * time.Minute, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"))},
+		},
+	},
+	{
+		name:  "ips go to their preferred node",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{PreferredNodes: map[string]string{"10.0.0.1": "node-3", "10.0.0.2": "node-3"}},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}},
+		timeline: []event{
+			{at: 0, expect: all(expectNoError(), expectOn("10.0.0.1", "node-3"), expectOn("10.0.0.2", "node-3"))},
+		},
+	},
+	{
+		name:  "ips return to the same nodes after a restart",
+		nodes: append(threeNodes(), testNode{name: "node-4"}, testNode{name: "node-5"}),
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2"}, {ip: "10.0.0.3"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: func(e *env) {
+				e.saved = map[string]string{}
+				for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+					e.saved[ip] = e.nodeOf(ip)
+				}
+				restart(e)
+				unassign("10.0.0.1", "10.0.0.2", "10.0.0.3")(e)
+			}},
+			{at: 10 * time.Second, expect: func(t *testing.T, e *env) {
+				for ip, node := range e.saved {
+					expectOn(ip, node)(t, e)
+				}
+			}},
+		},
+	},
+	{
+		name:  "a paused pool only reports pending moves and makes requested moves",
+		nodes: threeNodes(),
+		ips:   fourIPsOn("node-1"),
+		timeline: []event{
+			{at: 0, do: annotate(hcloudv1alpha1.PausedAnnotation, "true")},
+			{at: 0, expect: all(
+				expectNoError(),
+				expectCounts(4),
+				expectEvent(ReasonPaused),
+				expectEvent(ReasonPendingMoves, "not making 2 moves"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if !status.Paused || len(status.PendingMoves) != 2 {
+						t.Errorf("expected a paused pool with 2 pending moves, got %t %v", status.Paused, status.PendingMoves)
+					}
+				}),
+			)},
+			{at: 10 * time.Second, do: annotate(hcloudv1alpha1.MoveAnnotation, "10.0.0.4=node-3")},
+			{at: 10 * time.Second, expect: all(expectNoError(), expectCounts(3, 1), expectOn("10.0.0.4", "node-3"), expectNoAnnotation(hcloudv1alpha1.MoveAnnotation))},
+			{at: 20 * time.Second, do: annotate(hcloudv1alpha1.PausedAnnotation, "")},
+			{at: 20 * time.Second, expect: all(
+				expectNoError(),
+				expectCounts(2, 1, 1),
+				expectEvent(ReasonResumed),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if status.Paused || len(status.PendingMoves) != 0 {
+						t.Errorf("expected a resumed pool without pending moves, got %t %v", status.Paused, status.PendingMoves)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "pinned ips stay on their node",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-2"}, {ip: "10.0.0.2", on: "node-2"}, {ip: "10.0.0.3", on: "node-3"}},
+		timeline: []event{
+			{at: 0, do: annotate(hcloudv1alpha1.PinAnnotation, "10.0.0.1=node-1, 10.0.0.2=node-1")},
+			{at: 0, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"), expectOn("10.0.0.2", "node-1"), expectEvent(ReasonPinned, "10.0.0.1=node-1,10.0.0.2=node-1"))},
+			{at: 10 * time.Second, do: setNodeReady("node-1", false)},
+			{at: 10 * time.Second, expect: expectNothingOn("node-1")},
+			{at: 20 * time.Second, do: setNodeReady("node-1", true)},
+			{at: 20 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"), expectOn("10.0.0.2", "node-1"))},
+			{at: 60 * time.Second, expect: all(expectOn("10.0.0.1", "node-1"), expectOn("10.0.0.2", "node-1"))},
+		},
+	},
+	{
+		name:  "ips move as requested",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: annotate(hcloudv1alpha1.MoveAnnotation, "10.0.0.1=node-3,10.0.0.2=!node-2")},
+			{at: 10 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.1", "node-3"),
+				expectOn("10.0.0.2", "node-1"),
+				expectEvent(ReasonMoved, "10.0.0.1", "node-1 to node-3"),
+				expectEvent(ReasonMoved, "10.0.0.2", "node-2 to node-1"),
+				expectNoAnnotation(hcloudv1alpha1.MoveAnnotation),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if ip := status.IPs[0]; ip.PreferredNode != "node-3" {
+						t.Errorf("expected ip %s to prefer node-3, got %q", ip.IP, ip.PreferredNode)
+					}
+				}),
+			)},
+			{at: 60 * time.Second, expect: all(expectOn("10.0.0.1", "node-3"), expectOn("10.0.0.2", "node-1"))},
+		},
+	},
+	{
+		name:  "impossible and invalid move requests are acknowledged",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}},
+		timeline: []event{
+			{at: 0, do: annotate(hcloudv1alpha1.MoveAnnotation, "10.0.0.1=node-9")},
+			{at: 0, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"), expectEvent(ReasonMoveFailed, "node-9"), expectNoAnnotation(hcloudv1alpha1.MoveAnnotation))},
+			{at: 10 * time.Second, do: annotate(hcloudv1alpha1.MoveAnnotation, "10.0.0.9=node-2")},
+			{at: 10 * time.Second, expect: all(expectNoError(), expectOn("10.0.0.1", "node-1"), expectEvent(ReasonInvalidAnnotation, "10.0.0.9"), expectNoAnnotation(hcloudv1alpha1.MoveAnnotation))},
+		},
+	},
+	{
+		name:  "a dry run only reports the pending moves",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{DryRun: true},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1"}, {ip: "10.0.0.2", on: "node-1"}, {ip: "10.0.0.3", on: "node-1"}},
+		timeline: []event{
+			{at: 0, do: annotate(hcloudv1alpha1.MoveAnnotation, "10.0.0.2=node-3")},
+			{at: 0, expect: all(
+				expectNoError(),
+				expectCounts(2),
+				expectEvent(ReasonPendingMoves, "dry run, would make 2 moves", "10.0.0.1 -->", "10.0.0.2 node-1->node-3"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if !status.DryRun || len(status.PendingMoves) != 2 {
+						t.Errorf("expected a dry run with 2 pending moves, got %t %v", status.DryRun, status.PendingMoves)
+					}
+				}),
+			)},
+			{at: 10 * time.Second, do: func(e *env) {
+				pool := e.ipa.pool().DeepCopy()
+				pool.Spec.DryRun = false
+				e.ipa.Update(pool)
+			}},
+			{at: 10 * time.Second, expect: all(expectNoError(), expectCounts(1, 1, 1), expectOn("10.0.0.2", "node-3"), expectNoAnnotation(hcloudv1alpha1.MoveAnnotation))},
+		},
+	},
+	{
+		name:  "ips leave a drained node right away",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{FailoverAfterSeconds: 60},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-1"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: drainNode("node-1")},
+			{at: 10 * time.Second, expect: all(expectNoError(), expectNothingOn("node-1"), expectCounts(1, 1))},
+			{at: 60 * time.Second, expect: expectNothingOn("node-1")},
+		},
+	},
+	{
+		name:  "ips changed outside of the operator are reported and enforced",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}, {ip: "10.0.0.3", on: "node-3"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: func(e *env) {
+				addServer("other")(e)
+				consoleAssign("10.0.0.1", "other")(e)
+				consoleAssign("10.0.0.2", "")(e)
+			}},
+			{at: 10 * time.Second, expect: all(
+				expectNoError(),
+				expectCounts(1, 1, 1),
+				expectNothingOn("other"),
+				expectEvent(ReasonDrift, "ip 10.0.0.1 was reassigned from node node-1 to server other", "cause: assign_floating_ip action"),
+				expectEvent(ReasonDrift, "ip 10.0.0.2 was unassigned from node node-2", "cause: unassign_floating_ip action"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.Drift) != 0 {
+						t.Errorf("expected enforced drift not to be in the status, got %v", status.Drift)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "own moves are not drift when the status write failed",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{DriftPolicy: hcloudv1alpha1.DriftObserve},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}, {ip: "10.0.0.3", on: "node-3"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: func(e *env) {
+				setNodeReady("node-1", false)(e)
+				failStatusWrites(1)(e)
+			}},
+			{at: 10 * time.Second, expect: all(expectError("status write failed"), expectNothingOn("node-1"))},
+			{at: 15 * time.Second, expect: all(
+				expectNoError(),
+				expectNothingOn("node-1"),
+				func(t *testing.T, e *env) {
+					for _, ev := range e.events {
+						if strings.Contains(ev, ReasonDrift) {
+							t.Errorf("expected no drift, got event %s", ev)
+						}
+					}
+				},
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.Drift) != 0 {
+						t.Errorf("expected no drift, got %+v", status.Drift)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "ips changed outside of the operator are left alone when observing drift",
+		spec:  hcloudv1alpha1.FloatinIPPoolSpec{DriftPolicy: hcloudv1alpha1.DriftObserve},
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1", on: "node-1"}, {ip: "10.0.0.2", on: "node-2"}, {ip: "10.0.0.3", on: "node-3"}},
+		timeline: []event{
+			{at: 10 * time.Second, do: func(e *env) {
+				addServer("other")(e)
+				consoleAssign("10.0.0.1", "other")(e)
+				consoleAssign("10.0.0.2", "")(e)
+			}},
+			{at: 10 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.1", "other"),
+				expectOn("10.0.0.2", ""),
+				expectOn("10.0.0.3", "node-3"),
+				expectEvent(ReasonDrift, "ip 10.0.0.1 was reassigned", "assign_floating_ip action"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.Drift) != 2 || status.Drift[0].Kind != hcloudv1alpha1.DriftReassigned || status.Drift[1].Kind != hcloudv1alpha1.DriftUnassigned {
+						t.Fatalf("expected 2 drifted ips, got %+v", status.Drift)
+					}
+					if d := status.Drift[0]; d.ExpectedNode != "node-1" || d.ServerID == 0 || !strings.Contains(d.Cause, "assign_floating_ip") {
+						t.Errorf("unexpected drift %+v", d)
+					}
+				}),
+			)},
+			{at: 30 * time.Second, expect: all(expectOn("10.0.0.1", "other"), expectOn("10.0.0.2", ""))},
+			{at: 40 * time.Second, do: consoleAssign("10.0.0.1", "node-1")},
+			{at: 40 * time.Second, expect: all(
+				expectNoError(),
+				expectOn("10.0.0.1", "node-1"),
+				expectOn("10.0.0.2", ""),
+				expectEvent(ReasonDriftResolved, "ip 10.0.0.1"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.Drift) != 1 || status.Drift[0].IP != "10.0.0.2" {
+						t.Errorf("expected only 10.0.0.2 to be drifted, got %+v", status.Drift)
+					}
+				}),
+			)},
+			{at: 50 * time.Second, do: annotate(hcloudv1alpha1.MoveAnnotation, "10.0.0.2=node-2")},
+			{at: 50 * time.Second, expect: all(expectNoError(), expectCounts(1, 1, 1), expectOn("10.0.0.2", "node-2"))},
+			{at: 60 * time.Second, expect: all(
+				expectOn("10.0.0.2", "node-2"),
+				expectStatus(func(t *testing.T, status hcloudv1alpha1.FloatingIPPoolStatus) {
+					if len(status.Drift) != 0 {
+						t.Errorf("expected no drift after the requested move, got %+v", status.Drift)
+					}
+				}),
+			)},
+		},
+	},
+	{
+		name:  "an hcloud api error fails the reconcile",
+		nodes: threeNodes(),
+		ips:   []testIP{{ip: "10.0.0.1"}},
+		timeline: []event{
+			{at: 0, do: func(e *env) {
+				e.api.AddFault(hcloudtest.Fault{Method: "GET", Path: "/servers", Status: http.StatusServiceUnavailable, Code: string(hcloud.ErrorCodeServiceError), Message: "unavailable", Times: 1})
+			}},
+			{at: 0, expect: all(expectError("unavailable"), expectCounts())},
+			{at: 5 * time.Second, expect: all(expectNoError(), expectCounts(1))},
+		},
+	},
+}
+
+func TestScenarios(t *testing.T) {
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			runScenario(t, s)
+		})
+	}
+}
+
+func TestParallelAssignsRespectTheRateLimit(t *testing.T) {
+	s := scenario{nodes: []testNode{{name: "node-1"}, {name: "node-2"}, {name: "node-3"}}}
+	for i := 1; i <= 12; i++ {
+		s.ips = append(s.ips, testIP{ip: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	e := newEnv(s)
+	defer e.api.Close()
+
+	// The api allows twice the rate of the limiter of the operator, so only
+	// calls that skip the limiter are throttled.
+	e.api.SetRequestRate(40, 10)
+	pool, err := e.fipCli.HcloudV1alpha1().FloatingIPPools().Get(scenarioPool, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := hcloudapi.NewGuard(hcloudapi.NewLimiter(20, 5), hcloudapi.NewBreaker(5, time.Minute))
+	hcloudCli := e.api.Client()
+	cfg := Config{ActionTimeout: 5 * time.Second, AssignConcurrency: 8, MaxRetryDelay: time.Minute}
+	e.ipa = NewCustomIPAssigner(cfg, pool, e.k8sCli, e.fipCli, hcloudCli, guard, inventory.New(hcloudCli, guard, 0), metrics.Dummy, e.recorder, e.clock, kooperlog.Dummy)
+
+	if err := e.ipa.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.api.Throttled(); n > 0 {
+		t.Errorf("expected no throttled requests, got %d", n)
+	}
+	for ip, server := range e.api.Assignments() {
+		if server == 0 {
+			t.Errorf("expected %s to be assigned", ip)
+		}
+	}
+}
+
+func TestRemovedMoveAnnotationIsNoReconcileRequest(t *testing.T) {
+	newClient := func(token string) *hcloud.Client { return nil }
+	moved := &hcloudv1alpha1.FloatingIPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: scenarioPool, Annotations: map[string]string{hcloudv1alpha1.MoveAnnotation: "10.0.0.1=node-2"}},
+	}
+	handled := moved.DeepCopy()
+	delete(handled.Annotations, hcloudv1alpha1.MoveAnnotation)
+	c := NewService(Config{}, kubefake.NewSimpleClientset(), floatingipk8sfake.NewSimpleClientset(moved), "token", newClient, metrics.Dummy, record.NewFakeRecorder(100), kooperlog.Dummy)
+
+	ensure := func(fip *hcloudv1alpha1.FloatingIPPool) int {
+		if err := c.EnsureFloatingIPPool(fip); err != nil {
+			t.Fatal(err)
+		}
+		n := c.queue.Len()
+		for c.queue.Len() > 0 {
+			key, _ := c.queue.Get()
+			c.queue.Done(key)
+		}
+		return n
+	}
+
+	ensure(moved)
+	// The operator removes the annotation once the move is done.
+	if n := ensure(handled); n != 0 {
+		t.Errorf("expected no reconcile when the move annotation is removed, got %d", n)
+	}
+	// The same move requested again is a new request.
+	if n := ensure(moved); n != 1 {
+		t.Errorf("expected a reconcile when the move is requested again, got %d", n)
+	}
+}
+
+// runScenario reconciles the pool every interval until the end of the
+// timeline. The events up to and including a reconcile are applied right
+// before it, their expectations are checked right after it.
+func runScenario(t *testing.T, s scenario) {
+	e := newEnv(s)
+	defer e.api.Close()
+
+	var end time.Duration
+	for _, ev := range s.timeline {
+		if ev.at > end {
+			end = ev.at
+		}
+	}
+
+	start := e.clock.Now()
+	interval := e.ipa.Interval()
+	prev := time.Duration(-1)
+	for at := time.Duration(0); at <= end; at += interval {
+		e.clock.set(start.Add(at))
+
+		for _, ev := range s.timeline {
+			if ev.do != nil && ev.at > prev && ev.at <= at {
+				ev.do(e)
+			}
+		}
+
+		e.err = e.ipa.Reconcile()
+		e.drainEvents()
+
+		for _, ev := range s.timeline {
+			if ev.expect != nil && ev.at > prev && ev.at <= at {
+				ev.expect(t, e)
+			}
+		}
+		prev = at
+	}
+}
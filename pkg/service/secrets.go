@@ -0,0 +1,140 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// secretWatcher watches the secrets of the namespaces the pools take their
+// token from, with an informer per namespace so no access to the secrets of
+// other namespaces is needed. The secrets of a namespace whose informer
+// didn't sync yet are read from the api, so no pool waits for an informer.
+type secretWatcher struct {
+	k8sCli  kubernetes.Interface
+	handler cache.ResourceEventHandler
+
+	mutex      sync.Mutex
+	running    bool
+	namespaces map[string]*namespaceSecrets
+}
+
+// namespaceSecrets is the informer of the secrets of a namespace, it runs
+// until stopC is closed.
+type namespaceSecrets struct {
+	store      cache.Store
+	controller cache.Controller
+	stopC      chan struct{}
+}
+
+// newSecretWatcher returns a new secret watcher that calls handler when a
+// watched secret changes.
+func newSecretWatcher(k8sCli kubernetes.Interface, handler cache.ResourceEventHandler) *secretWatcher {
+	return &secretWatcher{
+		k8sCli:     k8sCli,
+		handler:    handler,
+		namespaces: map[string]*namespaceSecrets{},
+	}
+}
+
+// run starts the informers of the watched namespaces, and of the namespaces
+// watched later, until stopC is closed.
+func (s *secretWatcher) run(stopC <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.running = true
+	for _, ns := range s.namespaces {
+		go ns.controller.Run(ns.stopC)
+	}
+
+	go func() {
+		<-stopC
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		s.running = false
+		for name, ns := range s.namespaces {
+			close(ns.stopC)
+			delete(s.namespaces, name)
+		}
+	}()
+}
+
+// watch makes the watcher watch the secrets of the namespaces, the informers
+// of the namespaces that are no longer watched are stopped.
+func (s *secretWatcher) watch(namespaces map[string]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, ns := range s.namespaces {
+		if !namespaces[name] {
+			close(ns.stopC)
+			delete(s.namespaces, name)
+		}
+	}
+
+	for name := range namespaces {
+		if _, ok := s.namespaces[name]; ok {
+			continue
+		}
+		ns := s.newNamespaceSecrets(name)
+		s.namespaces[name] = ns
+		if s.running {
+			go ns.controller.Run(ns.stopC)
+		}
+	}
+}
+
+// newNamespaceSecrets returns the informer of the secrets of the namespace.
+func (s *secretWatcher) newNamespaceSecrets(namespace string) *namespaceSecrets {
+	store, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return s.k8sCli.CoreV1().Secrets(namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return s.k8sCli.CoreV1().Secrets(namespace).Watch(options)
+			},
+		},
+		&corev1.Secret{},
+		0,
+		s.handler,
+	)
+	return &namespaceSecrets{store: store, controller: controller, stopC: make(chan struct{})}
+}
+
+// get returns the secret, false when it doesn't exist.
+func (s *secretWatcher) get(namespace, name string) (*corev1.Secret, bool, error) {
+	s.mutex.Lock()
+	ns := s.namespaces[namespace]
+	s.mutex.Unlock()
+
+	if ns == nil || !ns.controller.HasSynced() {
+		secret, err := s.k8sCli.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+		switch {
+		case errors.IsNotFound(err):
+			return nil, false, nil
+		case err != nil:
+			return nil, false, err
+		}
+		return secret, true, nil
+	}
+
+	obj, ok, err := ns.store.GetByKey(namespace + "/" + name)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil, false, fmt.Errorf("%v is not a secret", obj)
+	}
+	return secret, true, nil
+}
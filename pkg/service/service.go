@@ -1,13 +1,28 @@
 package service
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
-	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
 	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8scli "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudapi"
 	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/log"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+)
+
+const (
+	// BaseRetryDelay is the delay before the first retry of a failed reconcile,
+	// it doubles on every following failure of the same pool.
+	BaseRetryDelay = 1 * time.Second
 )
 
 type Syncer interface {
@@ -15,64 +30,283 @@ type Syncer interface {
 	DeleteFloatingIPPool(name string) error
 }
 
+// Config is the service configuration.
+type Config struct {
+	// Workers is the number of pools that are reconciled concurrently.
+	Workers int
+	// MaxRetryDelay is the upper bound of the backoff between retries of a
+	// failed reconcile.
+	MaxRetryDelay time.Duration
+	// InventoryRefreshPeriod is the maximum age of the hcloud inventory shared
+	// by all the pools of an hcloud project.
+	InventoryRefreshPeriod time.Duration
+	// ActionTimeout is the time an hcloud action may take before it is
+	// considered stuck.
+	ActionTimeout time.Duration
+	// AssignConcurrency is the number of floating ips of a pool that are
+	// assigned in parallel.
+	AssignConcurrency int
+	// HCloudQPS and HCloudBurst configure the rate limiter shared by all the
+	// hcloud api calls of an hcloud project.
+	HCloudQPS   float64
+	HCloudBurst int
+	// CircuitFailureThreshold is the number of consecutive hcloud api
+	// failures that open the circuit breaker, CircuitOpenPeriod how long it
+	// stays open.
+	CircuitFailureThreshold int
+	CircuitOpenPeriod       time.Duration
+	// NodeServerKey is the annotation or label of a node that holds the id
+	// or name of its hcloud server, used when the node has no hcloud
+	// provider id.
+	NodeServerKey string
+	// DryRun only plans the moves of every pool and reports them, no
+	// floating ip is assigned.
+	DryRun bool
+	// HCloudTokenFile is the file with the token of the operator, it is
+	// reloaded when it changes. Empty when the token doesn't come from a
+	// file.
+	HCloudTokenFile string
+	// PoolDefaults are the settings of the pools that leave them unset.
+	PoolDefaults PoolDefaults
+}
+
 // Service is the service that will ensure that the desired floating ip CRDs are met.
-// Service will have running instances of IPAssigners.
+// Service keeps an IPAssigner per pool and reconciles them from a shared
+// rate limited queue keyed by pool name. Every pool is reconciled with the
+// hcloud project of its token, the secrets with the tokens are watched.
 type Service struct {
-	k8sCli    kubernetes.Interface
-	hcloudCli *hcloud.Client
-	reg       sync.Map
-	logger    log.Logger
+	cfg           Config
+	k8sCli        kubernetes.Interface
+	floatingIPCli floatingipk8scli.Interface
+	projects      *projects
+	secrets       *secretWatcher
+	queue         workqueue.RateLimitingInterface
+	metrics       metrics.Recorder
+	events        record.EventRecorder
+	logger        log.Logger
+
+	mutex sync.RWMutex
+	pools map[string]*IPAssigner
 }
 
-// NewService returns a new floating ip assigner service.
-func NewService(k8sCli kubernetes.Interface, hcloudCli *hcloud.Client, logger log.Logger) *Service {
-	return &Service{
-		k8sCli:    k8sCli,
-		hcloudCli: hcloudCli,
-		reg:       sync.Map{},
-		logger:    logger,
+// NewService returns a new floating ip assigner service, hcloudToken is the
+// token of the pools without a token secret.
+func NewService(cfg Config, k8sCli kubernetes.Interface, floatingIPCli floatingipk8scli.Interface, hcloudToken string, newHCloudClient HCloudClientFunc, recorder metrics.Recorder, events record.EventRecorder, logger log.Logger) *Service {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxRetryDelay < BaseRetryDelay {
+		cfg.MaxRetryDelay = BaseRetryDelay
+	}
+
+	rateLimiter := workqueue.NewMaxOfRateLimiter(
+		// Exponential per pool backoff on failures.
+		workqueue.NewItemExponentialFailureRateLimiter(BaseRetryDelay, cfg.MaxRetryDelay),
+		// Overall retry rate limit (10 qps, 100 bucket size) across all pools.
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+
+	c := &Service{
+		cfg:           cfg,
+		k8sCli:        k8sCli,
+		floatingIPCli: floatingIPCli,
+		queue:         workqueue.NewNamedRateLimitingQueue(rateLimiter, "floatingippools"),
+		metrics:       recorder,
+		events:        events,
+		logger:        logger,
+		pools:         map[string]*IPAssigner{},
 	}
+
+	c.secrets = newSecretWatcher(k8sCli, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.secretChanged,
+		UpdateFunc: func(_, obj interface{}) { c.secretChanged(obj) },
+		DeleteFunc: c.secretChanged,
+	})
+	c.projects = newProjects(cfg, hcloudToken, newHCloudClient, c.secrets, recorder, logger)
+
+	return c
 }
 
 // EnsureFloatingIP satisfies ServiceSyncer interface.
 func (c *Service) EnsureFloatingIPPool(fip *hcloudv1alpha1.FloatingIPPool) error {
-	ipav, ok := c.reg.Load(fip.Name)
-	var ipa *IPAssigner
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// We are already running.
+	ipa, ok := c.pools[fip.Name]
+
+	// We already know the pool.
 	if ok {
-		ipa = ipav.(*IPAssigner)
-		// If not the same spec means options have changed, so we don't longer need this ip assigner.
-		if !ipa.SameSpec(fip) {
-			c.logger.Infof("spec of %s changed, recreating ip assigner", ipa.fip.Name)
-			if err := c.DeleteFloatingIPPool(fip.Name); err != nil {
-				return err
-			}
-		} else { // We are ok, nothing changed.
+		switch {
+		// If not the same spec means options have changed, apply them in place.
+		case !ipa.SameSpec(fip):
+			c.logger.Infof("spec of %s changed, updating ip assigner", fip.Name)
+		// A reconcile was requested through the reconcile or a control annotation.
+		case ipa.ReconcileRequested(fip):
+			c.logger.Infof("reconcile of %s requested", fip.Name)
+		// We are ok, nothing changed that needs a reconcile, the pool is
+		// kept up to date, e.g. without a handled move annotation.
+		default:
+			ipa.Update(fip.DeepCopy())
 			return nil
 		}
+		ipa.Update(fip.DeepCopy())
+		c.watchSecrets()
+		c.queue.Add(fip.Name)
+		return nil
 	}
 
-	// Create an ip assigner.
+	// Create an ip assigner, its hcloud project is set before every
+	// reconcile.
 	fipCopy := fip.DeepCopy()
-	ipa = NewIPAssigner(fipCopy, c.k8sCli, c.hcloudCli, c.logger)
-	c.reg.Store(fip.Name, ipa)
-	return ipa.Start()
-	// TODO: garbage collection.
+	c.pools[fip.Name] = NewIPAssigner(c.cfg, fipCopy, c.k8sCli, c.floatingIPCli, nil, nil, nil, c.metrics, c.events, c.logger)
+	c.watchSecrets()
+	c.queue.Add(fip.Name)
+	c.logger.Infof("added %s ip assigner", fip.Name)
+	return nil
 }
 
 // DeleteFloatingIP satisfies ServiceSyncer interface.
 func (c *Service) DeleteFloatingIPPool(name string) error {
-	ipav, ok := c.reg.Load(name)
-	if !ok {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.pools[name]; !ok {
 		return nil
 	}
 
-	ipa := ipav.(*IPAssigner)
-	if err := ipa.Stop(); err != nil {
-		return err
+	// Pending reconciles of the pool are dropped by the workers.
+	delete(c.pools, name)
+	c.watchSecrets()
+	c.projects.release(name)
+	c.queue.Forget(name)
+	c.metrics.DeletePool(name)
+	c.logger.Infof("removed %s ip assigner", name)
+	return nil
+}
+
+// Run starts the reconcile workers and blocks until stopC is closed.
+func (c *Service) Run(stopC <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	c.secrets.run(stopC)
+	if c.cfg.HCloudTokenFile != "" {
+		go c.watchTokenFile(stopC)
 	}
 
-	c.reg.Delete(name)
-	return nil
+	c.logger.Infof("starting %d ip assigner workers", c.cfg.Workers)
+	for i := 0; i < c.cfg.Workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopC)
+	}
+
+	<-stopC
+	c.logger.Infof("stopping ip assigner workers")
+}
+
+// runWorker processes pools from the queue until the queue is shut down.
+func (c *Service) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+// processNextItem reconciles the next pool of the queue, returns false when
+// the queue has been shut down.
+func (c *Service) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	name, ok := key.(string)
+	if !ok {
+		c.queue.Forget(key)
+		c.logger.Errorf("%v is not a valid pool key", key)
+		return true
+	}
+
+	ipa := c.get(name)
+	// The pool has been deleted in the meantime.
+	if ipa == nil {
+		c.queue.Forget(key)
+		return true
+	}
+
+	if err := c.reconcile(ipa); err != nil {
+		c.logger.Errorf("error reconciling %s (%d retries): %s", name, c.queue.NumRequeues(key), err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	// Reconciled, resets the backoff and reconcile again after the interval
+	// or when a failover grace period ends.
+	c.queue.Forget(key)
+	c.queue.AddAfter(key, ipa.NextReconcile())
+	return true
+}
+
+// reconcile reconciles the pool with the hcloud project of its token and
+// reports whether the token is valid in the credentials condition of the
+// pool.
+func (c *Service) reconcile(ipa *IPAssigner) error {
+	proj, err := c.projects.get(ipa.pool())
+	if err != nil {
+		return ipa.reportCredentials(err)
+	}
+	ipa.useProject(proj)
+
+	err = ipa.Reconcile()
+	c.metrics.SetHCloudAPIState(proj.name, string(proj.guard.CircuitState()), proj.guard.Remaining())
+	switch {
+	case hcloudapi.IsUnauthorized(err):
+		c.logger.Errorf("the hcloud api rejected the token of project %s, it expired or was revoked", proj.name)
+		c.metrics.ObserveUnauthorized(proj.name)
+		// The token file might have changed since it was last read.
+		if proj.name == defaultProject && c.cfg.HCloudTokenFile != "" {
+			c.reloadToken()
+		}
+		return ipa.reportCredentials(&CredentialsError{
+			Reason:  CredentialsReasonUnauthorized,
+			Message: fmt.Sprintf("the hcloud token of project %s was rejected: %s", proj.name, err),
+		})
+	case err == nil:
+		return ipa.reportCredentials(nil)
+	}
+	return err
+}
+
+// watchSecrets watches the secrets of the namespaces the pools take their
+// token from. The mutex must be held.
+func (c *Service) watchSecrets() {
+	namespaces := map[string]bool{}
+	for _, ipa := range c.pools {
+		if ref := ipa.pool().Spec.TokenSecretRef; ref != nil {
+			namespaces[ref.Namespace] = true
+		}
+	}
+	c.secrets.watch(namespaces)
+}
+
+// secretChanged reconciles the pools that take their token from the secret.
+func (c *Service) secretChanged(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for name, ipa := range c.pools {
+		ref := ipa.pool().Spec.TokenSecretRef
+		if ref != nil && ref.Namespace+"/"+ref.Name == key {
+			c.logger.Infof("token secret %s of %s changed", key, name)
+			c.queue.Add(name)
+		}
+	}
+}
+
+// get returns the ip assigner of a pool or nil when the pool is unknown.
+func (c *Service) get(name string) *IPAssigner {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pools[name]
 }
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"reflect"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+)
+
+// buildStatus returns the status of the pool for the given placement of its
+// floating ips, placed holds the (verified) target of every floating ip that
+// is assigned to a node of the pool and preferred the preferred node of the
+// floating ips that have one. Floating ips without one prefer the node they
+// are on from now on.
+func (p *IPAssigner) buildStatus(hetznerIps []*hcloud.FloatingIP, placed map[int]*target, targets []*target, preferred map[string]string) hcloudv1alpha1.FloatingIPPoolStatus {
+	previous := map[string]hcloudv1alpha1.IPStatus{}
+	for _, ip := range p.status.IPs {
+		previous[ip.IP] = ip
+	}
+
+	status := hcloudv1alpha1.FloatingIPPoolStatus{
+		IPs:            make([]hcloudv1alpha1.IPStatus, len(hetznerIps)),
+		CircuitBreaker: string(p.guard.CircuitState()),
+		Conditions:     p.status.Conditions,
+	}
+
+	for _, t := range targets {
+		if t.failing {
+			status.FailingNodes = append(status.FailingNodes, hcloudv1alpha1.FailingNode{
+				Node:  t.node.Name,
+				Since: metav1.NewTime(t.failingSince),
+			})
+		}
+	}
+	status.QuarantinedNodes = p.quarantinedNodes()
+
+	for i, fip := range hetznerIps {
+		ip := hcloudv1alpha1.IPStatus{
+			IP: fip.IP.String(),
+		}
+		ip.PreferredNode = preferred[ip.IP]
+		if t, ok := placed[fip.ID]; ok {
+			ip.Node = t.node.Name
+			ip.ServerID = t.server.ID
+			if ip.PreferredNode == "" {
+				ip.PreferredNode = t.node.Name
+			}
+		}
+		if b, ok := p.backoffs[ip.IP]; ok {
+			ip.Failures = b.failures
+			ip.LastError = b.lastError
+		}
+
+		// Only a move to another node is a transition.
+		if prev, ok := previous[ip.IP]; ok && prev.Node == ip.Node && prev.ServerID == ip.ServerID {
+			ip.LastTransitionTime = prev.LastTransitionTime
+		} else {
+			ip.LastTransitionTime = metav1.NewTime(p.time.Now())
+		}
+
+		status.IPs[i] = ip
+	}
+
+	return status
+}
+
+// setCondition sets the condition in the status, its transition time only
+// changes when its status does. It returns the previous status of the
+// condition and false when nothing changed.
+func setCondition(status *hcloudv1alpha1.FloatingIPPoolStatus, cond hcloudv1alpha1.PoolCondition, now metav1.Time) (corev1.ConditionStatus, bool) {
+	for i, c := range status.Conditions {
+		if c.Type != cond.Type {
+			continue
+		}
+		if c.Status == cond.Status && c.Reason == cond.Reason && c.Message == cond.Message {
+			return c.Status, false
+		}
+
+		cond.LastTransitionTime = c.LastTransitionTime
+		if c.Status != cond.Status {
+			cond.LastTransitionTime = now
+		}
+		status.Conditions[i] = cond
+		return c.Status, true
+	}
+
+	cond.LastTransitionTime = now
+	status.Conditions = append(status.Conditions, cond)
+	return corev1.ConditionUnknown, true
+}
+
+// updateStatus writes the status of the pool when it changed since it was
+// last written.
+func (p *IPAssigner) updateStatus(name string, status hcloudv1alpha1.FloatingIPPoolStatus) error {
+	if reflect.DeepEqual(p.status, status) {
+		return nil
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		fip, err := p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		fip.Status = *status.DeepCopy()
+		_, err = p.floatingIPCli.HcloudV1alpha1().FloatingIPPools().Update(fip)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	p.status = status
+	return nil
+}
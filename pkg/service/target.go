@@ -0,0 +1,233 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/inventory"
+)
+
+const (
+	// DefaultNodeServerKey is the default annotation or label of a node that
+	// holds the id or name of its hcloud server.
+	DefaultNodeServerKey = "hcloud.zenjoy.be/server"
+
+	// providerIDPrefix is the prefix of the provider id the hcloud cloud
+	// controller manager sets on nodes, followed by the server id.
+	providerIDPrefix = "hcloud://"
+)
+
+// Event reasons.
+const (
+	// ReasonServerNotFound is the reason of the event on a node without a
+	// matching hcloud server.
+	ReasonServerNotFound = "ServerNotFound"
+)
+
+// target is a node of the pool that floating ips can be assigned to,
+// together with its hcloud server.
+type target struct {
+	node   *corev1.Node
+	server *hcloud.Server
+	// domain is the topology domain of the node, empty when the pool has no
+	// topology key or the node is not in any domain.
+	domain string
+	// failing is set on a node that is failing but still within the failover
+	// grace period, it keeps its floating ips but gets no new ones.
+	// failingSince is the time it started failing.
+	failing      bool
+	failingSince time.Time
+	// quarantined is set on a flapping node, it keeps its floating ips but
+	// gets no new ones.
+	quarantined bool
+}
+
+// keepsOnly returns true when the node keeps its floating ips but gets no
+// new ones.
+func (t *target) keepsOnly() bool {
+	return t.failing || t.quarantined
+}
+
+// getTargets returns the nodes that are eligible to receive floating ips of
+// the pool, in the same order. Drained nodes are skipped, nodes without a
+// matching hcloud server are not eligible and reported with an event when
+// they become unresolved or the reason changes, nodes
+// whose server doesn't match the server selector are skipped. Failing nodes,
+// not ready or with a server that isn't running, are skipped once the
+// failover grace period passed.
+func (p *IPAssigner) getTargets(fip *hcloudv1alpha1.FloatingIPPool, nodes []corev1.Node, inv *inventory.Snapshot) []*target {
+	targets := make([]*target, 0, len(nodes))
+	selector := labels.SelectorFromSet(fip.Spec.ServerSelector)
+	grace := time.Duration(fip.Spec.FailoverAfterSeconds) * time.Second
+	seen := make(map[string]bool, len(nodes))
+	unresolved := map[string]string{}
+	p.graceEnds = time.Time{}
+
+	for i := range nodes {
+		node := &nodes[i]
+
+		if node.Annotations[hcloudv1alpha1.DrainAnnotation] == "true" {
+			p.logger.Infof("%s node %s is not eligible: node is drained", fip.Name, node.Name)
+			continue
+		}
+
+		server, err := p.resolveServer(node, inv)
+		if err != nil {
+			unresolved[node.Name] = err.Error()
+			if p.unresolved[node.Name] == err.Error() {
+				p.logger.Infof("%s node %s is not eligible: %s", fip.Name, node.Name, err)
+				continue
+			}
+			p.logger.Warningf("%s node %s is not eligible: %s", fip.Name, node.Name, err)
+			p.events.Eventf(node, corev1.EventTypeWarning, ReasonServerNotFound, "node is not eligible for floating ips of pool %s: %s", fip.Name, err)
+			continue
+		}
+
+		if !selector.Matches(labels.Set(inv.ServerLabels(server.ID))) {
+			p.logger.Infof("%s node %s is not eligible: server %s does not match the server selector %s", fip.Name, node.Name, server.Name, selector)
+			continue
+		}
+
+		failure := nodeFailure(node, server)
+		h := p.observeNode(node.Name, failure == nil)
+		seen[node.Name] = true
+
+		flapping := p.checkFlapping(fip, node, h)
+
+		t := &target{node: node, server: server, domain: topologyDomain(fip.Spec.TopologyKey, node, server, inv)}
+		if failure != nil {
+			since := p.failingSince(node, h)
+			ends := since.Add(grace)
+			left := ends.Sub(p.time.Now())
+			if left <= 0 {
+				p.logger.Infof("%s node %s is not eligible: %s", fip.Name, node.Name, failure)
+				continue
+			}
+			p.logger.Infof("%s node %s is failing, its ips fail over in %s: %s", fip.Name, node.Name, left, failure)
+			t.failing = true
+			t.failingSince = since
+			if p.graceEnds.IsZero() || ends.Before(p.graceEnds) {
+				p.graceEnds = ends
+			}
+		}
+		if flapping {
+			p.logger.Infof("%s node %s is quarantined, it keeps its ips but gets no new ones", fip.Name, node.Name)
+			t.quarantined = true
+		}
+
+		targets = append(targets, t)
+	}
+
+	p.forgetNodes(seen)
+	p.unresolved = unresolved
+	return targets
+}
+
+// nodeFailure returns why the node is failing, nil when it is healthy. The
+// node must be ready and its server running and not locked by a pending
+// action.
+func nodeFailure(node *corev1.Node, server *hcloud.Server) error {
+	if !nodeReady(node) {
+		return fmt.Errorf("node is not ready")
+	}
+	if server.Status != hcloud.ServerStatusRunning {
+		return fmt.Errorf("server %s is %s", server.Name, server.Status)
+	}
+	if server.Locked {
+		return fmt.Errorf("server %s is locked by a pending action", server.Name)
+	}
+	return nil
+}
+
+// nodeReady returns true when the ready condition of the node is true.
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// resolveServer returns the hcloud server of a node. The provider id of the
+// node is preferred, then the node server annotation or label, the name of
+// the node and finally its addresses.
+func (p *IPAssigner) resolveServer(node *corev1.Node, inv *inventory.Snapshot) (*hcloud.Server, error) {
+	if strings.HasPrefix(node.Spec.ProviderID, providerIDPrefix) {
+		id, err := strconv.Atoi(strings.TrimPrefix(node.Spec.ProviderID, providerIDPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid provider id %s: %s", node.Spec.ProviderID, err)
+		}
+		if server := inv.ServerByID(id); server != nil {
+			return server, nil
+		}
+		return nil, fmt.Errorf("no hcloud server with id %d (provider id %s)", id, node.Spec.ProviderID)
+	}
+
+	key := p.cfg.NodeServerKey
+	if key == "" {
+		key = DefaultNodeServerKey
+	}
+	value, ok := node.Annotations[key]
+	if !ok {
+		value, ok = node.Labels[key]
+	}
+	if ok {
+		if id, err := strconv.Atoi(value); err == nil {
+			if server := inv.ServerByID(id); server != nil {
+				return server, nil
+			}
+		}
+		if server := inv.ServerByName(value); server != nil {
+			return server, nil
+		}
+		return nil, fmt.Errorf("no hcloud server with id or name %s (%s)", value, key)
+	}
+
+	if server := inv.ServerByName(node.Name); server != nil {
+		return server, nil
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != corev1.NodeInternalIP && addr.Type != corev1.NodeExternalIP {
+			continue
+		}
+		if server := inv.ServerByIP(addr.Address); server != nil {
+			return server, nil
+		}
+	}
+	return nil, fmt.Errorf("no hcloud server named %s or with its ips, set the provider id or the %s annotation of the node", node.Name, key)
+}
+
+// location returns the hcloud location of the server.
+func location(server *hcloud.Server) string {
+	if server.Datacenter == nil || server.Datacenter.Location == nil {
+		return ""
+	}
+	return server.Datacenter.Location.Name
+}
+
+// topologyDomain returns the domain of the node for the topology key.
+func topologyDomain(key string, node *corev1.Node, server *hcloud.Server, inv *inventory.Snapshot) string {
+	switch key {
+	case "":
+		return ""
+	case hcloudv1alpha1.TopologyLocation:
+		return location(server)
+	case hcloudv1alpha1.TopologyDatacenter:
+		if server.Datacenter != nil {
+			return server.Datacenter.Name
+		}
+		return ""
+	case hcloudv1alpha1.TopologyPlacementGroup:
+		return inv.ServerPlacementGroup(server.ID)
+	default:
+		return node.Labels[key]
+	}
+}
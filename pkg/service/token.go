@@ -0,0 +1,61 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// TokenFilePeriod is the time between two reads of the hcloud token file.
+	TokenFilePeriod = 10 * time.Second
+)
+
+// ReadTokenFile returns the hcloud api token in the file, surrounding white
+// space is ignored.
+func ReadTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("hcloud token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// watchTokenFile reloads the hcloud token file every TokenFilePeriod until
+// stopC is closed.
+func (c *Service) watchTokenFile(stopC <-chan struct{}) {
+	c.logger.Infof("watching hcloud token file %s", c.cfg.HCloudTokenFile)
+	wait.Until(c.reloadToken, TokenFilePeriod, stopC)
+}
+
+// reloadToken reads the hcloud token file and, when the token changed, makes
+// the pools without a token secret use it. A reconcile that is running keeps
+// the client it started with, the pools switch on their next reconcile which
+// is queued right away.
+func (c *Service) reloadToken() {
+	token, err := ReadTokenFile(c.cfg.HCloudTokenFile)
+	if err != nil {
+		c.logger.Errorf("error reading the hcloud token, keeping the current one: %s", err)
+		return
+	}
+	if !c.projects.setToken(token) {
+		return
+	}
+
+	c.logger.Infof("hcloud token file %s changed, switching to the new token", c.cfg.HCloudTokenFile)
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for name, ipa := range c.pools {
+		if ipa.pool().Spec.TokenSecretRef == nil {
+			c.queue.Add(name)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	kooperlog "github.com/spotahome/kooper/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	hcloudv1alpha1 "github.com/zenjoy/hcloud-floating-ip-operator/apis/hcloud/v1alpha1"
+	floatingipk8sfake "github.com/zenjoy/hcloud-floating-ip-operator/client/k8s/clientset/versioned/fake"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/hcloudtest"
+	"github.com/zenjoy/hcloud-floating-ip-operator/pkg/metrics"
+)
+
+func TestRotatedTokenFileIsReloaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	writeToken := func(token string) {
+		if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := hcloudtest.NewAPI()
+	defer api.Close()
+	api.SetToken("old")
+	api.AddServer(hcloudtest.Server{ID: 100, Name: "node-a", Location: "fsn1", Datacenter: "fsn1-dc1"})
+	api.AddFloatingIP(hcloudtest.FloatingIP{IP: "10.0.0.1", ServerID: 100})
+	newClient := func(token string) *hcloud.Client {
+		return api.Client(hcloud.WithToken(token))
+	}
+
+	writeToken("old")
+	token, err := ReadTokenFile(path)
+	if err != nil || token != "old" {
+		t.Fatalf("expected the old token, got %q, %v", token, err)
+	}
+
+	pool := &hcloudv1alpha1.FloatingIPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "a"},
+		Spec:       hcloudv1alpha1.FloatinIPPoolSpec{Ips: []string{"10.0.0.1"}},
+	}
+	k8sCli := kubefake.NewSimpleClientset(projectNode("node-a", "a", 100))
+	fipCli := floatingipk8sfake.NewSimpleClientset(pool)
+	cfg := Config{ActionTimeout: 5 * time.Second, HCloudQPS: 1000, HCloudBurst: 1000, CircuitFailureThreshold: 5, CircuitOpenPeriod: time.Minute, HCloudTokenFile: path}
+	c := NewService(cfg, k8sCli, fipCli, token, newClient, metrics.Dummy, record.NewFakeRecorder(100), kooperlog.Dummy)
+	if err := c.EnsureFloatingIPPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := c.queue.Get()
+	c.queue.Done(key)
+
+	if err := c.reconcile(c.get("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token expires before the file is rotated.
+	api.SetToken("new")
+	if err := c.reconcile(c.get("a")); err == nil {
+		t.Errorf("expected an error with the expired token")
+	}
+	if cond := credentialsCondition(t, fipCli, "a"); cond.Status != corev1.ConditionFalse || cond.Reason != CredentialsReasonUnauthorized {
+		t.Errorf("expected a rejected token, got %+v", cond)
+	}
+
+	// An unreadable file keeps the current token.
+	os.Remove(path)
+	c.reloadToken()
+	if c.queue.Len() != 0 {
+		t.Errorf("expected no reconcile without a token file")
+	}
+
+	writeToken("new")
+	c.reloadToken()
+	if c.queue.Len() != 1 {
+		t.Fatalf("expected the pool to be reconciled with the new token")
+	}
+	if err := c.reconcile(c.get("a")); err != nil {
+		t.Fatal(err)
+	}
+	if cond := credentialsCondition(t, fipCli, "a"); cond.Status != corev1.ConditionTrue {
+		t.Errorf("expected valid credentials, got %+v", cond)
+	}
+	if n := len(c.projects.byToken); n != 1 {
+		t.Errorf("expected the project of the old token to be dropped, got %d projects", n)
+	}
+}
+
+func TestTokenRevokedDuringAssignmentIsReloaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api := hcloudtest.NewAPI()
+	defer api.Close()
+	api.SetToken("old")
+	api.AddServer(hcloudtest.Server{ID: 100, Name: "node-a", Location: "fsn1", Datacenter: "fsn1-dc1"})
+	api.AddFloatingIP(hcloudtest.FloatingIP{IP: "10.0.0.1"})
+	newClient := func(token string) *hcloud.Client {
+		return api.Client(hcloud.WithToken(token))
+	}
+
+	pool := &hcloudv1alpha1.FloatingIPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "a"},
+		Spec:       hcloudv1alpha1.FloatinIPPoolSpec{Ips: []string{"10.0.0.1"}},
+	}
+	k8sCli := kubefake.NewSimpleClientset(projectNode("node-a", "a", 100))
+	fipCli := floatingipk8sfake.NewSimpleClientset(pool)
+	cfg := Config{ActionTimeout: 5 * time.Second, HCloudQPS: 1000, HCloudBurst: 1000, CircuitFailureThreshold: 5, CircuitOpenPeriod: time.Minute, HCloudTokenFile: path}
+	c := NewService(cfg, k8sCli, fipCli, "old", newClient, metrics.Dummy, record.NewFakeRecorder(100), kooperlog.Dummy)
+	if err := c.EnsureFloatingIPPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := c.queue.Get()
+	c.queue.Done(key)
+
+	// The token is revoked between listing and assigning, the file already
+	// has the new one.
+	api.AddFault(hcloudtest.Fault{Method: "POST", Path: "/floating_ips/", Status: 401, Code: "unauthorized", Message: "unable to authenticate"})
+	if err := ioutil.WriteFile(path, []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile(c.get("a")); err == nil {
+		t.Errorf("expected an error with the revoked token")
+	}
+	if cond := credentialsCondition(t, fipCli, "a"); cond.Status != corev1.ConditionFalse || cond.Reason != CredentialsReasonUnauthorized {
+		t.Errorf("expected a rejected token, got %+v", cond)
+	}
+	if c.projects.token != "new" {
+		t.Errorf("expected the token file to be reloaded, got token %q", c.projects.token)
+	}
+}